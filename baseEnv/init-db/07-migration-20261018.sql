@@ -0,0 +1,24 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H2. 新建 hvac.warning_rule 表，存放 nb67_event_builder 的声明式预警规则
+--       （rules_source: postgres），规则格式见 connect-nb67/rule_engine.go
+-- 说明：所有语句幂等，可重复执行
+--       表为空或规则编译失败时，event-builder 回退到内置默认规则
+--       （connect-nb67/hvac_predict_rules.yaml）
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H2. hvac.warning_rule：一行对应默认规则文件中 rules 列表的一项
+--     definition 为单条规则的 JSON（字段与 YAML 相同：id/seq/name/severity/expand/let/when）
+--     按 sort_order, rule_id 顺序求值，决定同一帧内预警命中的输出顺序
+-- ----------------------------------------------------------------------------
+CREATE TABLE IF NOT EXISTS hvac.warning_rule (
+    rule_id     VARCHAR(64)  PRIMARY KEY,
+    sort_order  INT          NOT NULL DEFAULT 0,
+    enabled     BOOLEAN      NOT NULL DEFAULT TRUE,
+    definition  JSONB        NOT NULL,
+    updated_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE hvac.warning_rule IS 'event-builder 声明式预警规则，启动时加载并编译';
@@ -0,0 +1,26 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H3. hvac.warning_config 写入后 NOTIFY warning_config_changed，
+--       nb67_event_builder 的 ConfigStore 收到通知后立即重新加载阈值
+--       （轮询仅作兜底，周期由 config_poll_interval 配置）
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H3. 语句级触发器：一次批量 UPDATE（如"恢复出厂默认"）只发送一条通知
+--     payload 为操作类型，ConfigStore 不解析 payload，始终全量加载
+-- ----------------------------------------------------------------------------
+CREATE OR REPLACE FUNCTION hvac.notify_warning_config_changed()
+RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('warning_config_changed', TG_OP);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_warning_config_notify ON hvac.warning_config;
+CREATE TRIGGER trg_warning_config_notify
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON hvac.warning_config
+    FOR EACH STATEMENT
+    EXECUTE FUNCTION hvac.notify_warning_config_changed();
@@ -0,0 +1,41 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H4. hvac.rule_state 增加 counter_value，持久化 nb67_event_builder 的部件累计计数器基线，
+--       使停机/离线期间发生的部件更换在恢复后仍能识别（见 connect-nb67/part_replacement.go）
+--   H5. 新建 hvac.part_history 表，storage-adapter 消费 signal-replacement 写入部件更换履历
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H4. counter_value：state_key = device_id || ':__counter:' || raw 字段名 的行使用，计时器行为 NULL
+-- ----------------------------------------------------------------------------
+ALTER TABLE hvac.rule_state ADD COLUMN IF NOT EXISTS counter_value BIGINT;
+
+COMMENT ON COLUMN hvac.rule_state.counter_value IS '部件累计计数器基线（秒或次），仅 __counter 伪规则行使用';
+
+-- ----------------------------------------------------------------------------
+-- H5. hvac.part_history：一行对应一次部件更换（计数器回落）
+--     replaced_at 为确认更换那一帧的设备时间；previous_value/current_value 为回落前后的累计值
+--     某部件当前在用周期的起点 = 该部件最近一次 replaced_at（无记录则为投用时间）
+-- ----------------------------------------------------------------------------
+CREATE TABLE IF NOT EXISTS hvac.part_history (
+    replaced_at     TIMESTAMPTZ  NOT NULL,
+    ingest_time     TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    line_id         INTEGER,
+    train_id        INTEGER,
+    carriage_id     INTEGER,
+    device_id       VARCHAR(64)  NOT NULL,
+    part_code       VARCHAR(32)  NOT NULL,
+    part_name       TEXT,
+    counter_field   VARCHAR(64),
+    counter_kind    VARCHAR(16),                 -- fan | comp | valve
+    previous_value  BIGINT,                      -- 更换前累计值（秒或次）
+    current_value   BIGINT,                      -- 更换后累计值（秒或次）
+    payload_json    JSONB,
+    PRIMARY KEY (device_id, part_code, replaced_at)
+);
+
+COMMENT ON TABLE hvac.part_history IS '部件更换履历（累计计数器回落检测），寿命跟踪据此分段';
+
+CREATE INDEX IF NOT EXISTS ix_part_history_train ON hvac.part_history (train_id, carriage_id, part_code, replaced_at DESC);
@@ -0,0 +1,73 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H6. hvac.warning_config 新增 default_params 列，Reset 时一并恢复 params
+--   H7. 新增部件寿命配置行 WARN_LIFE_FAN / WARN_LIFE_COMP / WARN_LIFE_VALVE（category = life），
+--       nb67_event_builder 的寿命预警（LifeHit.Limit）改由此处配置，见 connect-nb67/config_store.go
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H6. default_params：出厂默认 params（Reset 功能用）
+-- ----------------------------------------------------------------------------
+ALTER TABLE hvac.warning_config ADD COLUMN IF NOT EXISTS default_params JSONB;
+
+COMMENT ON COLUMN hvac.warning_config.default_params IS '出厂默认 params（Reset 功能用）';
+
+-- ----------------------------------------------------------------------------
+-- H7. 部件寿命配置
+--     trigger_value   额定寿命，单位见 unit（h 或 次）；原始计数器值 = trigger_value × params.raw_scale
+--     params.warn_pct 达到额定寿命的该比例（%）输出预警（severity 2）
+--     params.crit_pct 达到额定寿命的该比例（%）输出严重预警（severity 3）
+--     params.overrides 按线路 / 车厢 / 部件码覆盖，空字段表示不限，最具体的匹配项优先，例如：
+--       [{"line_id": "7", "carriage_id": "", "part_code": "56003", "rated_life": 40000, "warn_pct": 80, "crit_pct": 95}]
+--       rated_life / warn_pct / crit_pct 为 0 或缺省时沿用本行的值
+--     enabled = false 时不输出该类寿命预警
+-- ----------------------------------------------------------------------------
+INSERT INTO hvac.warning_config
+    (warn_code, component_name, category, threshold_good, threshold_normal, threshold_bad,
+     trigger_operator, trigger_value, clear_value, duration_seconds, unit, strategy, params)
+SELECT 'WARN_LIFE_FAN', '风机寿命预警', 'life',
+       '<75%', '75%~90%', '≥90%',
+       '>=', 25000, NULL, 0,
+       'h', E'1、检查风机运行声音及振动\n2、计划在下次检修时更换风机',
+       '{"raw_scale": 3600, "warn_pct": 75, "crit_pct": 90, "overrides": []}'::jsonb
+WHERE NOT EXISTS (SELECT 1 FROM hvac.warning_config WHERE warn_code = 'WARN_LIFE_FAN');
+
+INSERT INTO hvac.warning_config
+    (warn_code, component_name, category, threshold_good, threshold_normal, threshold_bad,
+     trigger_operator, trigger_value, clear_value, duration_seconds, unit, strategy, params)
+SELECT 'WARN_LIFE_COMP', '压缩机寿命预警', 'life',
+       '<75%', '75%~90%', '≥90%',
+       '>=', 50000, NULL, 0,
+       'h', E'1、检查压缩机运行电流及压力\n2、计划在下次检修时更换压缩机',
+       '{"raw_scale": 3600, "warn_pct": 75, "crit_pct": 90, "overrides": []}'::jsonb
+WHERE NOT EXISTS (SELECT 1 FROM hvac.warning_config WHERE warn_code = 'WARN_LIFE_COMP');
+
+INSERT INTO hvac.warning_config
+    (warn_code, component_name, category, threshold_good, threshold_normal, threshold_bad,
+     trigger_operator, trigger_value, clear_value, duration_seconds, unit, strategy, params)
+SELECT 'WARN_LIFE_VALVE', '阀门寿命预警', 'life',
+       '<75%', '75%~90%', '≥90%',
+       '>=', 1000000, NULL, 0,
+       '次', E'1、检查风阀、旁通阀动作是否顺畅\n2、计划在下次检修时更换阀门',
+       '{"raw_scale": 1, "warn_pct": 75, "crit_pct": 90, "overrides": []}'::jsonb
+WHERE NOT EXISTS (SELECT 1 FROM hvac.warning_config WHERE warn_code = 'WARN_LIFE_VALVE');
+
+-- 出厂默认值：寿命行写入 default_* 列；各行 default_params 取当前 params（仅未设置时），
+-- WARN_CABIN_OVERHEAT 去掉 05 测试模式追加的 min_cooling_runtime_s
+UPDATE hvac.warning_config SET
+    default_trigger_value    = trigger_value,
+    default_clear_value      = clear_value,
+    default_duration_seconds = duration_seconds,
+    default_threshold_good   = threshold_good,
+    default_threshold_normal = threshold_normal,
+    default_threshold_bad    = threshold_bad,
+    default_strategy         = strategy
+WHERE category = 'life' AND default_trigger_value IS NULL;
+
+UPDATE hvac.warning_config SET
+    default_params = CASE WHEN warn_code = 'WARN_CABIN_OVERHEAT'
+                          THEN params - 'min_cooling_runtime_s'
+                          ELSE params END
+WHERE default_params IS NULL AND params IS NOT NULL;
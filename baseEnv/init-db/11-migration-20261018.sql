@@ -0,0 +1,27 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H8. hvac.fact_event 改为一行一个发作周期（episode）：storage-adapter 对同一设备、事件类型、故障码
+--       只保留一条未恢复记录，重复命中累加 hit_count 并刷新 last_seen_time，
+--       命中消失时写入 recovery_time（见 connect/cmd/storage-adapter/consumer.go upsertEventSQL）
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H8. 新增 last_seen_time / hit_count
+-- ----------------------------------------------------------------------------
+ALTER TABLE hvac.fact_event
+    ADD COLUMN IF NOT EXISTS last_seen_time TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS hit_count      INTEGER NOT NULL DEFAULT 1;
+
+COMMENT ON COLUMN hvac.fact_event.event_time     IS '发作开始时间（设备时间），即该故障码首次命中的帧时间';
+COMMENT ON COLUMN hvac.fact_event.last_seen_time IS '本次发作最后一次命中的帧时间';
+COMMENT ON COLUMN hvac.fact_event.hit_count      IS '本次发作累计命中帧数';
+
+-- 查找未恢复的发作周期（hypertable 的唯一索引必须包含 event_time，故用普通部分索引）
+CREATE INDEX IF NOT EXISTS ix_fact_event_open
+    ON hvac.fact_event (device_id, event_type, fault_code)
+    WHERE recovery_time IS NULL;
+
+-- 存量数据：此前每帧一行，last_seen_time 为 NULL，本迁移不做改写（其中可能有仍在发作的告警）。
+-- storage-adapter 只续写/关闭 last_seen_time 非空的发作记录，存量行保持原状，按历史数据查询
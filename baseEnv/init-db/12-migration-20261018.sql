@@ -0,0 +1,11 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H9. hvac.rule_state 增加 fired，持久化规则是否已触发：迟滞阈值只在预警生效后切换到消除值，
+--       计时中尚未触发的规则仍按触发值判定（见 connect-nb67/nb67_event_processor.go checkRule）
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+ALTER TABLE hvac.rule_state ADD COLUMN IF NOT EXISTS fired BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMENT ON COLUMN hvac.rule_state.fired IS '规则已触发（预警生效中），按 clear 阈值判定消除；计时中为 false';
@@ -2,9 +2,16 @@ package main
 
 // config_store.go
 //
-// 从 hvac.warning_config 表热加载预警阈值，每 30s 轮询一次。
+// 从 hvac.warning_config 表热加载预警阈值。
 // 使用 atomic.Value 整体替换配置 map，读取零锁争用。
 //
+// 刷新方式：
+//   - LISTEN warning_config_changed：warning_config 上的触发器在每次写入后 NOTIFY，
+//     Web UI 修改阈值后立即生效（触发器见 08-migration-20261018.sql）
+//   - 轮询兜底：按 config_poll_interval 定期全量加载，覆盖监听连接断开期间遗漏的通知
+//   - 每次加载计算配置版本（内容哈希），变化时记录日志，并随事件 event_meta.config_version 下发，
+//     便于追溯某条预警由哪一版阈值产生
+//
 // 设计约定：
 //   - warn_code 对应 warning_config.warn_code，一行驱动同类型所有 check
 //     （如 WARN_EF_CURRENT 控制 HVAC_12~15 四个通风机电流检查）
@@ -13,38 +20,92 @@ package main
 //     raw_threshold = trigger_value × raw_scale
 //   - duration_seconds > 0 时覆盖硬编码持续时间，否则保持原默认值
 //   - enabled = false 时跳过该预警，等同于硬编码默认值
+//   - trigger_operator（> >= < <=）与 clear_value 构成迟滞区间：
+//     条件未成立时按 trigger_value 判定，成立后按 clear_value 判定，
+//     信号越过 clear_value 才释放，避免在阈值附近反复起止
+//     （clear_value 为 NULL 时与 trigger_value 相同，即无迟滞）
+//   - category = life 的行（WARN_LIFE_FAN / WARN_LIFE_COMP / WARN_LIFE_VALVE）配置部件寿命：
+//     trigger_value 为额定寿命（h 或 次），params.warn_pct / crit_pct 为预警、严重比例，
+//     params.overrides 按线路 / 车厢 / 部件码覆盖，见 csLifeLimits
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/benthosdev/benthos/v4/public/service"
 )
 
 // warnEntry 单条预警配置的运行时表示。
 type warnEntry struct {
-	TriggerValue         float64 // UI 显示单位阈值（超温类为超出量，单位℃）
-	DurationSeconds      int     // 持续时间门控（秒），0 表示立即触发
-	Enabled              bool
-	RawScale             float64 // params.raw_scale，默认 1.0
-	TargetTemp           float64 // params.target_temp（℃），0=未配置；超温类专用
-	MinCoolingRuntimeS   int     // params.min_cooling_runtime_s（秒），-1=未配置
+	TriggerOperator    string  // 触发比较符：> >= < <=
+	TriggerValue       float64 // UI 显示单位阈值（超温类为超出量，单位℃）
+	ClearValue         float64 // 消除阈值，单位同 TriggerValue
+	DurationSeconds    int     // 持续时间门控（秒），0 表示立即触发
+	Enabled            bool
+	RawScale           float64     // params.raw_scale，默认 1.0
+	TargetTemp         float64     // params.target_temp（℃），0=未配置；超温类专用
+	MinCoolingRuntimeS int         // params.min_cooling_runtime_s（秒），-1=未配置
+	Life               *lifeParams // 部件寿命参数，非寿命类为 nil
+}
+
+// lifeParams 部件寿命行的 params（见 10-migration-20261018.sql）。
+type lifeParams struct {
+	WarnPct   float64        `json:"warn_pct"` // 预警比例（%），0=硬编码默认
+	CritPct   float64        `json:"crit_pct"` // 严重比例（%），0=硬编码默认
+	Overrides []lifeOverride `json:"overrides"`
+}
+
+// lifeOverride 按线路 / 车厢 / 部件码覆盖额定寿命与比例，空字段表示不限；
+// 多条匹配时取指定字段最多的一条，相同时取靠后的一条。
+type lifeOverride struct {
+	LineID     idString `json:"line_id"`
+	CarriageID idString `json:"carriage_id"`
+	PartCode   idString `json:"part_code"`
+	RatedLife  float64  `json:"rated_life"` // UI 单位（h 或 次），0=沿用 trigger_value
+	WarnPct    float64  `json:"warn_pct"`
+	CritPct    float64  `json:"crit_pct"`
+}
+
+// idString 接受 JSON 字符串或数字（线路号、部件码在 UI 与手写 SQL 中两种写法都常见）。
+type idString string
+
+func (s *idString) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*s = ""
+		return nil
+	}
+	*s = idString(strings.Trim(string(b), `"`))
+	return nil
 }
 
 type configMap map[string]warnEntry
 
+// configNotifyChannel 是 warning_config 触发器 NOTIFY 的频道名。
+const configNotifyChannel = "warning_config_changed"
+
+// configVersionDefault 表示未加载 DB 配置，所有阈值取硬编码默认值。
+const configVersionDefault = "default"
+
 // ConfigStore 持有从 DB 加载的预警配置，支持并发安全热更新。
 type ConfigStore struct {
-	val    atomic.Value // 存储 *configMap，整体替换保证原子性
-	db     *sql.DB
-	logger *service.Logger
+	val     atomic.Value // 存储 *configMap，整体替换保证原子性
+	version atomic.Value // 存储 string，与 val 同步更新
+	dsn     string
+	db      *sql.DB
+	logger  *service.Logger
 }
 
 var (
@@ -52,9 +113,9 @@ var (
 	configStoreOnce   sync.Once
 )
 
-// ensureConfigStore 保证 ConfigStore 只初始化一次（sync.Once）。
+// ensureConfigStore 保证 ConfigStore 只初始化一次（sync.Once），pollInterval 为轮询兜底周期。
 // 若 PG_DSN 未设置或连接失败，globalConfigStore 保持 nil，所有读取返回硬编码默认值。
-func ensureConfigStore(logger *service.Logger) {
+func ensureConfigStore(logger *service.Logger, pollInterval time.Duration) {
 	configStoreOnce.Do(func() {
 		dsn := os.Getenv("PG_DSN")
 		if dsn == "" {
@@ -66,26 +127,51 @@ func ensureConfigStore(logger *service.Logger) {
 			logger.Warnf("ConfigStore: DB 连接失败，使用硬编码阈值: %v", err)
 			return
 		}
-		cs := &ConfigStore{db: db, logger: logger}
+		if pollInterval <= 0 {
+			pollInterval = 5 * time.Minute
+		}
+		cs := &ConfigStore{dsn: dsn, db: db, logger: logger}
 		if err := cs.load(); err != nil {
 			logger.Warnf("ConfigStore: 首次加载失败，使用硬编码阈值: %v", err)
 		}
 		globalConfigStore = cs
-		cs.startPolling(context.Background(), 30*time.Second)
-		logger.Infof("ConfigStore: 已启动，每 30s 从 hvac.warning_config 刷新预警阈值")
+		cs.startWatching(context.Background(), pollInterval)
+		logger.Infof("ConfigStore: 已启动，监听 %s 通知，每 %v 轮询兜底刷新 hvac.warning_config", configNotifyChannel, pollInterval)
 	})
 }
 
-func (cs *ConfigStore) startPolling(ctx context.Context, interval time.Duration) {
+// startWatching 在单个 goroutine 中处理 NOTIFY 与轮询，load 不会并发执行。
+// LISTEN 失败时仅依赖轮询，pq.Listener 会在后台自动重连。
+func (cs *ConfigStore) startWatching(ctx context.Context, pollInterval time.Duration) {
+	listener := pq.NewListener(cs.dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			cs.logger.Warnf("ConfigStore: 监听连接异常（事件 %d），依赖轮询兜底: %v", ev, err)
+		}
+	})
+	if err := listener.Listen(configNotifyChannel); err != nil {
+		cs.logger.Warnf("ConfigStore: LISTEN %s 失败，依赖轮询兜底: %v", configNotifyChannel, err)
+	}
+
 	go func() {
-		ticker := time.NewTicker(interval)
+		defer listener.Close()
+		ticker := time.NewTicker(pollInterval)
 		defer ticker.Stop()
 		for {
 			select {
+			case n := <-listener.Notify:
+				// n 为 nil 表示监听连接重建，期间的通知可能已丢失，同样全量加载
+				if n == nil {
+					cs.logger.Infof("ConfigStore: 监听连接已重建，重新加载预警配置")
+				}
+				if err := cs.load(); err != nil {
+					cs.logger.Warnf("ConfigStore: 通知触发加载失败，继续使用上次配置: %v", err)
+				}
 			case <-ticker.C:
 				if err := cs.load(); err != nil {
 					cs.logger.Warnf("ConfigStore: 轮询加载失败，继续使用上次配置: %v", err)
 				}
+				// 空闲连接上检测监听是否仍然存活，断开时触发重连
+				go func() { _ = listener.Ping() }()
 			case <-ctx.Done():
 				return
 			}
@@ -95,7 +181,7 @@ func (cs *ConfigStore) startPolling(ctx context.Context, interval time.Duration)
 
 func (cs *ConfigStore) load() error {
 	rows, err := cs.db.Query(
-		`SELECT warn_code, trigger_value, duration_seconds, enabled, params
+		`SELECT warn_code, trigger_operator, trigger_value, clear_value, duration_seconds, enabled, params
 		 FROM hvac.warning_config`)
 	if err != nil {
 		return err
@@ -104,15 +190,24 @@ func (cs *ConfigStore) load() error {
 
 	m := make(configMap)
 	for rows.Next() {
-		var code string
+		var code, op string
 		var tv float64
+		var cv sql.NullFloat64
 		var dur int
 		var enabled bool
 		var paramsJSON sql.NullString
-		if err := rows.Scan(&code, &tv, &dur, &enabled, &paramsJSON); err != nil {
+		if err := rows.Scan(&code, &op, &tv, &cv, &dur, &enabled, &paramsJSON); err != nil {
 			cs.logger.Warnf("ConfigStore: 行扫描失败，跳过: %v", err)
 			continue
 		}
+		if !validOperator(op) {
+			cs.logger.Warnf("ConfigStore: %s 的 trigger_operator=%q 非法，按 '>' 处理", code, op)
+			op = ">"
+		}
+		clear := tv
+		if cv.Valid {
+			clear = cv.Float64
+		}
 		rawScale := 1.0
 		targetTemp := 0.0
 		minCoolingRuntimeS := -1
@@ -130,40 +225,138 @@ func (cs *ConfigStore) load() error {
 				}
 			}
 		}
+		var life *lifeParams
+		if paramsJSON.Valid {
+			var lp lifeParams
+			if err := json.Unmarshal([]byte(paramsJSON.String), &lp); err != nil {
+				cs.logger.Warnf("ConfigStore: %s 的寿命参数解析失败，忽略: %v", code, err)
+			} else if lp.WarnPct > 0 || lp.CritPct > 0 || len(lp.Overrides) > 0 {
+				life = &lp
+			}
+		}
 		m[code] = warnEntry{
+			TriggerOperator:    op,
 			TriggerValue:       tv,
+			ClearValue:         clear,
 			DurationSeconds:    dur,
 			Enabled:            enabled,
 			RawScale:           rawScale,
 			TargetTemp:         targetTemp,
 			MinCoolingRuntimeS: minCoolingRuntimeS,
+			Life:               life,
 		}
 	}
 	if err := rows.Err(); err != nil {
 		return err
 	}
+	version := m.version()
+	prev, _ := cs.version.Load().(string)
 	cs.val.Store(&m)
-	cs.logger.Debugf("ConfigStore: 已加载 %d 条预警配置", len(m))
+	cs.version.Store(version)
+	if version != prev {
+		cs.logger.Infof("ConfigStore: 已加载 %d 条预警配置，config_version=%s", len(m), version)
+	} else {
+		cs.logger.Debugf("ConfigStore: 已加载 %d 条预警配置（未变化）", len(m))
+	}
 	return nil
 }
 
-// csRawThreshold 返回原始传感器单位的触发阈值。
-// 找不到、未启用或 PG_DSN 未配置时，返回 defaultVal（硬编码降级）。
-func csRawThreshold(warnCode string, defaultVal int64) int64 {
+// version 返回配置内容的短哈希，与行顺序无关。
+func (m configMap) version() string {
+	codes := make([]string, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	h := sha256.New()
+	for _, code := range codes {
+		e := m[code]
+		life, _ := json.Marshal(e.Life)
+		fmt.Fprintf(h, "%s|%s|%g|%g|%d|%t|%g|%g|%d|%s\n", code, e.TriggerOperator, e.TriggerValue, e.ClearValue,
+			e.DurationSeconds, e.Enabled, e.RawScale, e.TargetTemp, e.MinCoolingRuntimeS, life)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// csVersion 返回当前生效的配置版本，未加载 DB 配置时返回 configVersionDefault。
+func csVersion() string {
 	cs := globalConfigStore
 	if cs == nil {
-		return defaultVal
+		return configVersionDefault
+	}
+	if v, ok := cs.version.Load().(string); ok {
+		return v
+	}
+	return configVersionDefault
+}
+
+// threshold 是原始传感器单位的迟滞阈值。
+type threshold struct {
+	Op      string // > >= < <=
+	Trigger int64  // 条件未成立时的判定阈值
+	Clear   int64  // 条件成立后的保持阈值，已规整到 Trigger 的释放一侧
+}
+
+// fixedThreshold 返回无迟滞的 '>' 阈值（硬编码降级值）。
+func fixedThreshold(raw int64) threshold {
+	return threshold{Op: ">", Trigger: raw, Clear: raw}
+}
+
+// newThreshold 构造迟滞阈值。clear 落在触发一侧（如 '>' 时 clear > trigger）会导致
+// 刚触发即释放，此时收敛为 trigger，即退化为无迟滞。
+func newThreshold(op string, trigger, clear int64) threshold {
+	switch op {
+	case ">", ">=":
+		clear = min(clear, trigger)
+	case "<", "<=":
+		clear = max(clear, trigger)
+	}
+	return threshold{Op: op, Trigger: trigger, Clear: clear}
+}
+
+// Exceeds 判定 v 是否越限。latched 为该规则已触发（预警生效中），此时按 Clear 判定。
+func (t threshold) Exceeds(v int64, latched bool) bool {
+	limit := t.Trigger
+	if latched {
+		limit = t.Clear
+	}
+	switch t.Op {
+	case ">=":
+		return v >= limit
+	case "<":
+		return v < limit
+	case "<=":
+		return v <= limit
+	}
+	return v > limit
+}
+
+// validOperator 判断 trigger_operator 是否为支持的比较符。
+func validOperator(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=":
+		return true
+	}
+	return false
+}
+
+// csThreshold 返回原始传感器单位的迟滞阈值（trigger/clear × raw_scale）。
+// 找不到、未启用或 PG_DSN 未配置时，返回 '>' defaultVal 且无迟滞（硬编码降级）。
+func csThreshold(warnCode string, defaultVal int64) threshold {
+	cs := globalConfigStore
+	if cs == nil {
+		return fixedThreshold(defaultVal)
 	}
 	p := cs.val.Load()
 	if p == nil {
-		return defaultVal
+		return fixedThreshold(defaultVal)
 	}
 	m := *p.(*configMap)
 	e, ok := m[warnCode]
 	if !ok || !e.Enabled {
-		return defaultVal
+		return fixedThreshold(defaultVal)
 	}
-	return int64(e.TriggerValue * e.RawScale)
+	return newThreshold(e.TriggerOperator, int64(e.TriggerValue*e.RawScale), int64(e.ClearValue*e.RawScale))
 }
 
 // csDuration 返回持续时间门控。
@@ -222,23 +415,114 @@ func csCoolingPreconditionDur(warnCode string, defaultDur time.Duration) time.Du
 	return time.Duration(e.MinCoolingRuntimeS) * time.Second
 }
 
-// csOvertempAbsThreshold 返回车厢超温的绝对阈值（原始传感器单位）。
-// 从 DB 读取 target_temp（目标温度℃）和 trigger_value（允许超出量℃），
-// 计算 absolute_raw = (target_temp + trigger_value) × raw_scale。
+// csOvertempThreshold 返回车厢超温的绝对迟滞阈值（原始传感器单位）。
+// 从 DB 读取 target_temp（目标温度℃）、trigger_value / clear_value（超出量℃），
+// 计算 absolute_raw = (target_temp + 超出量) × raw_scale。
 // 未配置或未启用时返回 defaultRaw（硬编码降级，默认 300 = (26+4)×10）。
-func csOvertempAbsThreshold(warnCode string, defaultRaw int64) int64 {
+func csOvertempThreshold(warnCode string, defaultRaw int64) threshold {
 	cs := globalConfigStore
 	if cs == nil {
-		return defaultRaw
+		return fixedThreshold(defaultRaw)
 	}
 	p := cs.val.Load()
 	if p == nil {
-		return defaultRaw
+		return fixedThreshold(defaultRaw)
 	}
 	m := *p.(*configMap)
 	e, ok := m[warnCode]
 	if !ok || !e.Enabled || e.TargetTemp <= 0 {
-		return defaultRaw
+		return fixedThreshold(defaultRaw)
+	}
+	return newThreshold(e.TriggerOperator,
+		int64((e.TargetTemp+e.TriggerValue)*e.RawScale),
+		int64((e.TargetTemp+e.ClearValue)*e.RawScale))
+}
+
+// lifeLimits 是原始单位（秒或次）的部件寿命阈值。
+type lifeLimits struct {
+	Limit int64 // 额定寿命
+	Warn  int64 // 预警值
+	Crit  int64 // 严重值
+}
+
+// csLifeLimits 返回某部件的寿命阈值：额定寿命 = trigger_value × raw_scale，
+// 预警 / 严重值 = 额定寿命 × warn_pct / crit_pct，params.overrides 中最具体的匹配项优先。
+// 找不到或 PG_DSN 未配置时返回 def（硬编码降级）；enabled = false 时 ok 为 false，不输出寿命预警。
+func csLifeLimits(warnCode, lineID string, carriageID int, partCode string, def lifeLimits) (lim lifeLimits, ok bool) {
+	cs := globalConfigStore
+	if cs == nil {
+		return def, true
+	}
+	p := cs.val.Load()
+	if p == nil {
+		return def, true
+	}
+	m := *p.(*configMap)
+	e, found := m[warnCode]
+	if !found {
+		return def, true
+	}
+	if !e.Enabled {
+		return def, false
+	}
+
+	rated := e.TriggerValue
+	warnPct := float64(def.Warn) * 100 / float64(def.Limit)
+	critPct := float64(def.Crit) * 100 / float64(def.Limit)
+	if e.Life != nil {
+		if e.Life.WarnPct > 0 {
+			warnPct = e.Life.WarnPct
+		}
+		if e.Life.CritPct > 0 {
+			critPct = e.Life.CritPct
+		}
+		if o := e.Life.match(lineID, strconv.Itoa(carriageID), partCode); o != nil {
+			if o.RatedLife > 0 {
+				rated = o.RatedLife
+			}
+			if o.WarnPct > 0 {
+				warnPct = o.WarnPct
+			}
+			if o.CritPct > 0 {
+				critPct = o.CritPct
+			}
+		}
+	}
+	if rated <= 0 {
+		return def, true
+	}
+	limit := int64(rated * e.RawScale)
+	return lifeLimits{
+		Limit: limit,
+		Warn:  int64(float64(limit) * warnPct / 100),
+		Crit:  int64(float64(limit) * critPct / 100),
+	}, true
+}
+
+// match 返回与部件匹配且指定字段最多的覆盖项，无匹配时返回 nil。
+func (lp *lifeParams) match(lineID, carriageID, partCode string) *lifeOverride {
+	var best *lifeOverride
+	bestScore := -1
+	for i := range lp.Overrides {
+		o := &lp.Overrides[i]
+		score := 0
+		for _, f := range [][2]string{
+			{string(o.LineID), lineID},
+			{string(o.CarriageID), carriageID},
+			{string(o.PartCode), partCode},
+		} {
+			if f[0] == "" {
+				continue
+			}
+			if f[0] != f[1] {
+				score = -1
+				break
+			}
+			score++
+		}
+		if score >= 0 && score >= bestScore {
+			best, bestScore = o, score
+		}
 	}
-	return int64((e.TargetTemp + e.TriggerValue) * e.RawScale)
+	return best
 }
@@ -0,0 +1,124 @@
+package main
+
+// device_tracker.go
+//
+// 设备在线跟踪与过期计时器清理。
+//
+// 问题：states 中的计时器只在同一设备后续帧令条件为假时才删除。列车在条件满足期间下线，
+// 计时器会永久驻留；数日后列车回归，currentTime - firstSeen 远超持续时间门槛，规则立即触发。
+//
+// 处理：
+//   - 每台设备记录最后一帧的消息时间（判定遥测断档）与到达的系统时间（判定下线）
+//   - 新帧与上一帧的消息时间间隔超过 stale_ttl（或时钟大幅回拨）时，清空该设备全部计时器
+//   - 后台 sweeper 定期清理超过 stale_ttl 未收到任何帧的设备，限制内存占用
+//   - 设备最后消息时间以伪规则 key（deviceID + ":" + deviceSeenRule）随计时器一起持久化，
+//     重启后仍能识别停机期间的断档
+//   - 记录设备上一帧预警/告警命中是否非空，命中清零时输出一次 transition=clear 子事件，
+//     ground-reporter 据此为 6.1 记录补发 endtime
+
+import (
+	"strings"
+	"time"
+)
+
+// deviceSeenRule 是设备最后消息时间在持久化层使用的伪规则码。
+const deviceSeenRule = "__last_seen"
+
+// deviceSeen 记录设备最后一帧，按值存入 sync.Map 以避免并发修改。
+type deviceSeen struct {
+	msgTime  time.Time // 最后一帧的消息时间（与 checkRule 的 currentTime 同源）
+	wallTime time.Time // 最后一帧到达时的系统时间
+}
+
+// transitionClear 标记命中列表由非空变为空的子事件（SubEvent.Transition）。
+const transitionClear = "clear"
+
+// hitActivity 记录设备上一帧预警/告警命中是否非空，按值存入 sync.Map。
+type hitActivity struct {
+	predict bool
+	alarm   bool
+}
+
+// hitTransitions 刷新设备的命中状态，返回预警/告警是否由非空变为空。
+// 启动后（或设备被清理后）首帧的上一状态未知，命中为空时同样视为清零，
+// 确保下游关闭此前打开的记录；下游对无活动记录的设备收到 clear 时不做任何事。
+func (p *NB67EventProcessor) hitTransitions(deviceID string, predictActive, alarmActive bool) (predictCleared, alarmCleared bool) {
+	prev, seen := p.hitSets.Swap(deviceID, hitActivity{predict: predictActive, alarm: alarmActive})
+	if !seen {
+		return !predictActive, !alarmActive
+	}
+	last := prev.(hitActivity)
+	return last.predict && !predictActive, last.alarm && !alarmActive
+}
+
+// touchDevice 在规则判定前调用：遥测断档时先清空该设备计时器，再刷新最后一帧时间。
+func (p *NB67EventProcessor) touchDevice(deviceID string, msgTime time.Time) {
+	if p.staleTTL > 0 {
+		if v, ok := p.devices.Load(deviceID); ok {
+			gap := msgTime.Sub(v.(deviceSeen).msgTime)
+			if gap > p.staleTTL || gap < -p.staleTTL {
+				if n := p.resetDevice(deviceID); n > 0 {
+					p.logger.Infof("RuleState: 设备 %s 遥测断档 %v，已重置 %d 个规则计时器", deviceID, gap, n)
+				}
+			}
+		}
+	}
+	p.devices.Store(deviceID, deviceSeen{msgTime: msgTime, wallTime: time.Now()})
+	p.markStateDirty(deviceID+":"+deviceSeenRule, &ruleState{firstSeen: msgTime})
+}
+
+// resetDevice 删除设备的全部规则计时器（不含最后消息时间），返回删除数量。
+func (p *NB67EventProcessor) resetDevice(deviceID string) int {
+	prefix := deviceID + ":"
+	n := 0
+	p.states.Range(func(k, _ any) bool {
+		key := k.(string)
+		if strings.HasPrefix(key, prefix) {
+			p.states.Delete(key)
+			p.markStateDirty(key, nil)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// sweepStaleDevices 清理超过 staleTTL 未收到帧的设备及其计时器。
+func (p *NB67EventProcessor) sweepStaleDevices(now time.Time) {
+	evicted, timers := 0, 0
+	p.devices.Range(func(k, v any) bool {
+		deviceID := k.(string)
+		if now.Sub(v.(deviceSeen).wallTime) <= p.staleTTL {
+			return true
+		}
+		timers += p.resetDevice(deviceID)
+		p.devices.Delete(deviceID)
+		p.hitSets.Delete(deviceID)
+		p.forecastAt.Delete(deviceID)
+		p.markStateDirty(deviceID+":"+deviceSeenRule, nil)
+		evicted++
+		return true
+	})
+	if evicted > 0 {
+		p.logger.Infof("RuleState: 清理离线设备 %d 台，释放规则计时器 %d 个", evicted, timers)
+	}
+}
+
+// runSweeper 按 interval 周期清理离线设备，直到 done 关闭。
+func (p *NB67EventProcessor) runSweeper(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.sweepStaleDevices(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// splitDeviceSeenKey 判断持久化 key 是否为设备最后消息时间，是则返回设备 ID。
+func splitDeviceSeenKey(key string) (string, bool) {
+	return strings.CutSuffix(key, ":"+deviceSeenRule)
+}
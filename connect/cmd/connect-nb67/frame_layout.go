@@ -0,0 +1,98 @@
+package main
+
+// frame_layout.go
+//
+// NB67 帧布局注册表：按 (msg_protocal_version, msg_type) 选择解码器。
+//
+// 所有固件版本的帧头（同步字 ~ 协议版本，前 20 字节）布局相同，
+// nb67_parser 先 peek 帧头取出协议版本与消息类型，再查表选择对应布局解码。
+// 各布局统一解码为规范结构 *Nb67，下游（event builder / storage writer / ground reporter）
+// 按 raw 字段名读取，无需感知固件版本差异。
+//
+// 新增固件版本的步骤：
+//   1. 编写 codec/NB67_vN.ksy 并生成 Go 代码
+//   2. 实现 decode 函数，将新结构映射为 *Nb67（缺失字段保持零值）
+//   3. 在 init() 中调用 registerFrameLayout 注册
+//   4. parser_version 自动按布局名称写入（如 "nb67-v2"）
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/kaitai-io/kaitai_struct_go_runtime/kaitai"
+)
+
+// anyMsgType 作为 msg_type 通配符：该协议版本下所有消息类型共用同一布局。
+const anyMsgType = -1
+
+// frameHeaderPeekSize 为 peek 协议版本所需的最少字节数（msg_protocal_version 位于偏移 19）。
+const frameHeaderPeekSize = 20
+
+// frameHeader 是解码前从帧头直接读取的分派键。
+type frameHeader struct {
+	ProtocolVersion uint8
+	MessageType     uint16
+}
+
+// frameLayout 描述一种固件版本的帧布局。
+type frameLayout struct {
+	Name string // 写入 parser_version，如 "nb67-v1"
+	// Decode 将整帧解码为规范结构，返回解码器消费的字节数。
+	// 出错时返回的 *Nb67 至少应填充帧头字段（供 TRUNCATED 输出使用）。
+	Decode func(payload []byte) (*Nb67, int64, error)
+}
+
+type layoutKey struct {
+	version uint8
+	msgType int
+}
+
+var (
+	frameLayouts       = make(map[layoutKey]*frameLayout)
+	frameLayoutsByName = make(map[string]*frameLayout)
+)
+
+// registerFrameLayout 注册一种布局。msgType 传 anyMsgType 表示匹配该版本的所有消息类型。
+// 仅应在 init() 中调用，重复注册视为编程错误。
+func registerFrameLayout(version uint8, msgType int, layout *frameLayout) {
+	key := layoutKey{version: version, msgType: msgType}
+	if _, dup := frameLayouts[key]; dup {
+		panic(fmt.Sprintf("NB67 帧布局重复注册: version=%d msg_type=%d", version, msgType))
+	}
+	frameLayouts[key] = layout
+	frameLayoutsByName[layout.Name] = layout
+}
+
+// lookupFrameLayout 先精确匹配 (版本, 消息类型)，再回退到该版本的通配布局。
+func lookupFrameLayout(hdr frameHeader) (*frameLayout, bool) {
+	if l, ok := frameLayouts[layoutKey{version: hdr.ProtocolVersion, msgType: int(hdr.MessageType)}]; ok {
+		return l, true
+	}
+	l, ok := frameLayouts[layoutKey{version: hdr.ProtocolVersion, msgType: anyMsgType}]
+	return l, ok
+}
+
+// peekFrameHeader 读取分派键，不足 frameHeaderPeekSize 字节时返回 false。
+func peekFrameHeader(payload []byte) (frameHeader, bool) {
+	if len(payload) < frameHeaderPeekSize {
+		return frameHeader{}, false
+	}
+	return frameHeader{
+		ProtocolVersion: payload[19],
+		MessageType:     binary.BigEndian.Uint16(payload[6:8]),
+	}, true
+}
+
+// decodeNb67V1 使用 codec/NB67.ksy 生成的解码器（现役固件）。
+func decodeNb67V1(payload []byte) (*Nb67, int64, error) {
+	nb67 := &Nb67{}
+	io := kaitai.NewStream(bytes.NewReader(payload))
+	err := nb67.Read(io, nil, nb67)
+	consumed, _ := io.Pos()
+	return nb67, consumed, err
+}
+
+func init() {
+	registerFrameLayout(1, anyMsgType, &frameLayout{Name: "nb67-v1", Decode: decodeNb67V1})
+}
@@ -0,0 +1,121 @@
+package main
+
+// frame_quality.go
+//
+// NB67 帧完整性校验：在 Kaitai 解码之后对帧头同步字、长度字段、实际字节数
+// 以及源设备时钟做一致性检查，给出 quality_status / quality_code。
+//
+// 质量码约定（写入 signal-parsed.quality_code 与 hvac.fact_raw.quality_code）：
+//   0       OK              帧完整可信
+//   1 ~ 9   可用但有瑕疵     数据字段可信，仅附带信息异常（尾部多余字节、时钟非法）
+//   >= 10   帧结构损坏       字段值不可信，event builder 丢弃、看板应过滤
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	QualityOK             = "OK"
+	QualityTrailingBytes  = "TRAILING_BYTES"
+	QualityClockInvalid   = "CLOCK_INVALID"
+	QualityLengthMismatch = "LENGTH_MISMATCH"
+	QualityTruncated      = "TRUNCATED"
+	QualityBadHeader      = "BAD_HEADER"
+	QualityUnsupported    = "UNSUPPORTED_VERSION"
+)
+
+// qualityRejectCode 及以上的质量码表示帧结构损坏，下游不应基于其字段做判定。
+const qualityRejectCode = 10
+
+var qualityCodes = map[string]int{
+	QualityOK:             0,
+	QualityTrailingBytes:  1,
+	QualityClockInvalid:   2,
+	QualityLengthMismatch: 10,
+	QualityTruncated:      11,
+	QualityBadHeader:      12,
+	QualityUnsupported:    13,
+}
+
+// nb67HeaderSize 为帧头（同步字 ~ 源设备时间）的字节数，
+// 不足该长度时连设备标识都无法读出，只能整帧报错。
+const nb67HeaderSize = 36
+
+// 帧头同步字默认值（现场录制帧 whole_frame-260203 的前两个字节）。
+const (
+	defaultHeaderCode01 = 0x2C
+	defaultHeaderCode02 = 0x01
+)
+
+// frameValidator 持有校验所需的期望值，由处理器配置构造。
+type frameValidator struct {
+	headerCode01 uint8
+	headerCode02 uint8
+	maxClockSkew time.Duration // 0 表示不检查设备时钟与本地时钟的偏差
+}
+
+// qualityCode 返回质量状态对应的数值码，未知状态按帧损坏处理。
+func qualityCode(status string) int {
+	if c, ok := qualityCodes[status]; ok {
+		return c
+	}
+	return qualityRejectCode
+}
+
+// isTruncatedReadErr 判断 Kaitai 解码错误是否由输入字节不足引起。
+func isTruncatedReadErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// badHeader 直接检查原始字节的同步字，解码失败（如截断）的帧同样适用；
+// 不足 2 字节时无从判断。
+func (v frameValidator) badHeader(frame []byte) bool {
+	return len(frame) >= 2 && (frame[0] != v.headerCode01 || frame[1] != v.headerCode02)
+}
+
+// Validate 按严重程度从高到低检查一帧，返回第一个命中的质量状态。
+// frameSize 为实际收到的字节数，consumed 为解码器消费的字节数。
+func (v frameValidator) Validate(nb67 *Nb67, frameSize int, consumed int64, now time.Time) string {
+	if nb67.MsgHeaderCode01 != v.headerCode01 || nb67.MsgHeaderCode02 != v.headerCode02 {
+		return QualityBadHeader
+	}
+	declared := int(nb67.MsgLength)
+	if frameSize < declared {
+		return QualityTruncated
+	}
+	// 帧头声明的长度比协议布局本身还短，说明长度字段不可信
+	if int64(declared) < consumed {
+		return QualityLengthMismatch
+	}
+	if frameSize > declared {
+		return QualityTrailingBytes
+	}
+	if !v.clockValid(nb67, now) {
+		return QualityClockInvalid
+	}
+	return QualityOK
+}
+
+// clockValid 检查源设备时间是否为合法日历时间，并（可选）检查与本地时钟的偏差。
+func (v frameValidator) clockValid(nb67 *Nb67, now time.Time) bool {
+	year := 2000 + int(nb67.MsgSrcDvcYear)
+	month, day := int(nb67.MsgSrcDvcMonth), int(nb67.MsgSrcDvcDay)
+	hour, minute, second := int(nb67.MsgSrcDvcHour), int(nb67.MsgSrcDvcMinute), int(nb67.MsgSrcDvcSecond)
+	if month < 1 || month > 12 || day < 1 || hour > 23 || minute > 59 || second > 59 {
+		return false
+	}
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, beijingLoc)
+	// time.Date 会把 2 月 30 日规范化为 3 月 2 日，日期被改写即非法
+	if t.Day() != day {
+		return false
+	}
+	if v.maxClockSkew > 0 {
+		skew := now.Sub(t)
+		if skew > v.maxClockSkew || skew < -v.maxClockSkew {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,7 @@ require (
 	github.com/benthosdev/benthos/v4 v4.14.0
 	github.com/kaitai-io/kaitai_struct_go_runtime v0.10.0
 	github.com/lib/pq v1.10.4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -182,7 +183,6 @@ require (
 	gopkg.in/jcmturner/gokrb5.v6 v6.1.1 // indirect
 	gopkg.in/jcmturner/rpc.v1 v1.1.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
 	modernc.org/libc v1.41.0 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
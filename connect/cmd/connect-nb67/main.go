@@ -22,12 +22,33 @@ func init() {
 				"使用Kaitai Struct生成的Go代码解析NB67二进制浮车空调数据帧。\n"+
 					"输入：原始二进制消息\n"+
 					"输出：完整JSON对象，包含180+字段、新增车站信息、故障标志等\n"+
-					"包含字段：头部信息、时间戳、温度/湿度/压力传感器、故障诊断、新增车站信息(452-460偏移)\n",
+					"包含字段：头部信息、时间戳、温度/湿度/压力传感器、故障诊断、新增车站信息(452-460偏移)\n"+
+					"按帧头 msg_protocal_version / msg_type 选择已注册的帧布局，parser_version 为实际使用的布局名称\n",
 			).
 			Field(
 				service.NewIntField("log_sample_every").
 					Description("每处理N条消息输出日志采样（0=不采样）").
 					Default(100),
+			).
+			Field(
+				service.NewIntField("header_code_01").
+					Description("帧头同步字第 1 字节，不匹配时 quality_status=BAD_HEADER").
+					Default(defaultHeaderCode01),
+			).
+			Field(
+				service.NewIntField("header_code_02").
+					Description("帧头同步字第 2 字节，不匹配时 quality_status=BAD_HEADER").
+					Default(defaultHeaderCode02),
+			).
+			Field(
+				service.NewDurationField("max_clock_skew").
+					Description("源设备时间与本地时间允许的最大偏差，超出则 quality_status=CLOCK_INVALID（0s=只校验日历合法性）").
+					Default("0s"),
+			).
+			Field(
+				service.NewStringField("fallback_layout").
+					Description("msg_protocal_version 未注册时使用的帧布局名称（如 nb67-v1），parser_version 记为 <布局>-fallback-v<实际版本>；留空（默认）则输出 UNSUPPORTED_VERSION 坏帧").
+					Default(""),
 			),
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
 			_ = mgr
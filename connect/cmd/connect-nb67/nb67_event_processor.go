@@ -10,7 +10,7 @@ package main
 //
 // 注册处理器名称：nb67_event_builder
 // 输入消息：nb67_parser 输出的 signal-parsed JSON（含 raw 字段）
-// 输出消息：三个子事件聚合体，YAML 通过 fan_out + mapping 分拣到三个 topic
+// 输出消息：四个子事件聚合体，YAML 通过 fan_out + mapping 分拣到四个 topic
 //
 // 事件码规范：
 //   HVAC 预警码 = "HVAC" + string(carriage_id*100 + seq)  （来源：NB67 空调预警码表 20240802）
@@ -25,13 +25,15 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benthosdev/benthos/v4/public/service"
 )
 
 // ============================================================
-// 寿命阈值常量（只需在此处修改）
+// 寿命阈值常量：hvac.warning_config 未配置寿命行时的硬编码默认值
+// （WARN_LIFE_* 行可按线路 / 车厢 / 部件码覆盖，见 config_store.go csLifeLimits）
 // ============================================================
 
 const (
@@ -65,6 +67,7 @@ type EventMeta struct {
 	EventTimeText string `json:"event_time_text"`
 	IngestTime    string `json:"ingest_time"`
 	ProcessTime   string `json:"process_time"`
+	ConfigVersion string `json:"config_version"` // 产生本事件的预警阈值版本（见 config_store.go）
 }
 
 // PredictHit 预警命中条目（基于算法规则）。
@@ -87,14 +90,31 @@ type LifeHit struct {
 	Name     string `json:"name"`     // 中文名称
 	Severity int    `json:"severity"` // 3=高 2=中
 	Value    int64  `json:"value"`    // 当前累计值（秒或次）
-	Limit    int64  `json:"limit"`    // 额定寿命（秒或次）
+	Limit    int64  `json:"limit"`    // 额定寿命（秒或次），取自 warning_config 的 WARN_LIFE_* 配置
+
+	// 预计达到额定寿命的时间（unix ms），按计数器近期用量速率估算，历史不足时省略（见 part_replacement.go）
+	LimitTime int64 `json:"limit_time,omitempty"`
+
+	field string // raw 计数器字段，供 lifeLimitTime 查找基线
+}
+
+// LifeForecast 部件寿命预测条目：每台设备按 lifeForecastInterval 随 life_event 输出全部部件，
+// 未达到预警比例的部件也在内，ground-reporter 据此填写 6.7 每日批量的 limitTime。
+type LifeForecast struct {
+	Code      string `json:"code"`                 // 部件码
+	Value     int64  `json:"value"`                // 当前累计值（秒或次）
+	Limit     int64  `json:"limit"`                // 额定寿命（秒或次），该类寿命预警停用时为 0
+	LimitTime int64  `json:"limit_time,omitempty"` // 同 LifeHit.LimitTime
 }
 
 // SubEvent 单个子事件，用于输出到对应 topic。
 type SubEvent struct {
-	EventMeta EventMeta   `json:"event_meta"`
-	Hits      interface{} `json:"hits"`   // []PredictHit | []AlarmHit | []LifeHit
-	Source    string      `json:"source"` // 来源标识
+	EventMeta  EventMeta   `json:"event_meta"`
+	Hits       interface{} `json:"hits"`                 // []PredictHit | []AlarmHit | []LifeHit | []ReplacementHit
+	Source     string      `json:"source"`               // 来源标识
+	Transition string      `json:"transition,omitempty"` // "clear"：命中清零，hits 为空
+
+	Forecasts []LifeForecast `json:"forecasts,omitempty"` // 仅 life_event：全部部件寿命预测，hits 可为空
 }
 
 // EventOutput 处理器输出的聚合事件包，YAML fan_out 分拣用。
@@ -102,6 +122,8 @@ type EventOutput struct {
 	PredictEvent SubEvent `json:"predict_event"`
 	AlarmEvent   SubEvent `json:"alarm_event"`
 	LifeEvent    SubEvent `json:"life_event"`
+
+	ReplacementEvent SubEvent `json:"replacement_event"`
 }
 
 // parsedInput 是从上游 signal-parsed 消息解析的输入结构。
@@ -113,6 +135,7 @@ type parsedInput struct {
 	DeviceID      string         `json:"device_id"`
 	EventTimeText string         `json:"event_time_text"`
 	IngestTime    string         `json:"ingest_time"`
+	QualityCode   int            `json:"quality_code"`
 	Raw           map[string]any `json:"raw"`
 }
 
@@ -126,6 +149,8 @@ type parsedInput struct {
 
 type ruleState struct {
 	firstSeen time.Time
+	value     int64       // 仅计数器基线使用（见 part_replacement.go）
+	fired     atomic.Bool // 规则已触发（checkRule 已返回 true），迟滞阈值据此切换到消除值
 }
 
 // NB67EventProcessor 增加了状态表，用于判断规则持续时间。
@@ -135,13 +160,39 @@ type NB67EventProcessor struct {
 	states  sync.Map
 	logger  *service.Logger
 	runtime string // ENV "RUNTIME": "DEV" | "PRD"
+
+	// 设备最后一帧（见 device_tracker.go），key: DeviceID，value: deviceSeen
+	devices  sync.Map
+	staleTTL time.Duration // 遥测断档超过该时长即重置计时器，0 表示不检查
+
+	// 设备上一帧预警/告警命中是否非空（见 device_tracker.go），key: DeviceID，value: hitActivity
+	hitSets sync.Map
+
+	// 计时器持久化（见 rule_state_store.go），stateStore 为 nil 时纯内存运行
+	stateStore ruleStateStore
+	pendingMu  sync.Mutex
+	pending    map[string]*ruleState // 待 checkpoint 的变更，nil 值表示删除
+	stopLoop   chan struct{}
+	closeOnce  sync.Once
+
+	// 预警规则集（见 rule_engine.go），构造后只读
+	rules *ruleSet
+
+	// 部件计数器基线（见 part_replacement.go），key: DeviceID + ":" + counterRulePrefix + 字段，value: counterState
+	counters           sync.Map
+	replacementConfirm int // 连续回落多少帧判定为更换
+
+	// 设备最近一次输出寿命预测的消息时间（见 part_replacement.go），key: DeviceID，value: time.Time
+	forecastAt sync.Map
 }
 
 // checkRule 判定规则是否满足持续时间要求，使用消息中的 currentTime。
 func (p *NB67EventProcessor) checkRule(condition bool, duration time.Duration, deviceID string, ruleCode string, currentTime time.Time) bool {
 	key := deviceID + ":" + ruleCode
 	if !condition {
-		p.states.Delete(key)
+		if _, existed := p.states.LoadAndDelete(key); existed {
+			p.markStateDirty(key, nil)
+		}
 		return false
 	}
 
@@ -149,11 +200,22 @@ func (p *NB67EventProcessor) checkRule(condition bool, duration time.Duration, d
 	state := val.(*ruleState)
 
 	if !loaded {
-		return duration <= 0
+		p.markStateDirty(key, state)
 	}
 
 	// 计算消息间的时间差，而不是系统运行时间差
-	return currentTime.Sub(state.firstSeen) >= duration
+	fired := currentTime.Sub(state.firstSeen) >= duration
+	if fired && state.fired.CompareAndSwap(false, true) {
+		p.markStateDirty(key, state)
+	}
+	return fired
+}
+
+// latched 返回规则是否已触发（预警生效中），迟滞阈值据此选择触发值或消除值。
+// 计时中尚未触发的规则仍按触发值判定，条件回落到触发值以下即重新计时。
+func (p *NB67EventProcessor) latched(deviceID string, ruleCode string) bool {
+	v, ok := p.states.Load(deviceID + ":" + ruleCode)
+	return ok && v.(*ruleState).fired.Load()
 }
 
 // init 在程序启动时自动注册处理器。
@@ -162,17 +224,109 @@ func init() {
 		"nb67_event_builder",
 		service.NewConfigSpec().
 			Summary("NB67 空调事件构建处理器").
-			Description("支持状态化持续时间判定的事件构建器"),
+			Description("支持状态化持续时间判定的事件构建器").
+			Field(
+				service.NewStringEnumField("state_backend", "none", "file", "postgres").
+					Description("规则计时器持久化后端：none=纯内存，file=本地 JSON 快照，postgres=hvac.rule_state（使用 PG_DSN，单写者：仅一个实例可写，其余实例降级为纯内存）").
+					Default("none"),
+			).
+			Field(
+				service.NewStringField("state_path").
+					Description("state_backend=file 时的快照文件路径").
+					Default("/var/lib/connect/nb67-rule-state.json"),
+			).
+			Field(
+				service.NewDurationField("state_checkpoint_interval").
+					Description("计时器 checkpoint 周期，Close 时另做一次").
+					Default("30s"),
+			).
+			Field(
+				service.NewDurationField("stale_ttl").
+					Description("设备遥测断档超过该时长时重置其全部规则计时器，离线超过该时长的设备由后台清理（0s=不清理）").
+					Default("5m"),
+			).
+			Field(
+				service.NewDurationField("sweep_interval").
+					Description("离线设备清理周期").
+					Default("1m"),
+			).
+			Field(
+				service.NewDurationField("config_poll_interval").
+					Description("hvac.warning_config 轮询兜底周期；阈值修改通过 LISTEN/NOTIFY 即时生效").
+					Default("5m"),
+			).
+			Field(
+				service.NewIntField("replacement_confirm_frames").
+					Description("部件累计计数器连续回落多少帧判定为部件更换（输出 replacement_event）").
+					Default(3),
+			).
+			Field(
+				service.NewStringEnumField("rules_source", "builtin", "file", "postgres").
+					Description("预警规则来源：builtin=内置 hvac_predict_rules.yaml，file=rules_path，postgres=hvac.warning_rule（使用 PG_DSN）；失败时回退 builtin").
+					Default("builtin"),
+			).
+			Field(
+				service.NewStringField("rules_path").
+					Description("rules_source=file 时的规则文件路径（YAML / JSON）").
+					Default("/etc/connect/hvac_predict_rules.yaml"),
+			),
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
 			rt := os.Getenv("RUNTIME")
 			if rt == "" {
 				rt = "PRD"
 			}
-			ensureConfigStore(mgr.Logger())
-			return &NB67EventProcessor{
-				logger:  mgr.Logger(),
-				runtime: rt,
-			}, nil
+			pollInterval, _ := conf.FieldDuration("config_poll_interval")
+			ensureConfigStore(mgr.Logger(), pollInterval)
+			p := &NB67EventProcessor{
+				logger:   mgr.Logger(),
+				runtime:  rt,
+				pending:  make(map[string]*ruleState),
+				stopLoop: make(chan struct{}),
+			}
+			if p.replacementConfirm, _ = conf.FieldInt("replacement_confirm_frames"); p.replacementConfirm < 1 {
+				p.replacementConfirm = 1
+			}
+			rulesSource, _ := conf.FieldString("rules_source")
+			rulesPath, _ := conf.FieldString("rules_path")
+			rules, err := loadRuleSet(rulesSource, rulesPath)
+			if err != nil {
+				p.logger.Warnf("PredictRules: 加载 %s 规则失败，使用内置默认规则: %v", rulesSource, err)
+				if rules, err = loadRuleSet("builtin", ""); err != nil {
+					return nil, fmt.Errorf("内置预警规则编译失败: %w", err)
+				}
+			}
+			p.rules = rules
+			p.logger.Infof("PredictRules: 已从 %s 加载 %d 条预警规则", rules.source, len(rules.rules))
+
+			if ttl, err := conf.FieldDuration("stale_ttl"); err == nil {
+				p.staleTTL = ttl
+			}
+			if p.staleTTL > 0 {
+				sweep, err := conf.FieldDuration("sweep_interval")
+				if err != nil || sweep <= 0 {
+					sweep = time.Minute
+				}
+				go p.runSweeper(sweep, p.stopLoop)
+			}
+
+			backend, _ := conf.FieldString("state_backend")
+			path, _ := conf.FieldString("state_path")
+			interval, err := conf.FieldDuration("state_checkpoint_interval")
+			if err != nil || interval <= 0 {
+				interval = 30 * time.Second
+			}
+			store, err := newRuleStateStore(backend, path)
+			if err != nil {
+				p.logger.Warnf("RuleState: 后端 %s 初始化失败，计时器仅保存在内存: %v", backend, err)
+			}
+			if store != nil {
+				p.stateStore = store
+				if err := p.restoreStates(context.Background()); err != nil {
+					p.logger.Warnf("RuleState: 恢复计时器失败，从空状态开始: %v", err)
+				}
+				go p.runCheckpointLoop(interval, p.stopLoop)
+			}
+			return p, nil
 		},
 	)
 	if err != nil {
@@ -202,6 +356,11 @@ func (p *NB67EventProcessor) Process(ctx context.Context, msg *service.Message)
 		return service.MessageBatch{}, nil
 	}
 
+	// 帧头/长度校验失败的坏帧字段不可信，不参与任何规则判定（也不清除已有计时器）
+	if input.QualityCode >= qualityRejectCode {
+		return service.MessageBatch{}, nil
+	}
+
 	// 构建事件元数据
 	meta := EventMeta{
 		SchemaVersion: "nb67.event",
@@ -212,6 +371,7 @@ func (p *NB67EventProcessor) Process(ctx context.Context, msg *service.Message)
 		EventTimeText: input.EventTimeText,
 		IngestTime:    input.IngestTime,
 		ProcessTime:   time.Now().In(beijingLoc).Format(time.RFC3339Nano),
+		ConfigVersion: csVersion(),
 	}
 
 	// 【核心修复】：根据 RUNTIME 环境选择时间源
@@ -230,14 +390,23 @@ func (p *NB67EventProcessor) Process(ctx context.Context, msg *service.Message)
 		currentTime = time.Now()
 	}
 
-	// 构建三类事件命中列表
+	// 遥测断档检测必须先于规则判定，避免旧计时器在设备回归的第一帧即触发
+	p.touchDevice(input.DeviceID, currentTime)
+
+	// 构建三类事件命中列表及部件更换
 	cidInt := func() int { n, _ := input.CarriageID.Int64(); return int(n) }()
 	predictHits := p.buildPredictHits(input.Raw, cidInt, input.DeviceID, currentTime)
 	alarmHits := buildAlarmHits(input.Raw)
-	lifeHits := buildLifeHits(input.Raw, cidInt)
+	lifeHits := buildLifeHits(input.Raw, meta.LineID, cidInt)
+	replacementHits := p.detectReplacements(input.DeviceID, input.Raw, cidInt, currentTime)
+	p.lifeLimitTime(input.DeviceID, lifeHits, currentTime)
+	lifeForecasts := p.lifeForecasts(input.DeviceID, meta.LineID, cidInt, input.Raw, currentTime)
 
-	// 如果三类命中均为空，直接拦截，不向下游输出任何内容
-	if len(predictHits) == 0 && len(alarmHits) == 0 && len(lifeHits) == 0 {
+	// 预警/告警命中清零时需输出一次 clear 子事件，供下游关闭 6.1 记录
+	predictCleared, alarmCleared := p.hitTransitions(input.DeviceID, len(predictHits) > 0, len(alarmHits) > 0)
+
+	// 如果四类命中均为空、无清零转换且无寿命预测，直接拦截，不向下游输出任何内容
+	if len(predictHits) == 0 && len(alarmHits) == 0 && len(lifeHits) == 0 && len(replacementHits) == 0 && !predictCleared && !alarmCleared && len(lifeForecasts) == 0 {
 		return service.MessageBatch{}, nil
 	}
 
@@ -245,7 +414,15 @@ func (p *NB67EventProcessor) Process(ctx context.Context, msg *service.Message)
 	output := EventOutput{
 		PredictEvent: SubEvent{EventMeta: meta, Hits: predictHits, Source: "connect-rule-v2"},
 		AlarmEvent:   SubEvent{EventMeta: meta, Hits: alarmHits, Source: "raw-fault-bit"},
-		LifeEvent:    SubEvent{EventMeta: meta, Hits: lifeHits, Source: "part-life-v2"},
+		LifeEvent:    SubEvent{EventMeta: meta, Hits: lifeHits, Source: "part-life-v2", Forecasts: lifeForecasts},
+
+		ReplacementEvent: SubEvent{EventMeta: meta, Hits: replacementHits, Source: "part-replacement-v1"},
+	}
+	if predictCleared {
+		output.PredictEvent.Transition = transitionClear
+	}
+	if alarmCleared {
+		output.AlarmEvent.Transition = transitionClear
 	}
 
 	outBytes, err := json.Marshal(output)
@@ -260,9 +437,20 @@ func (p *NB67EventProcessor) Process(ctx context.Context, msg *service.Message)
 	return service.MessageBatch{outMsg}, nil
 }
 
-// Close 实现 service.Processor 接口。
+// Close 实现 service.Processor 接口，停止后台任务；持久化已启用时做最后一次 checkpoint。
 func (p *NB67EventProcessor) Close(ctx context.Context) error {
-	return nil
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.stopLoop)
+		if p.stateStore == nil {
+			return
+		}
+		if err = p.checkpointStates(ctx); err != nil {
+			p.logger.Errorf("RuleState: 关闭前 checkpoint 失败: %v", err)
+		}
+		_ = p.stateStore.Close()
+	})
+	return err
 }
 
 // ============================================================
@@ -309,203 +497,10 @@ func hvacCode(hvacBase int, seq int) string {
 //   seq 01~26 对应 26 种预警类型
 // ============================================================
 
-// buildPredictHits 全量实现 HVAC101 ~ HVAC126 业务逻辑
+// buildPredictHits 按已加载的规则集（见 rule_engine.go、hvac_predict_rules.yaml）
+// 求值 HVAC101 ~ HVAC126。
 func (p *NB67EventProcessor) buildPredictHits(raw map[string]any, carriageID int, deviceID string, currentTime time.Time) []PredictHit {
-	hits := make([]PredictHit, 0)
-	if len(raw) == 0 {
-		return hits
-	}
-	base := carriageID * 100
-
-	// 辅助变量
-	wModeU1 := rawInt(raw, "WmodeU1")
-	wModeU2 := rawInt(raw, "WmodeU2")
-
-	// ================================================================
-	// 1. 冷媒泄漏预警 (HVAC_01 ~ HVAC_04)
-	// ================================================================
-	checkRefLeak := func(mode int64, hvacSeq int, name string) {
-		code := hvacCode(base, hvacSeq)
-		uIdx := (hvacSeq + 1) / 2
-		sIdx := (hvacSeq+1)%2 + 1
-		fcp := rawInt(raw, fmt.Sprintf("FCpU%d%d", uIdx, sIdx))
-		suckp := rawInt(raw, fmt.Sprintf("SuckpU%d%d", uIdx, sIdx))
-		highp := rawInt(raw, fmt.Sprintf("HighpressU%d%d", uIdx, sIdx))
-
-		// 条件1：制冷模式 + 频率>30Hz + 吸气<2.0bar -> 持续5分钟
-		isCoolingLeak := (mode == 2 || mode == 3) && fcp > 300 && suckp < 20
-		if p.checkRule(isCoolingLeak, 5*time.Minute, deviceID, code+"_c", currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-			return
-		}
-		// 条件2：通风模式 + 高压<5bar -> 持续15分钟
-		isVentLeak := mode == 1 && highp < 50
-		if p.checkRule(isVentLeak, 15*time.Minute, deviceID, code+"_v", currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-		}
-	}
-	checkRefLeak(wModeU1, 1, "机组1系统1冷媒泄露预警")
-	checkRefLeak(wModeU1, 2, "机组1系统2冷媒泄露预警")
-	checkRefLeak(wModeU2, 3, "机组2系统1冷媒泄露预警")
-	checkRefLeak(wModeU2, 4, "机组2系统2冷媒泄露预警")
-
-	// ================================================================
-	// 2. 制冷系统预警 (HVAC_05 ~ HVAC_06)
-	// ================================================================
-	checkCpSys := func(uIdx int, name string) {
-		code := hvacCode(base, uIdx+4)
-		f1 := rawInt(raw, fmt.Sprintf("FCpU%d1", uIdx))
-		f2 := rawInt(raw, fmt.Sprintf("FCpU%d2", uIdx))
-		i1 := rawInt(raw, fmt.Sprintf("ICpU%d1", uIdx))
-		i2 := rawInt(raw, fmt.Sprintf("ICpU%d2", uIdx))
-		sp1 := rawInt(raw, fmt.Sprintf("SpU%d1", uIdx))
-		sp2 := rawInt(raw, fmt.Sprintf("SpU%d2", uIdx))
-
-		// 条件1：同频电流差 > 2A -> 持续3分钟
-		isCurrentDiff := f1 == f2 && f1 > 0 && (i1-i2 > 20 || i1-i2 < -20)
-		if p.checkRule(isCurrentDiff, 3*time.Minute, deviceID, code+"_i", currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-			return
-		}
-		// 条件2：运行 > 5min 后，过热度异常 -> 持续10分钟
-		isRunning := f1 > 0 || f2 > 0
-		hasBeenRunning := p.checkRule(isRunning, 5*time.Minute, deviceID, code+"_run", currentTime)
-		isSpErr := hasBeenRunning && (sp1 > 200 || sp1 < -80 || sp2 > 200 || sp2 < -80)
-		if p.checkRule(isSpErr, 10*time.Minute, deviceID, code+"_sp", currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-		}
-	}
-	checkCpSys(1, "机组1制冷系统预警")
-	checkCpSys(2, "机组2制冷系统预警")
-
-	// ================================================================
-	// 3. 传感器预警 (HVAC_07 ~ HVAC_11)
-	// ================================================================
-	// HVAC_07/08: 温差 > 8℃ -> 持续 5 分钟 (WARN_TEMP_SENSOR)
-	tempThresh := csRawThreshold("WARN_TEMP_SENSOR", 80)
-	tempDur := csDuration("WARN_TEMP_SENSOR", 5*time.Minute)
-	fasCondition := rawInt(raw, "FasU1")-rawInt(raw, "FasU2") > tempThresh || rawInt(raw, "FasU1")-rawInt(raw, "FasU2") < -tempThresh
-	if p.checkRule(fasCondition, tempDur, deviceID, hvacCode(base, 7), currentTime) {
-		hits = append(hits, PredictHit{Code: hvacCode(base, 7), Name: "新风温度传感器预警", Severity: 3})
-	}
-	rasCondition := rawInt(raw, "RasU1")-rawInt(raw, "RasU2") > tempThresh || rawInt(raw, "RasU1")-rawInt(raw, "RasU2") < -tempThresh
-	if p.checkRule(rasCondition, tempDur, deviceID, hvacCode(base, 8), currentTime) {
-		hits = append(hits, PredictHit{Code: hvacCode(base, 8), Name: "回风温度传感器预警", Severity: 3})
-	}
-
-	// HVAC_09: 车厢超温预警（PHM 文档条件）
-	// 条件1：制冷系统核心部件无故障（PHM "制冷系统无故障"）
-	//   注意：仅检查压缩机/变频器/高低压等制冷核心故障，传感器故障（如 BfltDiffpresU）不纳入，
-	//   避免因 mock 帧 presdiff=32767 误触发传感器故障位而永久屏蔽超温预警。
-	// 条件2：运行于强冷(2)/弱冷(3)模式，持续 > min_cooling_runtime_s
-	// 条件3：回风温度(RasU) > 制冷目标温度 + delta，持续 > duration_seconds
-	coolingSystemFaulty :=
-		rawBool(raw, "BfltPowersupplyU1") || rawBool(raw, "BfltPowersupplyU2") ||
-			rawBool(raw, "BfltTempover") ||
-			rawBool(raw, "BlpfltCompU11") || rawBool(raw, "BlpfltCompU12") ||
-			rawBool(raw, "BlpfltCompU21") || rawBool(raw, "BlpfltCompU22") ||
-			rawBool(raw, "BscfltCompU11") || rawBool(raw, "BscfltCompU12") ||
-			rawBool(raw, "BscfltCompU21") || rawBool(raw, "BscfltCompU22") ||
-			rawBool(raw, "BfltHighpresU11") || rawBool(raw, "BfltHighpresU12") ||
-			rawBool(raw, "BfltHighpresU21") || rawBool(raw, "BfltHighpresU22") ||
-			rawBool(raw, "BfltLowpresU11") || rawBool(raw, "BfltLowpresU12") ||
-			rawBool(raw, "BfltLowpresU21") || rawBool(raw, "BfltLowpresU22") ||
-			rawBool(raw, "BfltVfdU11") || rawBool(raw, "BfltVfdU12") ||
-			rawBool(raw, "BfltVfdU21") || rawBool(raw, "BfltVfdU22")
-	overtempThresh := csOvertempAbsThreshold("WARN_CABIN_OVERHEAT", 300)
-	overtempDur := csDuration("WARN_CABIN_OVERHEAT", 2*time.Minute)
-	coolingPrecondDur := csCoolingPreconditionDur("WARN_CABIN_OVERHEAT", 20*time.Minute)
-	coolingNormal := !coolingSystemFaulty && (wModeU1 == 2 || wModeU1 == 3 || wModeU2 == 2 || wModeU2 == 3)
-	sysRunningLong := p.checkRule(coolingNormal, coolingPrecondDur, deviceID, "cooling_normal_20", currentTime)
-	isOvertemp := sysRunningLong && (rawInt(raw, "RasU1") > overtempThresh || rawInt(raw, "RasU2") > overtempThresh)
-	if p.checkRule(isOvertemp, overtempDur, deviceID, hvacCode(base, 9), currentTime) {
-		hits = append(hits, PredictHit{Code: hvacCode(base, 9), Name: "车厢温度超温预警", Severity: 3})
-	}
-
-	// HVAC_10/11: 压差超阈值 -> 持续 30 分钟 (WARN_FILTER_CLOG)
-	filterThresh := csRawThreshold("WARN_FILTER_CLOG", 3000)
-	filterDur := csDuration("WARN_FILTER_CLOG", 30*time.Minute)
-	if p.checkRule(rawBool(raw, "CfbkEfU11") && rawInt(raw, "PresdiffU1") > filterThresh && rawInt(raw, "PresdiffU1") < 32767, filterDur, deviceID, hvacCode(base, 10), currentTime) {
-		hits = append(hits, PredictHit{Code: hvacCode(base, 10), Name: "机组1滤网脏堵预警", Severity: 2})
-	}
-	if p.checkRule(rawBool(raw, "CfbkEfU21") && rawInt(raw, "PresdiffU2") > filterThresh && rawInt(raw, "PresdiffU2") < 32767, filterDur, deviceID, hvacCode(base, 11), currentTime) {
-		hits = append(hits, PredictHit{Code: hvacCode(base, 11), Name: "机组2滤网脏堵预警", Severity: 2})
-	}
-
-	// ================================================================
-	// 4. 风机电流预警 (HVAC_12 ~ HVAC_20) -> 持续时间由 DB 配置
-	// ================================================================
-	efThresh := csRawThreshold("WARN_EF_CURRENT", 18)     // 通风机 PHM 3.6
-	cfThresh := csRawThreshold("WARN_CF_CURRENT", 23)     // 冷凝风机 PHM 3.7
-	exufThresh := csRawThreshold("WARN_EXUF_CURRENT", 23) // 废排风机 PHM 3.8
-	fanDur := csDuration("WARN_EF_CURRENT", 10*time.Minute)
-
-	checkFanI := func(cfbkField, iField string, threshold int64, seq int, name string) {
-		code := hvacCode(base, seq)
-		isOverI := rawBool(raw, cfbkField) && rawInt(raw, iField) > threshold
-		if p.checkRule(isOverI, fanDur, deviceID, code, currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-		}
-	}
-	checkFanI("CfbkEfU11", "IEfU11", efThresh, 12, "机组1通风机1电流预警")
-	checkFanI("CfbkEfU11", "IEfU12", efThresh, 13, "机组1通风机2电流预警")
-	checkFanI("CfbkEfU21", "IEfU21", efThresh, 14, "机组2通风机1电流预警")
-	checkFanI("CfbkEfU21", "IEfU22", efThresh, 15, "机组2通风机2电流预警")
-	checkFanI("CfbkCfU11", "ICfU11", cfThresh, 16, "机组1冷凝风机1电流预警")
-	checkFanI("CfbkCfU11", "ICfU12", cfThresh, 17, "机组1冷凝风机2电流预警")
-	checkFanI("CfbkCfU21", "ICfU21", cfThresh, 18, "机组2冷凝风机1电流预警")
-	checkFanI("CfbkCfU21", "ICfU22", cfThresh, 19, "机组2冷凝风机2电流预警")
-	checkFanI("CfbkExufan", "IExufan", exufThresh, 20, "废排风机电流预警")
-
-	// ================================================================
-	// 5. 压缩机电流预警 (HVAC_21 ~ HVAC_24) -> 新风 < 35℃ 且 I 超阈值 -> 持续时间由 DB 配置
-	// ================================================================
-	cpThresh := csRawThreshold("WARN_CP_CURRENT", 180) // 18A × 10
-	cpDur := csDuration("WARN_CP_CURRENT", 10*time.Minute)
-
-	checkCpI := func(fasField, iField string, seq int, name string) {
-		code := hvacCode(base, seq)
-		isOverI := rawInt(raw, fasField) < 350 && rawInt(raw, iField) > cpThresh
-		if p.checkRule(isOverI, cpDur, deviceID, code, currentTime) {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-		}
-	}
-	checkCpI("FasU1", "ICpU11", 21, "机组1压缩机1电流预警")
-	checkCpI("FasU1", "ICpU12", 22, "机组1压缩机2电流预警")
-	checkCpI("FasU2", "ICpU21", 23, "机组2压缩机1电流预警")
-	checkCpI("FasU2", "ICpU22", 24, "机组2压缩机2电流预警")
-
-	// ================================================================
-	// 6. 空气质量预警 (HVAC_125 ~ HVAC_126) — 阈值与持续时间由 DB 配置
-	// ================================================================
-	co2Thresh := csRawThreshold("WARN_AQ_CO2", 4500)
-	co2Dur := csDuration("WARN_AQ_CO2", 15*time.Minute)
-	pm25Thresh := csRawThreshold("WARN_AQ_PM25", 75)
-	pm10Thresh := csRawThreshold("WARN_AQ_PM10", 150)
-	tvocThresh := csRawThreshold("WARN_AQ_TVOC", 600)
-	pmDur := csDuration("WARN_AQ_PM25", 20*time.Minute)
-
-	checkAQ := func(uIdx int, name string) {
-		code := hvacCode(base, uIdx+24) // uIdx=1→125, uIdx=2→126
-		fanRunning := rawBool(raw, fmt.Sprintf("CfbkEfU%d1", uIdx))
-		hasBeenRunning := p.checkRule(fanRunning, 20*time.Minute, deviceID, code+"_fanrun", currentTime)
-
-		co2Err := hasBeenRunning && rawInt(raw, fmt.Sprintf("AqCo2U%d", uIdx)) > co2Thresh
-		co2Hit := p.checkRule(co2Err, co2Dur, deviceID, code+"_co2", currentTime)
-
-		pmTvocErr := hasBeenRunning && (rawInt(raw, fmt.Sprintf("AqPm25U%d", uIdx)) > pm25Thresh ||
-			rawInt(raw, fmt.Sprintf("AqPm10U%d", uIdx)) > pm10Thresh ||
-			rawInt(raw, fmt.Sprintf("AqTvocU%d", uIdx)) > tvocThresh)
-		pmTvocHit := p.checkRule(pmTvocErr, pmDur, deviceID, code+"_pmtvoc", currentTime)
-
-		if co2Hit || pmTvocHit {
-			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
-		}
-	}
-	checkAQ(1, "机组1空气质量预警")
-	checkAQ(2, "机组2空气质量预警")
-
-	return hits
+	return p.rules.evaluate(p, raw, carriageID, deviceID, currentTime)
 }
 
 // ============================================================
@@ -646,13 +641,66 @@ func buildAlarmHits(raw map[string]any) []AlarmHit {
 	return hits
 }
 
+// ============================================================
+// 部件累计计数器表：buildLifeHits 与更换检测（part_replacement.go）共用
+// ============================================================
+
+// 计数器类别，决定额定寿命与预警阈值（对应 warning_config 的 WARN_LIFE_* 行）。
+const (
+	counterFan   = "fan"   // 风机类（秒）
+	counterComp  = "comp"  // 压缩机（秒）
+	counterValve = "valve" // 阀门类（次）
+)
+
+// lifeCounter 描述一个部件累计计数器（raw 字段）。
+type lifeCounter struct {
+	Field  string // raw 字段名
+	Offset int    // 部件码偏移：part_code = carriage_id*1000 + 50000 + offset
+	Name   string // 中文名称
+	Kind   string // counterFan | counterComp | counterValve
+}
+
+// limits 返回该计数器在指定线路 / 车厢 / 部件码下的寿命阈值，ok 为 false 表示该类寿命预警已停用。
+func (c lifeCounter) limits(lineID string, carriageID int, partCode string) (lim lifeLimits, ok bool) {
+	switch c.Kind {
+	case counterComp:
+		return csLifeLimits("WARN_LIFE_COMP", lineID, carriageID, partCode, lifeLimits{cpLifeS, cpWarnS, cpCritS})
+	case counterValve:
+		return csLifeLimits("WARN_LIFE_VALVE", lineID, carriageID, partCode, lifeLimits{valveLifeN, valveWarnN, valveCritN})
+	default:
+		return csLifeLimits("WARN_LIFE_FAN", lineID, carriageID, partCode, lifeLimits{fanLifeS, fanWarnS, fanCritS})
+	}
+}
+
+var lifeCounters = []lifeCounter{
+	// 机组1（offset +001~+006）
+	{"DwefOpTmU11", 1, "机组1通风机累计运行时间", counterFan},
+	{"DwcfOpTmU11", 2, "机组1冷凝风机累计运行时间", counterFan},
+	{"DwcpOpTmU11", 3, "机组1压缩机1累计运行时间", counterComp},
+	{"DwcpOpTmU12", 4, "机组1压缩机2累计运行时间", counterComp},
+	{"DwfadOpCntU1", 5, "机组1新风阀开关总次数", counterValve},
+	{"DwradOpCntU1", 6, "机组1回风阀开关总次数", counterValve},
+
+	// 机组2（offset +011~+016）
+	{"DwefOpTmU21", 11, "机组2通风机累计运行时间", counterFan},
+	{"DwcfOpTmU21", 12, "机组2冷凝风机累计运行时间", counterFan},
+	{"DwcpOpTmU21", 13, "机组2压缩机1累计运行时间", counterComp},
+	{"DwcpOpTmU22", 14, "机组2压缩机2累计运行时间", counterComp},
+	{"DwfadOpCntU2", 15, "机组2新风阀开关总次数", counterValve},
+	{"DwradOpCntU2", 16, "机组2回风阀开关总次数", counterValve},
+
+	// 废排（offset +021~+022）
+	{"DwexufanOpTm", 21, "废排风机累计运行时间", counterFan},
+	{"DwdmpexuOpCnt", 22, "废排风阀开关总次数", counterValve},
+}
+
 // ============================================================
 // buildLifeHits：部件寿命预警
 // part_code = carriage_id * 1000 + 50000 + offset
 // 风机时间单位：秒（raw）  阀门单位：次（raw）
 // ============================================================
 
-func buildLifeHits(raw map[string]any, carriageID int) []LifeHit {
+func buildLifeHits(raw map[string]any, lineID string, carriageID int) []LifeHit {
 	// 初始化为空 slice（非 nil），序列化时输出 [] 而非 null
 	hits := make([]LifeHit, 0)
 	// raw 为空时直接返回，避免误判断
@@ -661,58 +709,19 @@ func buildLifeHits(raw map[string]any, carriageID int) []LifeHit {
 	}
 	lifeBase := int64(carriageID*1000 + 50_000)
 
-	// checkFan 检查风机类寿命（单位：秒）
-	checkFan := func(field string, offset int, name string) {
-		val := rawInt(raw, field)
-		code := fmt.Sprintf("%d", lifeBase+int64(offset))
-		if val >= fanCritS {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 3, Value: val, Limit: fanLifeS})
-		} else if val >= fanWarnS {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 2, Value: val, Limit: fanLifeS})
+	for _, c := range lifeCounters {
+		val := rawInt(raw, c.Field)
+		code := fmt.Sprintf("%d", lifeBase+int64(c.Offset))
+		lim, ok := c.limits(lineID, carriageID, code)
+		if !ok {
+			continue
 		}
-	}
-
-	// checkComp 检查压缩机类寿命（单位：秒）
-	checkComp := func(field string, offset int, name string) {
-		val := rawInt(raw, field)
-		code := fmt.Sprintf("%d", lifeBase+int64(offset))
-		if val >= cpCritS {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 3, Value: val, Limit: cpLifeS})
-		} else if val >= cpWarnS {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 2, Value: val, Limit: cpLifeS})
-		}
-	}
-
-	// checkValve 检查阀门类寿命（单位：次）
-	checkValve := func(field string, offset int, name string) {
-		val := rawInt(raw, field)
-		code := fmt.Sprintf("%d", lifeBase+int64(offset))
-		if val >= valveCritN {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 3, Value: val, Limit: valveLifeN})
-		} else if val >= valveWarnN {
-			hits = append(hits, LifeHit{Code: code, Name: name, Severity: 2, Value: val, Limit: valveLifeN})
+		if val >= lim.Crit {
+			hits = append(hits, LifeHit{Code: code, Name: c.Name, Severity: 3, Value: val, Limit: lim.Limit, field: c.Field})
+		} else if val >= lim.Warn {
+			hits = append(hits, LifeHit{Code: code, Name: c.Name, Severity: 2, Value: val, Limit: lim.Limit, field: c.Field})
 		}
 	}
 
-	// 机组1（offset +001~+006）
-	checkFan("DwefOpTmU11", 1, "机组1通风机累计运行时间")
-	checkFan("DwcfOpTmU11", 2, "机组1冷凝风机累计运行时间")
-	checkComp("DwcpOpTmU11", 3, "机组1压缩机1累计运行时间")
-	checkComp("DwcpOpTmU12", 4, "机组1压缩机2累计运行时间")
-	checkValve("DwfadOpCntU1", 5, "机组1新风阀开关总次数")
-	checkValve("DwradOpCntU1", 6, "机组1回风阀开关总次数")
-
-	// 机组2（offset +011~+016）
-	checkFan("DwefOpTmU21", 11, "机组2通风机累计运行时间")
-	checkFan("DwcfOpTmU21", 12, "机组2冷凝风机累计运行时间")
-	checkComp("DwcpOpTmU21", 13, "机组2压缩机1累计运行时间")
-	checkComp("DwcpOpTmU22", 14, "机组2压缩机2累计运行时间")
-	checkValve("DwfadOpCntU2", 15, "机组2新风阀开关总次数")
-	checkValve("DwradOpCntU2", 16, "机组2回风阀开关总次数")
-
-	// 废排（offset +021~+022）
-	checkFan("DwexufanOpTm", 21, "废排风机累计运行时间")
-	checkValve("DwdmpexuOpCnt", 22, "废排风阀开关总次数")
-
 	return hits
 }
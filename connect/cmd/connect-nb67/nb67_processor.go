@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,7 +8,6 @@ import (
 	"time"
 
 	"github.com/benthosdev/benthos/v4/public/service"
-	"github.com/kaitai-io/kaitai_struct_go_runtime/kaitai"
 )
 
 var beijingLoc *time.Location
@@ -25,7 +23,11 @@ func init() {
 
 type NB67Processor struct {
 	count          int64
+	rejected       int64
+	unsupported    int64
 	logSampleEvery int64
+	validator      frameValidator
+	fallback       *frameLayout // 未注册协议版本的兜底布局，nil 表示不兜底
 }
 
 type ParsedOutput struct {
@@ -96,6 +98,7 @@ type ParsedOutput struct {
 
 	ParserVersion  string `json:"parser_version"`
 	QualityStatus  string `json:"quality_status"`
+	QualityCode    int    `json:"quality_code"`
 	FrameSize      int    `json:"frame_size"`
 	ParsedAtUnixMs int64  `json:"parsed_at_unix_ms"`
 
@@ -110,7 +113,28 @@ func NewNB67Processor(conf *service.ParsedConfig) (*NB67Processor, error) {
 	if v, err := conf.FieldInt("log_sample_every"); err == nil {
 		logSampleEvery = int64(v)
 	}
-	return &NB67Processor{logSampleEvery: logSampleEvery}, nil
+	validator := frameValidator{
+		headerCode01: defaultHeaderCode01,
+		headerCode02: defaultHeaderCode02,
+	}
+	if v, err := conf.FieldInt("header_code_01"); err == nil {
+		validator.headerCode01 = uint8(v)
+	}
+	if v, err := conf.FieldInt("header_code_02"); err == nil {
+		validator.headerCode02 = uint8(v)
+	}
+	if v, err := conf.FieldDuration("max_clock_skew"); err == nil {
+		validator.maxClockSkew = v
+	}
+	var fallback *frameLayout
+	if name, err := conf.FieldString("fallback_layout"); err == nil && name != "" {
+		l, ok := frameLayoutsByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown fallback_layout %q", name)
+		}
+		fallback = l
+	}
+	return &NB67Processor{logSampleEvery: logSampleEvery, validator: validator, fallback: fallback}, nil
 }
 
 func (p *NB67Processor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
@@ -119,13 +143,60 @@ func (p *NB67Processor) Process(ctx context.Context, msg *service.Message) (serv
 		return service.MessageBatch{msg}, fmt.Errorf("failed to get message bytes: %w", err)
 	}
 
-	nb67 := &Nb67{}
-	io := kaitai.NewStream(bytes.NewReader(payload))
-	if err := nb67.Read(io, nil, nb67); err != nil {
-		return service.MessageBatch{msg}, fmt.Errorf("NB67 parse error: %w", err)
+	hdr, ok := peekFrameHeader(payload)
+	if !ok {
+		return service.MessageBatch{msg}, fmt.Errorf("NB67 parse error: frame too short for header (%d bytes)", len(payload))
+	}
+	layout, ok := lookupFrameLayout(hdr)
+	fallback := !ok && p.fallback != nil
+	if fallback {
+		layout, ok = p.fallback, true
+		p.unsupported++
+		if p.logSampleEvery > 0 && (p.unsupported-1)%p.logSampleEvery == 0 {
+			log.Printf("[NB67] Unregistered protocol version %d msg_type=%d, decoding with fallback layout %s (%d so far)",
+				hdr.ProtocolVersion, hdr.MessageType, layout.Name, p.unsupported)
+		}
 	}
 
 	now := time.Now().In(beijingLoc)
+	var (
+		nb67     *Nb67
+		raw      *Nb67
+		quality  string
+		parserID string
+	)
+	if ok {
+		var consumed int64
+		var readErr error
+		nb67, consumed, readErr = layout.Decode(payload)
+		parserID = layout.Name
+		if fallback {
+			// 记录线上实际的协议版本，便于区分兜底解码的数据
+			parserID = fmt.Sprintf("%s-fallback-v%d", layout.Name, hdr.ProtocolVersion)
+		}
+		switch {
+		case readErr == nil:
+			quality = p.validator.Validate(nb67, len(payload), consumed, now)
+			raw = nb67
+		// 帧头完整但正文被截断时仍输出一条 TRUNCATED 记录，便于按设备统计坏帧；
+		// 同步字不对时优先判为 BAD_HEADER。连帧头都读不全的数据无法归属设备，维持原有报错行为。
+		case isTruncatedReadErr(readErr) && len(payload) >= nb67HeaderSize:
+			quality = QualityTruncated
+			if p.validator.badHeader(payload) {
+				quality = QualityBadHeader
+			}
+		case p.validator.badHeader(payload):
+			return service.MessageBatch{msg}, fmt.Errorf("NB67 parse error (%s): %s: %w", layout.Name, QualityBadHeader, readErr)
+		default:
+			return service.MessageBatch{msg}, fmt.Errorf("NB67 parse error (%s): %w", layout.Name, readErr)
+		}
+	} else {
+		// 未注册的协议版本：帧头各版本通用，仅输出帧头字段供统计
+		nb67, _, _ = decodeNb67V1(payload)
+		parserID = fmt.Sprintf("nb67-v%d-unsupported", hdr.ProtocolVersion)
+		quality = QualityUnsupported
+	}
+
 	output := &ParsedOutput{
 		HeaderCode01:    nb67.MsgHeaderCode01,
 		HeaderCode02:    nb67.MsgHeaderCode02,
@@ -192,12 +263,13 @@ func (p *NB67Processor) Process(ctx context.Context, msg *service.Message) (serv
 		CurStation:      nb67.CurStation,
 		NextStation:     nb67.NextStation,
 
-		ParserVersion:  "nb67-v1",
-		QualityStatus:  "OK",
+		ParserVersion:  parserID,
+		QualityStatus:  quality,
+		QualityCode:    qualityCode(quality),
 		FrameSize:      len(payload),
 		ParsedAtUnixMs: now.UnixMilli(),
 		ParsedAt:       now.Format(time.RFC3339Nano),
-		Raw:            nb67,
+		Raw:            raw,
 	}
 
 	jsonBytes, err := json.Marshal(output)
@@ -208,6 +280,13 @@ func (p *NB67Processor) Process(ctx context.Context, msg *service.Message) (serv
 	msg.SetBytes(jsonBytes)
 
 	p.count++
+	if quality != QualityOK {
+		p.rejected++
+		if p.logSampleEvery > 0 && (p.rejected-1)%p.logSampleEvery == 0 {
+			log.Printf("[NB67] Frame quality %s (%d non-OK so far): TrainNo=%d Carriage=%d FrameSize=%d MsgLength=%d",
+				quality, p.rejected, output.TrainNo, output.CarriageNo, len(payload), output.MessageLength)
+		}
+	}
 	if p.logSampleEvery > 0 && p.count%p.logSampleEvery == 0 {
 		log.Printf("[NB67] Processed %d frames: TrainNo=%d Carriage=%d CurStation=%d", p.count, output.TrainNo, output.CarriageNo, output.CurStation)
 	}
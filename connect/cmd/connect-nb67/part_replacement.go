@@ -0,0 +1,204 @@
+package main
+
+// part_replacement.go
+//
+// 部件更换检测：基于部件累计计数器（lifeCounters）的回落。
+//
+// 问题：DwcpOpTmU11、DwfadOpCntU1 等字段在部件或控制器更换前单调递增，更换后回落到较小值。
+// 此前回落只是让上报值悄悄变小，下游寿命跟踪（6.7、部件履历）无从得知部件已更换。
+//
+// 处理：
+//   - 每台设备每个计数器记录基线（最近确认的累计值），key 为 deviceID + ":" + counterRulePrefix + 字段名
+//   - 新值低于基线的帧连续达到 replacement_confirm_frames 帧，判定为更换，输出一条 ReplacementHit，
+//     基线改为新值；中途回到基线以上视为坏值，放弃本次判定
+//   - 字段缺失的帧不参与判定（rawInt 对缺失字段返回 0，不能当作回落）
+//   - 更换多发生在车辆离线检修期间，因此离线设备被 sweeper 清理时保留计数器基线；
+//     基线以伪规则 key 随规则计时器一起持久化（persistedRuleState.Value），
+//     写入频率限制为每个计数器 counterSaveInterval 一次，回落判定只需基线不高于真实值
+//   - 子事件经 replacement_event 输出到 signal-replacement topic，
+//     由 ground-reporter 转发平台（6.7），storage-adapter 写入 hvac.part_history
+//
+// 同一基线还记录用量速率窗口（窗口起点的消息时间与累计值），据此估算部件达到额定寿命的时间：
+// 寿命命中带 LifeHit.LimitTime（见 lifeLimitTime），每台设备每 lifeForecastInterval 另输出一次
+// 全部部件的额定寿命与预测（life_event.forecasts，见 lifeForecasts），ground-reporter 的 6.7 上报
+// 只使用这里的预测。窗口只在内存中，重启或部件更换后重新积累。
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// counterRulePrefix 是计数器基线在持久化层使用的伪规则码前缀。
+const counterRulePrefix = "__counter:"
+
+// counterSaveInterval 计数器基线随 checkpoint 持久化的最小间隔（回落确认时立即持久化）。
+const counterSaveInterval = 10 * time.Minute
+
+// 用量速率窗口：窗口满 lifeRateWindow 后以上一窗口的速率为准并重新起算，
+// 当前窗口不足 lifeRateMinSpan 时沿用上一窗口速率，均无则不估算。
+const (
+	lifeRateWindow  = 30 * 24 * time.Hour
+	lifeRateMinSpan = 24 * time.Hour
+)
+
+// lifeForecastInterval 每台设备输出全部部件寿命预测的最小间隔（消息时间）。
+const lifeForecastInterval = time.Hour
+
+// ReplacementHit 部件更换条目。
+type ReplacementHit struct {
+	Code     string `json:"code"`     // 部件码
+	Name     string `json:"name"`     // 中文名称
+	Field    string `json:"field"`    // raw 计数器字段
+	Kind     string `json:"kind"`     // fan | comp | valve
+	Previous int64  `json:"previous"` // 更换前累计值（秒或次）
+	Current  int64  `json:"current"`  // 更换后累计值（秒或次）
+}
+
+// counterState 是一个计数器的基线，按值存入 sync.Map。
+type counterState struct {
+	value   int64     // 最近确认的累计值
+	drops   int       // 连续低于基线的帧数
+	savedAt time.Time // 最近一次登记持久化的系统时间
+
+	rateAt    time.Time // 用量速率窗口起点（消息时间），零值表示尚未开始
+	rateValue int64     // 窗口起点的累计值
+	rate      float64   // 上一完整窗口的用量速率（每秒）
+}
+
+// advanceRate 以本帧累计值推进用量速率窗口。
+func (st *counterState) advanceRate(cur int64, msgTime time.Time) {
+	if st.rateAt.IsZero() || msgTime.Before(st.rateAt) {
+		st.rateAt, st.rateValue = msgTime, cur
+		return
+	}
+	if span := msgTime.Sub(st.rateAt); span >= lifeRateWindow {
+		st.rate = float64(cur-st.rateValue) / span.Seconds()
+		st.rateAt, st.rateValue = msgTime, cur
+	}
+}
+
+// limitTime 估算累计值 val 达到额定寿命 limit 的时间（unix ms）：历史不足或部件未在使用时返回 0，
+// 已达到额定寿命时返回本帧时间。速率按日历时间计，停运天数会相应拉低速率。
+func (st counterState) limitTime(val, limit int64, msgTime time.Time) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	if val >= limit {
+		return msgTime.UnixMilli()
+	}
+	rate := st.rate
+	if !st.rateAt.IsZero() {
+		if span := msgTime.Sub(st.rateAt); span >= lifeRateMinSpan && val > st.rateValue {
+			rate = float64(val-st.rateValue) / span.Seconds()
+		}
+	}
+	if rate <= 0 {
+		return 0
+	}
+	return msgTime.UnixMilli() + int64(float64(limit-val)/rate*1000)
+}
+
+// lifeLimitTime 为本帧寿命命中填入预计达到额定寿命的时间，需在 detectReplacements 之后调用。
+func (p *NB67EventProcessor) lifeLimitTime(deviceID string, hits []LifeHit, msgTime time.Time) {
+	for i := range hits {
+		v, ok := p.counters.Load(deviceID + ":" + counterRulePrefix + hits[i].field)
+		if !ok {
+			continue
+		}
+		hits[i].LimitTime = v.(counterState).limitTime(hits[i].Value, hits[i].Limit, msgTime)
+	}
+}
+
+// lifeForecasts 距设备上次输出超过 lifeForecastInterval 时返回本帧全部计数器的寿命预测，
+// 否则返回 nil。需在 detectReplacements 之后调用。
+func (p *NB67EventProcessor) lifeForecasts(deviceID, lineID string, carriageID int, raw map[string]any, msgTime time.Time) []LifeForecast {
+	if v, ok := p.forecastAt.Load(deviceID); ok {
+		if last := v.(time.Time); !msgTime.Before(last) && msgTime.Sub(last) < lifeForecastInterval {
+			return nil
+		}
+	}
+	lifeBase := int64(carriageID*1000 + 50_000)
+
+	var out []LifeForecast
+	for _, c := range lifeCounters {
+		if _, present := raw[c.Field]; !present {
+			continue
+		}
+		f := LifeForecast{Code: fmt.Sprintf("%d", lifeBase+int64(c.Offset)), Value: rawInt(raw, c.Field)}
+		if lim, ok := c.limits(lineID, carriageID, f.Code); ok {
+			f.Limit = lim.Limit
+			if v, ok := p.counters.Load(deviceID + ":" + counterRulePrefix + c.Field); ok {
+				f.LimitTime = v.(counterState).limitTime(f.Value, f.Limit, msgTime)
+			}
+		}
+		out = append(out, f)
+	}
+	if len(out) > 0 {
+		p.forecastAt.Store(deviceID, msgTime)
+	}
+	return out
+}
+
+// detectReplacements 刷新设备全部计数器基线，返回本帧确认的部件更换。
+func (p *NB67EventProcessor) detectReplacements(deviceID string, raw map[string]any, carriageID int, msgTime time.Time) []ReplacementHit {
+	// 初始化为空 slice（非 nil），序列化时输出 [] 而非 null
+	hits := make([]ReplacementHit, 0)
+	lifeBase := int64(carriageID*1000 + 50_000)
+	now := time.Now()
+
+	for _, c := range lifeCounters {
+		if _, present := raw[c.Field]; !present {
+			continue
+		}
+		cur := rawInt(raw, c.Field)
+		key := deviceID + ":" + counterRulePrefix + c.Field
+
+		v, ok := p.counters.Load(key)
+		if !ok {
+			p.storeCounter(key, counterState{value: cur, savedAt: now, rateAt: msgTime, rateValue: cur}, msgTime)
+			continue
+		}
+		st := v.(counterState)
+
+		if cur >= st.value {
+			st.value, st.drops = cur, 0
+			st.advanceRate(cur, msgTime)
+			if now.Sub(st.savedAt) >= counterSaveInterval {
+				st.savedAt = now
+				p.storeCounter(key, st, msgTime)
+			} else {
+				p.counters.Store(key, st)
+			}
+			continue
+		}
+
+		st.drops++
+		if st.drops < p.replacementConfirm {
+			p.counters.Store(key, st)
+			continue
+		}
+		hits = append(hits, ReplacementHit{
+			Code:     fmt.Sprintf("%d", lifeBase+int64(c.Offset)),
+			Name:     c.Name,
+			Field:    c.Field,
+			Kind:     c.Kind,
+			Previous: st.value,
+			Current:  cur,
+		})
+		p.logger.Infof("PartReplacement: 设备 %s %s 由 %d 回落至 %d，判定为部件更换", deviceID, c.Field, st.value, cur)
+		p.storeCounter(key, counterState{value: cur, savedAt: now, rateAt: msgTime, rateValue: cur}, msgTime)
+	}
+	return hits
+}
+
+// storeCounter 更新内存基线并登记持久化。
+func (p *NB67EventProcessor) storeCounter(key string, st counterState, msgTime time.Time) {
+	p.counters.Store(key, st)
+	p.markStateDirty(key, &ruleState{firstSeen: msgTime, value: st.value})
+}
+
+// isCounterKey 判断持久化 key 是否为计数器基线。
+func isCounterKey(key string) bool {
+	return strings.Contains(key, ":"+counterRulePrefix)
+}
@@ -0,0 +1,567 @@
+package main
+
+// rule_engine.go
+//
+// 声明式预警规则引擎：HVAC 算法预警由规则定义（YAML / JSON）驱动，
+// 新增 PHM 条目或调整前置条件无需发布 Go 版本。
+//
+// 规则来源（nb67_event_builder.rules_source）：
+//   - builtin：编译进二进制的 hvac_predict_rules.yaml（默认）
+//   - file：rules_path 指定的 YAML / JSON 文件，格式同默认规则文件
+//   - postgres：hvac.warning_rule 表，每行 definition 为单条规则（使用 PG_DSN）
+//   加载或编译失败时记录警告并回退到 builtin。
+//
+// 规则格式：
+//   version: 1
+//   rules:
+//     - id:       规则标识（日志用）
+//       seq:      预警序号，输出码 = HVAC{carriage_id*100 + seq}，支持模板
+//       name:     中文名称，支持模板
+//       severity: 3=高 2=中 1=低
+//       enabled:  false 时跳过（默认 true）
+//       expand:   模板参数列表，每组参数展开为一条规则实例（机组 U1/U2、系统 1/2 等）
+//       let:      [{name, when}]，每帧按顺序求值的命名条件，供 ref 引用
+//       when:     命中条件
+//
+// 条件节点（每个节点只能使用一种形式）：
+//   all: [...] / any: [...]   与 / 或，按顺序短路求值（与 Go 的 && / || 相同）
+//   not: {...}                取反
+//   ref: name                 引用 let 中已求值的命名条件
+//   flag: Field               布尔字段为真
+//   field: Field, op: > >= < <= == !=, value: N    与常量比较
+//   field: Field, op: ...,  to: Field2             与另一字段比较
+//   field: Field, in: [N, ...]                     取值属于集合
+//   field: Field, threshold: {config: WARN_X, default: N[, relative: target_temp]}
+//                             ConfigStore 迟滞阈值（trigger_operator / clear_value），
+//                             保持态取最近外层 gate 的规则是否已触发
+//   gate: {key, for, when}    持续时间门控（checkRule），when 持续成立 for 时长后为真
+//     key: 计时器 key，默认 "{code}"；与 hvac.rule_state 的 state_key 后缀一致
+//     for: 5m | {config: WARN_X, default: 5m[, param: min_cooling_runtime_s]}
+//   field 可附加 minus: Field2（取差值）与 abs: true（取绝对值）
+//
+// 模板：字符串中的 {name} 在编译时替换为 expand 参数；
+// {code} 为内置变量，求值时替换为当前车厢的预警码（如 HVAC301）。
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed hvac_predict_rules.yaml
+var defaultRulesYAML []byte
+
+// ============================================================
+// 规则定义（反序列化结构）
+// ============================================================
+
+type ruleFile struct {
+	Version int        `yaml:"version"`
+	Rules   []ruleSpec `yaml:"rules"`
+}
+
+type ruleSpec struct {
+	ID       string           `yaml:"id"`
+	Seq      string           `yaml:"seq"`
+	Name     string           `yaml:"name"`
+	Severity int              `yaml:"severity"`
+	Enabled  *bool            `yaml:"enabled"`
+	Expand   []map[string]any `yaml:"expand"`
+	Let      []letSpec        `yaml:"let"`
+	When     *condSpec        `yaml:"when"`
+}
+
+type letSpec struct {
+	Name string    `yaml:"name"`
+	When *condSpec `yaml:"when"`
+}
+
+type condSpec struct {
+	All  []*condSpec `yaml:"all"`
+	Any  []*condSpec `yaml:"any"`
+	Not  *condSpec   `yaml:"not"`
+	Ref  string      `yaml:"ref"`
+	Flag string      `yaml:"flag"`
+	Gate *gateSpec   `yaml:"gate"`
+
+	Field     string         `yaml:"field"`
+	Minus     string         `yaml:"minus"`
+	Abs       bool           `yaml:"abs"`
+	Op        string         `yaml:"op"`
+	Value     *int64         `yaml:"value"`
+	To        string         `yaml:"to"`
+	In        []int64        `yaml:"in"`
+	Threshold *thresholdSpec `yaml:"threshold"`
+}
+
+type gateSpec struct {
+	Key  string       `yaml:"key"`
+	For  durationSpec `yaml:"for"`
+	When *condSpec    `yaml:"when"`
+}
+
+type thresholdSpec struct {
+	Config   string `yaml:"config"`
+	Default  int64  `yaml:"default"`
+	Relative string `yaml:"relative"` // "" | "target_temp"
+}
+
+// durationSpec 支持两种写法：固定时长 "5m"，或 {config, default, param} 从 ConfigStore 读取。
+type durationSpec struct {
+	Config  string
+	Param   string
+	Default time.Duration
+	set     bool
+}
+
+func (d *durationSpec) UnmarshalYAML(node *yaml.Node) error {
+	d.set = true
+	if node.Kind == yaml.ScalarNode {
+		v, err := time.ParseDuration(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		d.Default = v
+		return nil
+	}
+	var m struct {
+		Config  string `yaml:"config"`
+		Param   string `yaml:"param"`
+		Default string `yaml:"default"`
+	}
+	if err := node.Decode(&m); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(m.Default)
+	if err != nil {
+		return fmt.Errorf("line %d: default: %w", node.Line, err)
+	}
+	d.Config, d.Param, d.Default = m.Config, m.Param, v
+	return nil
+}
+
+// ============================================================
+// 编译结果与求值
+// ============================================================
+
+// ruleEnv 是单条规则实例一次求值的上下文。
+type ruleEnv struct {
+	p        *NB67EventProcessor
+	raw      map[string]any
+	deviceID string
+	code     string
+	now      time.Time
+	lets     []bool
+}
+
+type condFn func(env *ruleEnv) bool
+
+type compiledRule struct {
+	id       string
+	seq      int
+	name     string
+	severity int
+	lets     []condFn
+	when     condFn
+}
+
+// ruleSet 是编译后的规则集，构造后只读，可被多个 pipeline 线程并发使用。
+type ruleSet struct {
+	source string
+	rules  []compiledRule
+}
+
+// evaluate 按规则顺序求值，返回命中的预警列表（非 nil）。
+func (rs *ruleSet) evaluate(p *NB67EventProcessor, raw map[string]any, carriageID int, deviceID string, now time.Time) []PredictHit {
+	hits := make([]PredictHit, 0)
+	if len(raw) == 0 {
+		return hits
+	}
+	base := carriageID * 100
+	env := &ruleEnv{p: p, raw: raw, deviceID: deviceID, now: now}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		env.code = hvacCode(base, r.seq)
+		env.lets = env.lets[:0]
+		for _, let := range r.lets {
+			env.lets = append(env.lets, let(env))
+		}
+		if r.when(env) {
+			hits = append(hits, PredictHit{Code: env.code, Name: r.name, Severity: r.severity})
+		}
+	}
+	return hits
+}
+
+// resolveKey 将计时器 key 中的 {code} 替换为当前预警码。
+func (env *ruleEnv) resolveKey(key string) string {
+	return strings.ReplaceAll(key, "{code}", env.code)
+}
+
+// ============================================================
+// 加载
+// ============================================================
+
+// loadRuleSet 按 source 加载并编译规则集。
+func loadRuleSet(source, path string) (*ruleSet, error) {
+	switch source {
+	case "", "builtin":
+		return compileRuleFile(defaultRulesYAML, "builtin")
+	case "file":
+		if path == "" {
+			return nil, errors.New("rules_path 未配置")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return compileRuleFile(data, path)
+	case "postgres":
+		return loadRuleSetFromDB()
+	}
+	return nil, fmt.Errorf("未知的 rules_source: %q", source)
+}
+
+func compileRuleFile(data []byte, source string) (*ruleSet, error) {
+	var f ruleFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", source, err)
+	}
+	if f.Version != 1 {
+		return nil, fmt.Errorf("%s: 不支持的规则版本 %d", source, f.Version)
+	}
+	return compileRuleSpecs(f.Rules, source)
+}
+
+// loadRuleSetFromDB 从 hvac.warning_rule 读取启用的规则（表结构见 07-migration-20261018.sql）。
+func loadRuleSetFromDB() (*ruleSet, error) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		return nil, errors.New("PG_DSN 未设置")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := db.QueryContext(ctx,
+		`SELECT rule_id, definition FROM hvac.warning_rule
+		 WHERE enabled ORDER BY sort_order, rule_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var specs []ruleSpec
+	for rows.Next() {
+		var id, def string
+		if err := rows.Scan(&id, &def); err != nil {
+			return nil, err
+		}
+		var spec ruleSpec
+		if err := yaml.Unmarshal([]byte(def), &spec); err != nil {
+			return nil, fmt.Errorf("规则 %s 解析失败: %w", id, err)
+		}
+		if spec.ID == "" {
+			spec.ID = id
+		}
+		specs = append(specs, spec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("hvac.warning_rule 中没有启用的规则")
+	}
+	return compileRuleSpecs(specs, "hvac.warning_rule")
+}
+
+// ============================================================
+// 编译
+// ============================================================
+
+func compileRuleSpecs(specs []ruleSpec, source string) (*ruleSet, error) {
+	rs := &ruleSet{source: source}
+	for _, spec := range specs {
+		if spec.Enabled != nil && !*spec.Enabled {
+			continue
+		}
+		if spec.When == nil {
+			return nil, fmt.Errorf("规则 %s: 缺少 when", spec.ID)
+		}
+		expand := spec.Expand
+		if len(expand) == 0 {
+			expand = []map[string]any{nil}
+		}
+		for i, params := range expand {
+			r, err := compileRuleInstance(spec, params)
+			if err != nil {
+				return nil, fmt.Errorf("规则 %s[%d]: %w", spec.ID, i, err)
+			}
+			rs.rules = append(rs.rules, r)
+		}
+	}
+	return rs, nil
+}
+
+func compileRuleInstance(spec ruleSpec, params map[string]any) (compiledRule, error) {
+	c := &ruleCompiler{params: params, lets: make(map[string]int)}
+	r := compiledRule{id: spec.ID, severity: spec.Severity}
+
+	seq, err := strconv.Atoi(c.str(spec.Seq))
+	if err != nil && c.err == nil {
+		c.err = fmt.Errorf("seq: %w", err)
+	}
+	r.seq = seq
+	r.name = c.str(spec.Name)
+
+	for _, let := range spec.Let {
+		if let.Name == "" || let.When == nil {
+			return r, errors.New("let 需要 name 与 when")
+		}
+		if _, dup := c.lets[let.Name]; dup {
+			return r, fmt.Errorf("let %s 重复定义", let.Name)
+		}
+		fn := c.cond(let.When)
+		c.lets[let.Name] = len(r.lets)
+		r.lets = append(r.lets, fn)
+	}
+	r.when = c.cond(spec.When)
+	return r, c.err
+}
+
+// templateVar 匹配模板变量 {name}。
+var templateVar = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ruleCompiler 将单个规则实例的条件树编译为闭包，记录遇到的第一个错误。
+type ruleCompiler struct {
+	params  map[string]any
+	lets    map[string]int
+	gateKey string // 最近外层 gate 的计时器 key，阈值节点据此判定迟滞保持态
+	err     error
+}
+
+func (c *ruleCompiler) fail(format string, args ...any) condFn {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, args...)
+	}
+	return func(*ruleEnv) bool { return false }
+}
+
+// str 替换模板参数；{code} 保留到求值时替换，其余未知变量视为错误。
+func (c *ruleCompiler) str(s string) string {
+	return templateVar.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[1 : len(m)-1]
+		if v, ok := c.params[name]; ok {
+			return fmt.Sprint(v)
+		}
+		if name != "code" && c.err == nil {
+			c.err = fmt.Errorf("模板变量 %s 未定义", m)
+		}
+		return m
+	})
+}
+
+func (c *ruleCompiler) cond(n *condSpec) condFn {
+	if n == nil {
+		return c.fail("条件节点为空")
+	}
+	kinds := 0
+	for _, set := range []bool{n.All != nil, n.Any != nil, n.Not != nil, n.Ref != "", n.Flag != "", n.Gate != nil, n.Field != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return c.fail("条件节点必须且只能使用一种形式（all/any/not/ref/flag/gate/field）")
+	}
+
+	switch {
+	case n.All != nil:
+		fns := c.conds(n.All)
+		return func(env *ruleEnv) bool {
+			for _, fn := range fns {
+				if !fn(env) {
+					return false
+				}
+			}
+			return true
+		}
+	case n.Any != nil:
+		fns := c.conds(n.Any)
+		return func(env *ruleEnv) bool {
+			for _, fn := range fns {
+				if fn(env) {
+					return true
+				}
+			}
+			return false
+		}
+	case n.Not != nil:
+		fn := c.cond(n.Not)
+		return func(env *ruleEnv) bool { return !fn(env) }
+	case n.Ref != "":
+		idx, ok := c.lets[n.Ref]
+		if !ok {
+			return c.fail("ref %s 未在之前的 let 中定义", n.Ref)
+		}
+		return func(env *ruleEnv) bool { return env.lets[idx] }
+	case n.Flag != "":
+		field := c.str(n.Flag)
+		return func(env *ruleEnv) bool { return rawBool(env.raw, field) }
+	case n.Gate != nil:
+		return c.gate(n.Gate)
+	}
+	return c.field(n)
+}
+
+func (c *ruleCompiler) conds(nodes []*condSpec) []condFn {
+	if len(nodes) == 0 {
+		c.fail("all/any 不能为空")
+	}
+	fns := make([]condFn, len(nodes))
+	for i, child := range nodes {
+		fns[i] = c.cond(child)
+	}
+	return fns
+}
+
+func (c *ruleCompiler) gate(g *gateSpec) condFn {
+	key := "{code}"
+	if g.Key != "" {
+		key = c.str(g.Key)
+	}
+	if !g.For.set {
+		return c.fail("gate %s 缺少 for", key)
+	}
+	dur := c.duration(g.For)
+
+	outer := c.gateKey
+	c.gateKey = key
+	inner := c.cond(g.When)
+	c.gateKey = outer
+
+	return func(env *ruleEnv) bool {
+		ok := inner(env)
+		return env.p.checkRule(ok, dur(), env.deviceID, env.resolveKey(key), env.now)
+	}
+}
+
+func (c *ruleCompiler) duration(d durationSpec) func() time.Duration {
+	def := d.Default
+	if d.Config == "" {
+		return func() time.Duration { return def }
+	}
+	code := c.str(d.Config)
+	switch d.Param {
+	case "":
+		return func() time.Duration { return csDuration(code, def) }
+	case "min_cooling_runtime_s":
+		return func() time.Duration { return csCoolingPreconditionDur(code, def) }
+	}
+	c.fail("未知的 duration param: %s", d.Param)
+	return func() time.Duration { return def }
+}
+
+// field 编译字段比较节点。
+func (c *ruleCompiler) field(n *condSpec) condFn {
+	value := c.value(n)
+	forms := 0
+	for _, set := range []bool{n.Value != nil, n.To != "", n.In != nil, n.Threshold != nil} {
+		if set {
+			forms++
+		}
+	}
+	if forms != 1 {
+		return c.fail("field %s 必须且只能使用 value / to / in / threshold 之一", n.Field)
+	}
+
+	switch {
+	case n.In != nil:
+		set := n.In
+		return func(env *ruleEnv) bool {
+			v := value(env.raw)
+			for _, want := range set {
+				if v == want {
+					return true
+				}
+			}
+			return false
+		}
+	case n.Threshold != nil:
+		return c.threshold(n.Threshold, value)
+	}
+
+	cmp, ok := compareOps[n.Op]
+	if !ok {
+		return c.fail("field %s: 不支持的 op %q", n.Field, n.Op)
+	}
+	if n.To != "" {
+		other := c.str(n.To)
+		return func(env *ruleEnv) bool { return cmp(value(env.raw), rawInt(env.raw, other)) }
+	}
+	rhs := *n.Value
+	return func(env *ruleEnv) bool { return cmp(value(env.raw), rhs) }
+}
+
+// value 编译字段取值：rawInt(field) [- rawInt(minus)] [绝对值]。
+func (c *ruleCompiler) value(n *condSpec) func(raw map[string]any) int64 {
+	field := c.str(n.Field)
+	minus := c.str(n.Minus)
+	abs := n.Abs
+	return func(raw map[string]any) int64 {
+		v := rawInt(raw, field)
+		if minus != "" {
+			v -= rawInt(raw, minus)
+		}
+		if abs && v < 0 {
+			v = -v
+		}
+		return v
+	}
+}
+
+func (c *ruleCompiler) threshold(t *thresholdSpec, value func(map[string]any) int64) condFn {
+	if c.gateKey == "" {
+		return c.fail("threshold 必须位于 gate 内（迟滞保持态取 gate 计时器）")
+	}
+	if t.Config == "" {
+		return c.fail("threshold 缺少 config")
+	}
+	code := c.str(t.Config)
+	def := t.Default
+	var lookup func() threshold
+	switch t.Relative {
+	case "":
+		lookup = func() threshold { return csThreshold(code, def) }
+	case "target_temp":
+		lookup = func() threshold { return csOvertempThreshold(code, def) }
+	default:
+		return c.fail("未知的 threshold relative: %s", t.Relative)
+	}
+	key := c.gateKey
+	return func(env *ruleEnv) bool {
+		return lookup().Exceeds(value(env.raw), env.p.latched(env.deviceID, env.resolveKey(key)))
+	}
+}
+
+var compareOps = map[string]func(a, b int64) bool{
+	">":  func(a, b int64) bool { return a > b },
+	">=": func(a, b int64) bool { return a >= b },
+	"<":  func(a, b int64) bool { return a < b },
+	"<=": func(a, b int64) bool { return a <= b },
+	"==": func(a, b int64) bool { return a == b },
+	"!=": func(a, b int64) bool { return a != b },
+}
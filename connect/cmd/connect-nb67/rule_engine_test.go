@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// rule_engine_test.go
+//
+// 内置规则集（hvac_predict_rules.yaml）与规则引擎上线前手写的 buildPredictHits
+// 逐帧对照：命中列表与计时器（states 的 key 及已触发标记）必须完全一致。
+// legacyPredictHits 为原实现的原样移植，除对照外不要修改。
+
+// recordedFrame 为现场录制帧（Mock 模式使用的同一份数据）。
+const recordedFrame = "../../../dist/mock-data/whole_frame-260203"
+
+func TestBuiltinRulesMatchLegacy(t *testing.T) {
+	base := recordedRaw(t)
+	rules, err := loadRuleSet("builtin", "")
+	if err != nil {
+		t.Fatalf("compile builtin rules: %v", err)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		compareWithLegacy(t, rules, base)
+	})
+	t.Run("hysteresis", func(t *testing.T) {
+		installConfig(t, configMap{
+			"WARN_TEMP_SENSOR":    {TriggerOperator: ">", TriggerValue: 8, ClearValue: 6, DurationSeconds: 300, Enabled: true, RawScale: 10},
+			"WARN_CABIN_OVERHEAT": {TriggerOperator: ">", TriggerValue: 4, ClearValue: 2, DurationSeconds: 120, Enabled: true, RawScale: 10, TargetTemp: 26, MinCoolingRuntimeS: 1200},
+			"WARN_FILTER_CLOG":    {TriggerOperator: ">", TriggerValue: 300, ClearValue: 250, DurationSeconds: 1800, Enabled: true, RawScale: 10},
+			"WARN_EF_CURRENT":     {TriggerOperator: ">", TriggerValue: 18, ClearValue: 15, DurationSeconds: 600, Enabled: true, RawScale: 1},
+			"WARN_CF_CURRENT":     {TriggerOperator: ">", TriggerValue: 23, ClearValue: 20, Enabled: true, RawScale: 1},
+			"WARN_EXUF_CURRENT":   {TriggerOperator: ">", TriggerValue: 23, ClearValue: 20, Enabled: true, RawScale: 1},
+			"WARN_CP_CURRENT":     {TriggerOperator: ">", TriggerValue: 18, ClearValue: 15, DurationSeconds: 600, Enabled: true, RawScale: 10},
+			"WARN_AQ_CO2":         {TriggerOperator: ">", TriggerValue: 4500, ClearValue: 4000, DurationSeconds: 900, Enabled: true, RawScale: 1},
+			"WARN_AQ_PM25":        {TriggerOperator: ">", TriggerValue: 75, ClearValue: 60, DurationSeconds: 1200, Enabled: true, RawScale: 1},
+			"WARN_AQ_PM10":        {TriggerOperator: ">", TriggerValue: 150, ClearValue: 120, Enabled: true, RawScale: 1},
+			"WARN_AQ_TVOC":        {TriggerOperator: ">", TriggerValue: 600, ClearValue: 500, Enabled: true, RawScale: 1},
+		})
+		held := compareWithLegacy(t, rules, base)
+		// 保持段数值落在 clear 与 trigger 之间，迟滞生效时已触发的阈值类预警应继续命中
+		for _, seq := range []int{7, 8, 9, 10, 12, 16, 20, 21, 25, 26} {
+			if code := hvacCode(100, seq); !held[code] {
+				t.Errorf("%s not held between clear and trigger", code)
+			}
+		}
+	})
+}
+
+// phase 是一段持续时长内保持不变的帧内容（在录制帧基础上覆盖部分字段）。
+type phase struct {
+	name string
+	dur  time.Duration
+	set  map[string]any
+	// flip 非空时奇数帧撤销这些字段的覆盖，用于检查条件中断后计时器重置
+	flip []string
+}
+
+// faultAll 使 HVAC_01 ~ HVAC_26 全部满足触发条件。
+var faultAll = map[string]any{
+	// 01/02：U1 制冷 + 频率>30Hz + 吸气<2.0bar；05：同频电流差；21/22：压缩机过流
+	"WmodeU1": 2, "FCpU11": 400, "FCpU12": 400, "SuckpU11": 10, "SuckpU12": 10,
+	"ICpU11": 250, "ICpU12": 200,
+	// 03/04：U2 通风 + 高压<5bar；06：运行后过热度异常；23/24：压缩机过流
+	"WmodeU2": 1, "HighpressU21": 30, "HighpressU22": 30,
+	"FCpU21": 300, "FCpU22": 0, "SpU21": 300, "ICpU21": 200, "ICpU22": 200,
+	// 07/08：温差；09：回风超温（FasU < 35℃ 同时满足 21~24）
+	"FasU1": 300, "FasU2": 100, "RasU1": 350, "RasU2": 250,
+	// 10/11：滤网压差；12~20：风机过流
+	"CfbkEfU11": true, "CfbkEfU21": true, "PresdiffU1": 3500, "PresdiffU2": 3500,
+	"IEfU11": 20, "IEfU12": 20, "IEfU21": 20, "IEfU22": 20,
+	"CfbkCfU11": true, "CfbkCfU21": true, "ICfU11": 30, "ICfU12": 30, "ICfU21": 30, "ICfU22": 30,
+	"CfbkExufan": true, "IExufan": 30,
+	// 25/26：空气质量
+	"AqCo2U1": 5000, "AqPm25U2": 100,
+}
+
+// faultHold 在 faultAll 基础上把阈值类字段回落到 clear 与 trigger 之间。
+var faultHold = merge(faultAll, map[string]any{
+	"FasU1": 170, "RasU1": 290, "RasU2": 220, "PresdiffU1": 2700, "PresdiffU2": 2700,
+	"IEfU11": 16, "ICfU11": 21, "IExufan": 21, "ICpU11": 170, "ICpU12": 160,
+	"AqCo2U1": 4200, "AqPm25U2": 70,
+})
+
+var phases = []phase{
+	{name: "recorded", dur: 10 * time.Minute},
+	{name: "fault_all", dur: 45 * time.Minute, set: faultAll},
+	{name: "hold", dur: 10 * time.Minute, set: faultHold},
+	// 01 的 _c 条件中途恢复，验证 _v 与 _c 的短路顺序
+	{name: "leak_vent", dur: 20 * time.Minute, set: merge(faultAll, map[string]any{"WmodeU1": 1, "HighpressU11": 30})},
+	// 制冷核心故障屏蔽超温前置条件
+	{name: "cooling_fault", dur: 5 * time.Minute, set: merge(faultAll, map[string]any{"BfltVfdU11": true})},
+	{name: "intermittent", dur: 20 * time.Minute, set: faultAll, flip: []string{"SuckpU11", "FCpU21", "CfbkEfU11", "IEfU21", "AqPm25U2"}},
+	{name: "recovered", dur: 10 * time.Minute},
+}
+
+// compareWithLegacy 逐帧驱动两套实现并比较，返回 hold 段最后一帧的命中码集合。
+func compareWithLegacy(t *testing.T, rules *ruleSet, base map[string]any) map[string]bool {
+	t.Helper()
+	const (
+		deviceID   = "7-1"
+		carriageID = 1
+		step       = 30 * time.Second
+	)
+	engine := &NB67EventProcessor{rules: rules}
+	legacy := &NB67EventProcessor{}
+
+	now := time.Date(2026, 10, 18, 8, 0, 0, 0, beijingLoc)
+	seen := map[string]bool{}
+	var held map[string]bool
+	for _, ph := range phases {
+		frames := int(ph.dur / step)
+		for i := 0; i < frames; i++ {
+			raw := merge(base, ph.set)
+			if i%2 == 1 {
+				for _, f := range ph.flip {
+					raw[f] = base[f]
+				}
+			}
+			got := engine.buildPredictHits(raw, carriageID, deviceID, now)
+			want := legacyPredictHits(legacy, raw, carriageID, deviceID, now)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s frame %d: hits differ\n engine: %v\n legacy: %v", ph.name, i, got, want)
+			}
+			if gs, ls := ruleStates(engine), ruleStates(legacy); !maps.Equal(gs, ls) {
+				t.Fatalf("%s frame %d: states differ\n engine: %v\n legacy: %v", ph.name, i, gs, ls)
+			}
+			for _, h := range got {
+				seen[h.Code] = true
+			}
+			if ph.name == "hold" && i == frames-1 {
+				held = map[string]bool{}
+				for _, h := range got {
+					held[h.Code] = true
+				}
+			}
+			now = now.Add(step)
+		}
+	}
+	for seq := 1; seq <= 26; seq++ {
+		if code := hvacCode(carriageID*100, seq); !seen[code] {
+			t.Errorf("%s never fired, scenario does not cover it", code)
+		}
+	}
+	return held
+}
+
+// ruleStates 返回计时器 key 与已触发标记。
+func ruleStates(p *NB67EventProcessor) map[string]bool {
+	out := map[string]bool{}
+	p.states.Range(func(k, v any) bool {
+		out[k.(string)] = v.(*ruleState).fired.Load()
+		return true
+	})
+	return out
+}
+
+// recordedRaw 按 nb67_parser 的输出方式（raw 对象经 JSON 往返）解码录制帧。
+func recordedRaw(t *testing.T) map[string]any {
+	t.Helper()
+	payload, err := os.ReadFile(recordedFrame)
+	if err != nil {
+		t.Fatalf("read recorded frame: %v", err)
+	}
+	nb67, _, err := decodeNb67V1(payload)
+	if err != nil {
+		t.Fatalf("decode recorded frame: %v", err)
+	}
+	b, err := json.Marshal(nb67)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// installConfig 临时替换全局 ConfigStore，测试结束后恢复。
+func installConfig(t *testing.T, m configMap) {
+	t.Helper()
+	prev := globalConfigStore
+	cs := &ConfigStore{}
+	cs.val.Store(&m)
+	globalConfigStore = cs
+	t.Cleanup(func() { globalConfigStore = prev })
+}
+
+// merge 返回 base 的副本并覆盖 set 中的字段；数值统一为 float64，与 JSON 解码结果一致。
+func merge(base, set map[string]any) map[string]any {
+	out := maps.Clone(base)
+	for k, v := range set {
+		switch v := v.(type) {
+		case int:
+			out[k] = float64(v)
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// legacyPredictHits 为规则引擎上线前 buildPredictHits 的实现。
+func legacyPredictHits(p *NB67EventProcessor, raw map[string]any, carriageID int, deviceID string, currentTime time.Time) []PredictHit {
+	hits := make([]PredictHit, 0)
+	if len(raw) == 0 {
+		return hits
+	}
+	base := carriageID * 100
+
+	wModeU1 := rawInt(raw, "WmodeU1")
+	wModeU2 := rawInt(raw, "WmodeU2")
+
+	checkRefLeak := func(mode int64, hvacSeq int, name string) {
+		code := hvacCode(base, hvacSeq)
+		uIdx := (hvacSeq + 1) / 2
+		sIdx := (hvacSeq+1)%2 + 1
+		fcp := rawInt(raw, fmt.Sprintf("FCpU%d%d", uIdx, sIdx))
+		suckp := rawInt(raw, fmt.Sprintf("SuckpU%d%d", uIdx, sIdx))
+		highp := rawInt(raw, fmt.Sprintf("HighpressU%d%d", uIdx, sIdx))
+
+		isCoolingLeak := (mode == 2 || mode == 3) && fcp > 300 && suckp < 20
+		if p.checkRule(isCoolingLeak, 5*time.Minute, deviceID, code+"_c", currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+			return
+		}
+		isVentLeak := mode == 1 && highp < 50
+		if p.checkRule(isVentLeak, 15*time.Minute, deviceID, code+"_v", currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+		}
+	}
+	checkRefLeak(wModeU1, 1, "机组1系统1冷媒泄露预警")
+	checkRefLeak(wModeU1, 2, "机组1系统2冷媒泄露预警")
+	checkRefLeak(wModeU2, 3, "机组2系统1冷媒泄露预警")
+	checkRefLeak(wModeU2, 4, "机组2系统2冷媒泄露预警")
+
+	checkCpSys := func(uIdx int, name string) {
+		code := hvacCode(base, uIdx+4)
+		f1 := rawInt(raw, fmt.Sprintf("FCpU%d1", uIdx))
+		f2 := rawInt(raw, fmt.Sprintf("FCpU%d2", uIdx))
+		i1 := rawInt(raw, fmt.Sprintf("ICpU%d1", uIdx))
+		i2 := rawInt(raw, fmt.Sprintf("ICpU%d2", uIdx))
+		sp1 := rawInt(raw, fmt.Sprintf("SpU%d1", uIdx))
+		sp2 := rawInt(raw, fmt.Sprintf("SpU%d2", uIdx))
+
+		isCurrentDiff := f1 == f2 && f1 > 0 && (i1-i2 > 20 || i1-i2 < -20)
+		if p.checkRule(isCurrentDiff, 3*time.Minute, deviceID, code+"_i", currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+			return
+		}
+		isRunning := f1 > 0 || f2 > 0
+		hasBeenRunning := p.checkRule(isRunning, 5*time.Minute, deviceID, code+"_run", currentTime)
+		isSpErr := hasBeenRunning && (sp1 > 200 || sp1 < -80 || sp2 > 200 || sp2 < -80)
+		if p.checkRule(isSpErr, 10*time.Minute, deviceID, code+"_sp", currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+		}
+	}
+	checkCpSys(1, "机组1制冷系统预警")
+	checkCpSys(2, "机组2制冷系统预警")
+
+	tempThresh := csThreshold("WARN_TEMP_SENSOR", 80)
+	tempDur := csDuration("WARN_TEMP_SENSOR", 5*time.Minute)
+	absDiff := func(a, b int64) int64 {
+		if a > b {
+			return a - b
+		}
+		return b - a
+	}
+	fasCondition := tempThresh.Exceeds(absDiff(rawInt(raw, "FasU1"), rawInt(raw, "FasU2")), p.latched(deviceID, hvacCode(base, 7)))
+	if p.checkRule(fasCondition, tempDur, deviceID, hvacCode(base, 7), currentTime) {
+		hits = append(hits, PredictHit{Code: hvacCode(base, 7), Name: "新风温度传感器预警", Severity: 3})
+	}
+	rasCondition := tempThresh.Exceeds(absDiff(rawInt(raw, "RasU1"), rawInt(raw, "RasU2")), p.latched(deviceID, hvacCode(base, 8)))
+	if p.checkRule(rasCondition, tempDur, deviceID, hvacCode(base, 8), currentTime) {
+		hits = append(hits, PredictHit{Code: hvacCode(base, 8), Name: "回风温度传感器预警", Severity: 3})
+	}
+
+	coolingSystemFaulty :=
+		rawBool(raw, "BfltPowersupplyU1") || rawBool(raw, "BfltPowersupplyU2") ||
+			rawBool(raw, "BfltTempover") ||
+			rawBool(raw, "BlpfltCompU11") || rawBool(raw, "BlpfltCompU12") ||
+			rawBool(raw, "BlpfltCompU21") || rawBool(raw, "BlpfltCompU22") ||
+			rawBool(raw, "BscfltCompU11") || rawBool(raw, "BscfltCompU12") ||
+			rawBool(raw, "BscfltCompU21") || rawBool(raw, "BscfltCompU22") ||
+			rawBool(raw, "BfltHighpresU11") || rawBool(raw, "BfltHighpresU12") ||
+			rawBool(raw, "BfltHighpresU21") || rawBool(raw, "BfltHighpresU22") ||
+			rawBool(raw, "BfltLowpresU11") || rawBool(raw, "BfltLowpresU12") ||
+			rawBool(raw, "BfltLowpresU21") || rawBool(raw, "BfltLowpresU22") ||
+			rawBool(raw, "BfltVfdU11") || rawBool(raw, "BfltVfdU12") ||
+			rawBool(raw, "BfltVfdU21") || rawBool(raw, "BfltVfdU22")
+	overtempThresh := csOvertempThreshold("WARN_CABIN_OVERHEAT", 300)
+	overtempDur := csDuration("WARN_CABIN_OVERHEAT", 2*time.Minute)
+	coolingPrecondDur := csCoolingPreconditionDur("WARN_CABIN_OVERHEAT", 20*time.Minute)
+	coolingNormal := !coolingSystemFaulty && (wModeU1 == 2 || wModeU1 == 3 || wModeU2 == 2 || wModeU2 == 3)
+	sysRunningLong := p.checkRule(coolingNormal, coolingPrecondDur, deviceID, "cooling_normal_20", currentTime)
+	overtempLatched := p.latched(deviceID, hvacCode(base, 9))
+	isOvertemp := sysRunningLong && (overtempThresh.Exceeds(rawInt(raw, "RasU1"), overtempLatched) ||
+		overtempThresh.Exceeds(rawInt(raw, "RasU2"), overtempLatched))
+	if p.checkRule(isOvertemp, overtempDur, deviceID, hvacCode(base, 9), currentTime) {
+		hits = append(hits, PredictHit{Code: hvacCode(base, 9), Name: "车厢温度超温预警", Severity: 3})
+	}
+
+	filterThresh := csThreshold("WARN_FILTER_CLOG", 3000)
+	filterDur := csDuration("WARN_FILTER_CLOG", 30*time.Minute)
+	checkFilter := func(cfbkField, presField string, seq int, name string) {
+		code := hvacCode(base, seq)
+		pres := rawInt(raw, presField)
+		isClog := rawBool(raw, cfbkField) && filterThresh.Exceeds(pres, p.latched(deviceID, code)) && pres < 32767
+		if p.checkRule(isClog, filterDur, deviceID, code, currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 2})
+		}
+	}
+	checkFilter("CfbkEfU11", "PresdiffU1", 10, "机组1滤网脏堵预警")
+	checkFilter("CfbkEfU21", "PresdiffU2", 11, "机组2滤网脏堵预警")
+
+	efThresh := csThreshold("WARN_EF_CURRENT", 18)
+	cfThresh := csThreshold("WARN_CF_CURRENT", 23)
+	exufThresh := csThreshold("WARN_EXUF_CURRENT", 23)
+	fanDur := csDuration("WARN_EF_CURRENT", 10*time.Minute)
+
+	checkFanI := func(cfbkField, iField string, th threshold, seq int, name string) {
+		code := hvacCode(base, seq)
+		isOverI := rawBool(raw, cfbkField) && th.Exceeds(rawInt(raw, iField), p.latched(deviceID, code))
+		if p.checkRule(isOverI, fanDur, deviceID, code, currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+		}
+	}
+	checkFanI("CfbkEfU11", "IEfU11", efThresh, 12, "机组1通风机1电流预警")
+	checkFanI("CfbkEfU11", "IEfU12", efThresh, 13, "机组1通风机2电流预警")
+	checkFanI("CfbkEfU21", "IEfU21", efThresh, 14, "机组2通风机1电流预警")
+	checkFanI("CfbkEfU21", "IEfU22", efThresh, 15, "机组2通风机2电流预警")
+	checkFanI("CfbkCfU11", "ICfU11", cfThresh, 16, "机组1冷凝风机1电流预警")
+	checkFanI("CfbkCfU11", "ICfU12", cfThresh, 17, "机组1冷凝风机2电流预警")
+	checkFanI("CfbkCfU21", "ICfU21", cfThresh, 18, "机组2冷凝风机1电流预警")
+	checkFanI("CfbkCfU21", "ICfU22", cfThresh, 19, "机组2冷凝风机2电流预警")
+	checkFanI("CfbkExufan", "IExufan", exufThresh, 20, "废排风机电流预警")
+
+	cpThresh := csThreshold("WARN_CP_CURRENT", 180)
+	cpDur := csDuration("WARN_CP_CURRENT", 10*time.Minute)
+
+	checkCpI := func(fasField, iField string, seq int, name string) {
+		code := hvacCode(base, seq)
+		isOverI := rawInt(raw, fasField) < 350 && cpThresh.Exceeds(rawInt(raw, iField), p.latched(deviceID, code))
+		if p.checkRule(isOverI, cpDur, deviceID, code, currentTime) {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+		}
+	}
+	checkCpI("FasU1", "ICpU11", 21, "机组1压缩机1电流预警")
+	checkCpI("FasU1", "ICpU12", 22, "机组1压缩机2电流预警")
+	checkCpI("FasU2", "ICpU21", 23, "机组2压缩机1电流预警")
+	checkCpI("FasU2", "ICpU22", 24, "机组2压缩机2电流预警")
+
+	co2Thresh := csThreshold("WARN_AQ_CO2", 4500)
+	co2Dur := csDuration("WARN_AQ_CO2", 15*time.Minute)
+	pm25Thresh := csThreshold("WARN_AQ_PM25", 75)
+	pm10Thresh := csThreshold("WARN_AQ_PM10", 150)
+	tvocThresh := csThreshold("WARN_AQ_TVOC", 600)
+	pmDur := csDuration("WARN_AQ_PM25", 20*time.Minute)
+
+	checkAQ := func(uIdx int, name string) {
+		code := hvacCode(base, uIdx+24)
+		fanRunning := rawBool(raw, fmt.Sprintf("CfbkEfU%d1", uIdx))
+		hasBeenRunning := p.checkRule(fanRunning, 20*time.Minute, deviceID, code+"_fanrun", currentTime)
+
+		co2Err := hasBeenRunning && co2Thresh.Exceeds(rawInt(raw, fmt.Sprintf("AqCo2U%d", uIdx)), p.latched(deviceID, code+"_co2"))
+		co2Hit := p.checkRule(co2Err, co2Dur, deviceID, code+"_co2", currentTime)
+
+		pmLatched := p.latched(deviceID, code+"_pmtvoc")
+		pmTvocErr := hasBeenRunning && (pm25Thresh.Exceeds(rawInt(raw, fmt.Sprintf("AqPm25U%d", uIdx)), pmLatched) ||
+			pm10Thresh.Exceeds(rawInt(raw, fmt.Sprintf("AqPm10U%d", uIdx)), pmLatched) ||
+			tvocThresh.Exceeds(rawInt(raw, fmt.Sprintf("AqTvocU%d", uIdx)), pmLatched))
+		pmTvocHit := p.checkRule(pmTvocErr, pmDur, deviceID, code+"_pmtvoc", currentTime)
+
+		if co2Hit || pmTvocHit {
+			hits = append(hits, PredictHit{Code: code, Name: name, Severity: 3})
+		}
+	}
+	checkAQ(1, "机组1空气质量预警")
+	checkAQ(2, "机组2空气质量预警")
+
+	return hits
+}
@@ -0,0 +1,315 @@
+package main
+
+// rule_state_store.go
+//
+// 规则计时器（ruleState）持久化：让 5/10/15/20/30 分钟持续时间门控跨重启延续。
+//
+// 设计约定：
+//   - 运行时仍以 NB67EventProcessor.states（sync.Map）为准，持久化只做定期 checkpoint
+//   - checkRule 新建/删除计时器时登记到 pending，checkpoint 时增量写入后端
+//   - 启动时从后端恢复全部计时器；Close 时做最后一次 checkpoint
+//   - 后端不可用时降级为纯内存运行（与 ConfigStore 一致，不影响告警主流程）
+//
+// 后端：
+//   - file：本地 JSON 快照文件，写临时文件后 rename，保证原子替换
+//   - postgres：hvac.rule_state 表，按 state_key 增量 upsert/delete。
+//     单写者：checkpoint 只依据本实例内存中的计时器增删，多个实例写同一张表会互相覆盖、
+//     删除对方的计时器，因此启动时取 advisory lock，取不到的实例降级为纯内存运行
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// persistedRuleState 是计时器的持久化表示。
+type persistedRuleState struct {
+	FirstSeen time.Time `json:"first_seen"`
+	Value     int64     `json:"value,omitempty"` // 计数器基线（见 part_replacement.go），计时器为 0
+	Fired     bool      `json:"fired,omitempty"` // 规则已触发，恢复后继续按消除值判定
+}
+
+// ruleStateStore 是计时器持久化后端。
+type ruleStateStore interface {
+	// Load 返回全部已持久化的计时器，key 与 NB67EventProcessor.states 相同。
+	Load(ctx context.Context) (map[string]persistedRuleState, error)
+	// Checkpoint 增量写入：upserts 中的 key 覆盖写入，deletes 中的 key 删除。
+	Checkpoint(ctx context.Context, upserts map[string]persistedRuleState, deletes []string) error
+	Close() error
+}
+
+// newRuleStateStore 按 backend 名称构造后端，"none" 或空串返回 nil（纯内存）。
+func newRuleStateStore(backend, path string) (ruleStateStore, error) {
+	switch backend {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return newFileRuleStateStore(path)
+	case "postgres":
+		dsn := os.Getenv("PG_DSN")
+		if dsn == "" {
+			return nil, errors.New("PG_DSN 未设置")
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		store, err := lockPgRuleStateStore(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("未知的 state_backend: %q", backend)
+}
+
+// ============================================================
+// file 后端
+// ============================================================
+
+type fileRuleStateStore struct {
+	path   string
+	mu     sync.Mutex
+	states map[string]persistedRuleState
+}
+
+func newFileRuleStateStore(path string) (*fileRuleStateStore, error) {
+	if path == "" {
+		return nil, errors.New("state_path 未配置")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return &fileRuleStateStore{path: path, states: make(map[string]persistedRuleState)}, nil
+}
+
+func (s *fileRuleStateStore) Load(ctx context.Context) (map[string]persistedRuleState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]persistedRuleState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]persistedRuleState)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", s.path, err)
+	}
+	s.states = loaded
+
+	out := make(map[string]persistedRuleState, len(loaded))
+	for k, v := range loaded {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *fileRuleStateStore) Checkpoint(ctx context.Context, upserts map[string]persistedRuleState, deletes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range upserts {
+		s.states[k] = v
+	}
+	for _, k := range deletes {
+		delete(s.states, k)
+	}
+
+	data, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileRuleStateStore) Close() error { return nil }
+
+// ============================================================
+// postgres 后端（表结构见 06-migration-20261018.sql，counter_value 见 09-migration-20261018.sql）
+// ============================================================
+
+// ruleStateLockKey 为 hvac.rule_state 单写者的 advisory lock 键。
+const ruleStateLockKey = 670003
+
+type pgRuleStateStore struct {
+	db   *sql.DB
+	lock *sql.Conn // 持有 advisory lock 的会话，Close 时释放
+}
+
+// lockPgRuleStateStore 在独占连接上取会话级 advisory lock，已被其他实例持有时返回错误。
+func lockPgRuleStateStore(db *sql.DB) (*pgRuleStateStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, ruleStateLockKey).Scan(&locked); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !locked {
+		_ = conn.Close()
+		return nil, errors.New("hvac.rule_state 已由另一个 event-builder 实例写入（单写者）")
+	}
+	return &pgRuleStateStore{db: db, lock: conn}, nil
+}
+
+func (s *pgRuleStateStore) Load(ctx context.Context) (map[string]persistedRuleState, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT state_key, first_seen, COALESCE(counter_value, 0), fired FROM hvac.rule_state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]persistedRuleState)
+	for rows.Next() {
+		var key string
+		var st persistedRuleState
+		if err := rows.Scan(&key, &st.FirstSeen, &st.Value, &st.Fired); err != nil {
+			return nil, err
+		}
+		out[key] = st
+	}
+	return out, rows.Err()
+}
+
+func (s *pgRuleStateStore) Checkpoint(ctx context.Context, upserts map[string]persistedRuleState, deletes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for k, v := range upserts {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO hvac.rule_state (state_key, first_seen, counter_value, fired, updated_at)
+			 VALUES ($1, $2, NULLIF($3::BIGINT, 0), $4, NOW())
+			 ON CONFLICT (state_key) DO UPDATE
+			 SET first_seen = EXCLUDED.first_seen, counter_value = EXCLUDED.counter_value,
+			     fired = EXCLUDED.fired, updated_at = NOW()`,
+			k, v.FirstSeen, v.Value, v.Fired); err != nil {
+			return err
+		}
+	}
+	for _, k := range deletes {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM hvac.rule_state WHERE state_key = $1`, k); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *pgRuleStateStore) Close() error {
+	_, _ = s.lock.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, ruleStateLockKey)
+	_ = s.lock.Close()
+	return s.db.Close()
+}
+
+// ============================================================
+// 处理器侧：pending 登记、恢复与 checkpoint 循环
+// ============================================================
+
+// markStateDirty 登记一次计时器变更，st 为 nil 表示删除。未启用持久化时不做任何事。
+func (p *NB67EventProcessor) markStateDirty(key string, st *ruleState) {
+	if p.stateStore == nil {
+		return
+	}
+	p.pendingMu.Lock()
+	p.pending[key] = st
+	p.pendingMu.Unlock()
+}
+
+// restoreStates 从后端恢复计时器，在处理第一条消息前调用。
+func (p *NB67EventProcessor) restoreStates(ctx context.Context) error {
+	loaded, err := p.stateStore.Load(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	timers, counters := 0, 0
+	for k, v := range loaded {
+		// 部件计数器基线（见 part_replacement.go）
+		if isCounterKey(k) {
+			p.counters.Store(k, counterState{value: v.Value, savedAt: now})
+			counters++
+			continue
+		}
+		// 设备最后消息时间：到达时间记为恢复时刻，stale_ttl 内无新帧则由 sweeper 清理
+		if deviceID, ok := splitDeviceSeenKey(k); ok {
+			p.devices.Store(deviceID, deviceSeen{msgTime: v.FirstSeen, wallTime: now})
+			continue
+		}
+		st := &ruleState{firstSeen: v.FirstSeen}
+		st.fired.Store(v.Fired)
+		p.states.Store(k, st)
+		timers++
+	}
+	p.logger.Infof("RuleState: 已恢复 %d 个规则计时器、%d 个部件计数器基线", timers, counters)
+	return nil
+}
+
+// checkpointStates 将 pending 中的变更写入后端；失败时变更放回 pending 等待下次重试。
+func (p *NB67EventProcessor) checkpointStates(ctx context.Context) error {
+	p.pendingMu.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*ruleState)
+	p.pendingMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	upserts := make(map[string]persistedRuleState)
+	var deletes []string
+	for k, st := range pending {
+		if st == nil {
+			deletes = append(deletes, k)
+		} else {
+			upserts[k] = persistedRuleState{FirstSeen: st.firstSeen, Value: st.value, Fired: st.fired.Load()}
+		}
+	}
+	if err := p.stateStore.Checkpoint(ctx, upserts, deletes); err != nil {
+		p.pendingMu.Lock()
+		for k, st := range pending {
+			// 期间产生的更新更晚，不能被旧值覆盖
+			if _, newer := p.pending[k]; !newer {
+				p.pending[k] = st
+			}
+		}
+		p.pendingMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// runCheckpointLoop 按 interval 周期 checkpoint，直到 done 关闭。
+func (p *NB67EventProcessor) runCheckpointLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.checkpointStates(context.Background()); err != nil {
+				p.logger.Warnf("RuleState: checkpoint 失败，下次重试: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
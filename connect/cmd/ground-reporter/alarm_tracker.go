@@ -3,28 +3,93 @@ package main
 import (
 	"crypto/rand"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
 type activeAlarm struct {
-	UUID      string
-	StartTime int64 // unix ms at first detection
+	UUID      string `json:"uuid"`
+	StartTime int64  `json:"start_time"` // unix ms at first detection
+}
+
+// trackedDevice holds the active alarms of one device key plus what is needed
+// to build end records without a fresh message (see Expire).
+type trackedDevice struct {
+	alarms    map[string]*activeAlarm // code → alarm
+	meta      EventMeta               // latest event meta seen for this device
+	lastSeen  int64                   // unix ms of the latest Diff call
+	lastEvent string                  // event_time_text of the latest applied message
+	restored  bool                    // loaded from disk, not yet reconciled with a fresh message
 }
 
 // AlarmTracker maintains the lifecycle state for 6.1 alarm/predict records.
 // For each device, it tracks which hit codes are currently active.
 // When a code appears for the first time → fire "start" (endtime empty).
 // When a code disappears → fire "end" (endtime = now).
+// An empty hit set (the event builder's "clear" transition) ends every active code.
+//
+// State is persisted to path so a restart keeps UUIDs and start times: a restored
+// device is reconciled against its first fresh message, which ends the codes that
+// cleared during the downtime and keeps the ones still active without re-announcing.
 type AlarmTracker struct {
 	mu     sync.Mutex
-	active map[string]map[string]*activeAlarm // deviceID → code → alarm
+	active map[string]*trackedDevice // deviceKey → state
+	path   string                    // state file
+	dirty  bool                      // lastSeen/meta changed since the last save
+}
+
+// trackerSnapshot is the on-disk form of AlarmTracker.
+type trackerSnapshot struct {
+	SavedAt int64                     `json:"saved_at"`
+	Devices map[string]deviceSnapshot `json:"devices"`
+}
+
+type deviceSnapshot struct {
+	Meta      EventMeta               `json:"meta"`
+	LastSeen  int64                   `json:"last_seen"`
+	LastEvent string                  `json:"last_event"`
+	Alarms    map[string]*activeAlarm `json:"alarms"`
 }
 
-func newAlarmTracker() *AlarmTracker {
-	return &AlarmTracker{
-		active: make(map[string]map[string]*activeAlarm),
+// newAlarmTracker creates a tracker backed by the state file at path and restores
+// the alarms still open when the previous process stopped.
+func newAlarmTracker(path string) *AlarmTracker {
+	t := &AlarmTracker{
+		active: make(map[string]*trackedDevice),
+		path:   path,
+	}
+
+	var snap trackerSnapshot
+	found, err := loadJSONFile(path, &snap)
+	if err != nil {
+		log.Printf("[WARN] alarm tracker: load %s failed, starting empty: %v", path, err)
+		return t
+	}
+	if !found {
+		return t
+	}
+
+	// Restored devices get a full stale window from now before Expire may close
+	// them, so each one has the chance to reconcile against a fresh message first.
+	ts := nowMs()
+	open := 0
+	for key, d := range snap.Devices {
+		if len(d.Alarms) == 0 {
+			continue
+		}
+		t.active[key] = &trackedDevice{
+			alarms:    d.Alarms,
+			meta:      d.Meta,
+			lastSeen:  ts,
+			lastEvent: d.LastEvent,
+			restored:  true,
+		}
+		open += len(d.Alarms)
 	}
+	log.Printf("[INFO] alarm tracker: restored %d open record(s) of %d device(s) from %s",
+		open, len(t.active), path)
+	return t
 }
 
 type AlarmDiff struct {
@@ -43,15 +108,34 @@ type ActiveHit struct {
 // Diff computes which hit codes are new vs. which have ended for the given device.
 // currentCodes is the full set of hit codes present in the current message.
 // The caller provides nowMs as the reference time so the tracker is deterministic.
-func (t *AlarmTracker) Diff(deviceID string, currentCodes []HitCode, nowMs int64) AlarmDiff {
+//
+// For a device restored from disk, messages older than the last one applied before
+// the restart (Kafka redelivery of uncommitted offsets) are ignored; the first
+// message at or after it reconciles the restored state.
+func (t *AlarmTracker) Diff(deviceKey string, meta EventMeta, currentCodes []HitCode, nowMs int64) AlarmDiff {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	existing, ok := t.active[deviceID]
+	dev, ok := t.active[deviceKey]
 	if !ok {
-		existing = make(map[string]*activeAlarm)
-		t.active[deviceID] = existing
+		dev = &trackedDevice{alarms: make(map[string]*activeAlarm)}
+		t.active[deviceKey] = dev
 	}
+	if dev.restored {
+		// event_time_text is "2006-01-02 15:04:05", so string order is time order.
+		if meta.EventTimeText != "" && meta.EventTimeText < dev.lastEvent {
+			return AlarmDiff{}
+		}
+		dev.restored = false
+		log.Printf("[INFO] alarm tracker: %s reconciled at %s (%d record(s) open before restart)",
+			deviceKey, meta.EventTimeText, len(dev.alarms))
+	}
+	dev.meta = meta
+	dev.lastSeen = nowMs
+	if meta.EventTimeText > dev.lastEvent {
+		dev.lastEvent = meta.EventTimeText
+	}
+	existing := dev.alarms
 
 	currSet := make(map[string]HitCode, len(currentCodes))
 	for _, h := range currentCodes {
@@ -88,9 +172,110 @@ func (t *AlarmTracker) Diff(deviceID string, currentCodes []HitCode, nowMs int64
 		}
 	}
 
+	if len(existing) == 0 {
+		delete(t.active, deviceKey)
+	}
+	if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+		t.saveLocked(nowMs)
+	} else {
+		t.dirty = true
+	}
 	return diff
 }
 
+// Undo reverts a diff whose records could not be queued, so the same change is
+// detected again when the message is retried (or on the next Expire tick).
+// lastSeen is restored as given.
+func (t *AlarmTracker) Undo(deviceKey string, meta EventMeta, lastSeen int64, diff AlarmDiff) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dev, ok := t.active[deviceKey]
+	if !ok {
+		dev = &trackedDevice{alarms: make(map[string]*activeAlarm)}
+		t.active[deviceKey] = dev
+	}
+	dev.meta = meta
+	dev.lastSeen = lastSeen
+	for _, hit := range diff.Added {
+		delete(dev.alarms, hit.Code)
+	}
+	for _, hit := range diff.Removed {
+		dev.alarms[hit.Code] = &activeAlarm{UUID: hit.UUID, StartTime: hit.StartTime}
+	}
+	if len(dev.alarms) == 0 {
+		delete(t.active, deviceKey)
+	}
+	t.saveLocked(nowMs())
+}
+
+// ExpiredDevice lists the alarms ended by Expire for one device key.
+type ExpiredDevice struct {
+	DeviceKey string
+	Meta      EventMeta
+	Removed   []ActiveHit
+}
+
+// Expire ends every active alarm of devices that have sent nothing since cutoffMs
+// (train powered off or left the network), so no start record stays open forever.
+func (t *AlarmTracker) Expire(cutoffMs, nowMs int64) []ExpiredDevice {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []ExpiredDevice
+	for key, dev := range t.active {
+		if dev.lastSeen >= cutoffMs {
+			continue
+		}
+		exp := ExpiredDevice{DeviceKey: key, Meta: dev.meta}
+		for code, alarm := range dev.alarms {
+			exp.Removed = append(exp.Removed, ActiveHit{
+				UUID:      alarm.UUID,
+				Code:      code,
+				StartTime: alarm.StartTime,
+				EndTime:   nowMs,
+			})
+		}
+		delete(t.active, key)
+		out = append(out, exp)
+	}
+	if len(out) > 0 {
+		t.saveLocked(nowMs)
+	}
+	return out
+}
+
+// Flush saves the tracker if anything changed since the last save.
+func (t *AlarmTracker) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dirty {
+		t.saveLocked(nowMs())
+	}
+}
+
+// saveLocked writes the tracker state to disk. Caller must hold t.mu.
+// Failures are logged only: the in-memory state stays authoritative.
+func (t *AlarmTracker) saveLocked(nowMs int64) {
+	snap := trackerSnapshot{SavedAt: nowMs, Devices: make(map[string]deviceSnapshot, len(t.active))}
+	for key, dev := range t.active {
+		if len(dev.alarms) == 0 {
+			continue
+		}
+		snap.Devices[key] = deviceSnapshot{
+			Meta:      dev.meta,
+			LastSeen:  dev.lastSeen,
+			LastEvent: dev.lastEvent,
+			Alarms:    dev.alarms,
+		}
+	}
+	if err := saveJSONFile(t.path, snap); err != nil {
+		log.Printf("[ERROR] alarm tracker: save %s failed: %v", t.path, err)
+		return
+	}
+	t.dirty = false
+}
+
 // HitCode carries the minimal info needed for diff (code + display name).
 type HitCode struct {
 	Code string
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // carriageNames maps carriage ID (1-6) to the physical coach designation.
@@ -25,88 +28,134 @@ func coachName(carriageID int) string {
 	return strconv.Itoa(carriageID)
 }
 
+// Tracker key prefixes keep alarm and predict state tables separate in the shared tracker.
+const (
+	alarmKeyPrefix   = "alarm:"
+	predictKeyPrefix = "predict:"
+)
+
 // Handle61Alarm processes a signal-alarm message: diffs against active state,
-// then POSTs start/end records to the platform.
-func Handle61Alarm(ctx context.Context, client *PlatformClient, tracker *AlarmTracker, sc *StationCache, cfg Config, data []byte) {
+// then queues start/end records for the platform.
+// Fault bit names are mapped to platform fault codes before diffing, so start and
+// end records carry the same code.
+// An empty hit list (transition "clear") ends every alarm still open for the device.
+func Handle61Alarm(outbox *Outbox, tracker *AlarmTracker, sc *StationCache, cfg Config, data []byte) error {
 	var msg SubEventMsg
 	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("[WARN] 6.1 alarm: bad json: %v", err)
-		return
+		return poison(fmt.Errorf("6.1 alarm: bad json: %w", err))
 	}
 
 	var hits []AlarmHit
-	if err := json.Unmarshal(msg.Hits, &hits); err != nil || len(hits) == 0 {
-		return
-	}
-
-	codes := make([]HitCode, len(hits))
-	for i, h := range hits {
-		codes[i] = HitCode{Code: h.Code, Name: h.Name}
-	}
-
-	ts := nowMs()
-	diff := tracker.Diff(msg.EventMeta.DeviceID, codes, ts)
-	si := sc.Get(msg.EventMeta.DeviceID)
-
-	var records []Record61
-	for _, hit := range diff.Added {
-		records = append(records, buildRecord61(cfg, msg.EventMeta, si, "0", hit.Code, hit.StartTime, 0))
-	}
-	for _, hit := range diff.Removed {
-		records = append(records, buildRecord61(cfg, msg.EventMeta, si, "0", hit.Code, hit.StartTime, hit.EndTime))
+	if err := json.Unmarshal(msg.Hits, &hits); err != nil {
+		return poison(fmt.Errorf("6.1 alarm: bad hits: %w", err))
 	}
 
-	if len(records) == 0 {
-		return
-	}
-	if err := client.PostJSON(ctx, cfg.FaultRecordURL, records); err != nil {
-		log.Printf("[ERROR] 6.1 alarm POST failed: %v", err)
+	// Bits without a platform fault code are left out, as if they had not fired.
+	codes := make([]HitCode, 0, len(hits))
+	for _, h := range hits {
+		if code, ok := faultCodeFor(h.Code, msg.EventMeta.CarriageID); ok {
+			codes = append(codes, HitCode{Code: code, Name: h.Name})
+		}
 	}
+	return apply61(outbox, tracker, sc, cfg, alarmKeyPrefix+msg.EventMeta.DeviceID, msg.EventMeta, "0", codes)
 }
 
 // Handle61Predict processes a signal-predict message the same way as alarm.
-func Handle61Predict(ctx context.Context, client *PlatformClient, tracker *AlarmTracker, sc *StationCache, cfg Config, data []byte) {
+func Handle61Predict(outbox *Outbox, tracker *AlarmTracker, sc *StationCache, cfg Config, data []byte) error {
 	var msg SubEventMsg
 	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("[WARN] 6.1 predict: bad json: %v", err)
-		return
+		return poison(fmt.Errorf("6.1 predict: bad json: %w", err))
 	}
 
 	var hits []PredictHit
-	if err := json.Unmarshal(msg.Hits, &hits); err != nil || len(hits) == 0 {
-		return
+	if err := json.Unmarshal(msg.Hits, &hits); err != nil {
+		return poison(fmt.Errorf("6.1 predict: bad hits: %w", err))
 	}
 
-	// Prefix device key with "predict:" to keep alarm and predict state tables separate.
-	deviceKey := "predict:" + msg.EventMeta.DeviceID
 	codes := make([]HitCode, len(hits))
 	for i, h := range hits {
 		codes[i] = HitCode{Code: h.Code, Name: h.Name}
 	}
+	return apply61(outbox, tracker, sc, cfg, predictKeyPrefix+msg.EventMeta.DeviceID, msg.EventMeta, "1", codes)
+}
 
+// apply61 diffs the current hit codes of a device and queues the resulting records.
+// If they cannot be queued the diff is undone, so a retry of the message sees it again.
+func apply61(outbox *Outbox, tracker *AlarmTracker, sc *StationCache, cfg Config, deviceKey string, meta EventMeta, msgType string, codes []HitCode) error {
 	ts := nowMs()
-	diff := tracker.Diff(deviceKey, codes, ts)
-	si := sc.Get(msg.EventMeta.DeviceID)
+	diff := tracker.Diff(deviceKey, meta, codes, ts)
+	if err := post61(outbox, sc, cfg, meta, msgType, diff); err != nil {
+		tracker.Undo(deviceKey, meta, ts, diff)
+		return err
+	}
+	return nil
+}
+
+// Run61Expiry periodically ends alarms of devices that stopped sending events for
+// cfg.AlarmStaleMin minutes. Disabled when AlarmStaleMin <= 0.
+func Run61Expiry(ctx context.Context, outbox *Outbox, tracker *AlarmTracker, sc *StationCache, cfg Config) {
+	if cfg.AlarmStaleMin <= 0 {
+		return
+	}
+	stale := time.Duration(cfg.AlarmStaleMin) * time.Minute
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ts := nowMs()
+			cutoff := ts - stale.Milliseconds()
+			for _, exp := range tracker.Expire(cutoff, ts) {
+				msgType := "0"
+				if strings.HasPrefix(exp.DeviceKey, predictKeyPrefix) {
+					msgType = "1"
+				}
+				log.Printf("[INFO] 6.1 %s: no events for %v, closing %d open record(s)", exp.DeviceKey, stale, len(exp.Removed))
+				diff := AlarmDiff{Removed: exp.Removed}
+				if err := post61(outbox, sc, cfg, exp.Meta, msgType, diff); err != nil {
+					// Keep them open and stale, so the next tick tries again.
+					log.Printf("[ERROR] %v", err)
+					tracker.Undo(exp.DeviceKey, exp.Meta, cutoff-1, diff)
+				}
+			}
+		}
+	}
+}
+
+// post61 queues the start/end records of one diff for delivery; msgType is "0"=fault "1"=predict.
+func post61(outbox *Outbox, sc *StationCache, cfg Config, meta EventMeta, msgType string, diff AlarmDiff) error {
+	if len(diff.Added) == 0 && len(diff.Removed) == 0 {
+		return nil
+	}
+	si := sc.Get(meta.DeviceID)
 
 	var records []Record61
 	for _, hit := range diff.Added {
-		records = append(records, buildRecord61(cfg, msg.EventMeta, si, "1", hit.Code, hit.StartTime, 0))
+		records = append(records, buildRecord61(cfg, meta, si, msgType, hit.Code, hit.StartTime, 0))
 	}
 	for _, hit := range diff.Removed {
-		records = append(records, buildRecord61(cfg, msg.EventMeta, si, "1", hit.Code, hit.StartTime, hit.EndTime))
+		records = append(records, buildRecord61(cfg, meta, si, msgType, hit.Code, hit.StartTime, hit.EndTime))
 	}
 
-	if len(records) == 0 {
-		return
+	if err := outbox.Enqueue("6.1 "+kind61(msgType), cfg.FaultRecordURL, records); err != nil {
+		return fmt.Errorf("6.1 %s enqueue failed: %w", kind61(msgType), err)
 	}
-	if err := client.PostJSON(ctx, cfg.FaultRecordURL, records); err != nil {
-		log.Printf("[ERROR] 6.1 predict POST failed: %v", err)
+	return nil
+}
+
+func kind61(msgType string) string {
+	if msgType == "1" {
+		return "predict"
 	}
+	return "alarm"
 }
 
 // buildRecord61 constructs a single 6.1 record.
 // endTimeMs == 0 means alarm is still open (endtime = "").
-// location is looked up from the alertcode table by code; code itself is passed through unchanged.
+// location is looked up from the alertcode table by code (HVAC predict code or a fault code from FAULT_CODE_FILE).
 func buildRecord61(cfg Config, meta EventMeta, si StationInfo, msgType, code string, startMs, endMs int64) Record61 {
 	endTime := ""
 	if endMs > 0 {
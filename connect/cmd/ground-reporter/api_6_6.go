@@ -8,33 +8,37 @@ import (
 )
 
 // Run66Heartbeat sends a heartbeat to the platform every HeartbeatIntervalMin minutes.
+// Its status, remark and solution are computed from pipeline health (see Health.Evaluate).
 // Runs until ctx is cancelled.
-func Run66Heartbeat(ctx context.Context, client *PlatformClient, cfg Config) {
+func Run66Heartbeat(ctx context.Context, client *PlatformClient, health *Health, sc *StationCache, cfg Config) {
 	interval := time.Duration(cfg.HeartbeatIntervalMin) * time.Minute
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	// Send one immediately on startup so the platform sees us right away.
-	sendHeartbeat(ctx, client, cfg)
+	sendHeartbeat(ctx, client, health, sc, cfg)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			sendHeartbeat(ctx, client, cfg)
+			sendHeartbeat(ctx, client, health, sc, cfg)
 		}
 	}
 }
 
-func sendHeartbeat(ctx context.Context, client *PlatformClient, cfg Config) {
+func sendHeartbeat(ctx context.Context, client *PlatformClient, health *Health, sc *StationCache, cfg Config) {
+	frames, framesSeen := sc.LastFrames(time.Duration(cfg.FrameExpireHours) * time.Hour)
+	status, remark, solution := health.Evaluate(frames, framesSeen,
+		time.Duration(cfg.FrameStaleMin)*time.Minute, int64(cfg.ConsumerLagWarn))
 	payload := []Status66{
 		{
 			MessageType: "500",
 			Subsystem:   cfg.SubsystemCode,
-			Status:      "1",
-			Remark:      "",
-			Solution:    "",
+			Status:      status,
+			Remark:      remark,
+			Solution:    solution,
 			Time:        strconv.FormatInt(nowMs(), 10),
 		},
 	}
@@ -42,5 +46,9 @@ func sendHeartbeat(ctx context.Context, client *PlatformClient, cfg Config) {
 		log.Printf("[ERROR] 6.6 heartbeat POST failed: %v", err)
 		return
 	}
-	log.Printf("[INFO] 6.6 heartbeat sent")
+	if status == status66OK {
+		log.Printf("[INFO] 6.6 heartbeat sent: status=%s", status)
+	} else {
+		log.Printf("[WARN] 6.6 heartbeat sent: status=%s remark=%s", status, remark)
+	}
 }
@@ -2,92 +2,292 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Handle67LifeAction processes a signal-life message and immediately POSTs
-// each LifeHit as a per-action life record to the platform.
-func Handle67LifeAction(ctx context.Context, client *PlatformClient, cfg Config, data []byte) {
+// Handle67LifeAction processes a signal-life message and queues each LifeHit
+// as a per-action life record for the platform. limitTime is the event
+// builder's forecast: the one on the hit, else the last one from its hourly
+// forecasts, which are also kept in the life cache for the daily batch.
+func Handle67LifeAction(outbox *Outbox, cache *LifeCache, registry *PartRegistry, cfg Config, data []byte) error {
 	var msg SubEventMsg
 	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("[WARN] 6.7 life action: bad json: %v", err)
-		return
+		return poison(fmt.Errorf("6.7 life action: bad json: %w", err))
 	}
 
 	var hits []LifeHit
-	if err := json.Unmarshal(msg.Hits, &hits); err != nil || len(hits) == 0 {
-		return
+	if err := json.Unmarshal(msg.Hits, &hits); err != nil {
+		return poison(fmt.Errorf("6.7 life action: bad hits: %w", err))
+	}
+	deviceID := msg.EventMeta.DeviceID
+	for _, f := range msg.Forecasts {
+		cache.SetForecast(deviceID, f)
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+
+	ts := nowMs()
+	records := make([]LifeRecord67, 0, len(hits))
+	for _, hit := range hits {
+		limitTime := hit.LimitTime
+		if limitTime == 0 {
+			limitTime = cache.LimitTime(deviceID, hit.Code)
+		}
+		records = append(records, newLifeRecord67(registry, cfg, msg.EventMeta.LineID, msg.EventMeta.TrainID,
+			hit.Code, hit.Value, ts, limitTime))
+	}
+
+	if err := outbox.Enqueue("6.7 life action", cfg.LifeRecordURL, records); err != nil {
+		return fmt.Errorf("6.7 life action enqueue failed: %w", err)
+	}
+	return nil
+}
+
+// Handle67Replacement processes a signal-replacement message: the part registry
+// restarts useTime/mileage of each replaced part, and the reset counter value is
+// queued as a 6.7 record so the platform drops the previous part's total.
+func Handle67Replacement(outbox *Outbox, registry *PartRegistry, cfg Config, data []byte) error {
+	var msg SubEventMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return poison(fmt.Errorf("6.7 replacement: bad json: %w", err))
+	}
+
+	var hits []ReplacementHit
+	if err := json.Unmarshal(msg.Hits, &hits); err != nil {
+		return poison(fmt.Errorf("6.7 replacement: bad hits: %w", err))
+	}
+	if len(hits) == 0 {
+		return nil
 	}
 
+	at := eventTime(msg.EventMeta)
+	trainNo := padTrainNo(msg.EventMeta.TrainID)
 	ts := nowMs()
 	records := make([]LifeRecord67, 0, len(hits))
 	for _, hit := range hits {
-		records = append(records, LifeRecord67{
-			LineName:     msg.EventMeta.LineID,
-			TrainType:    cfg.TrainType,
-			TrainNo:      padTrainNo(msg.EventMeta.TrainID),
-			PartCode:     hit.Code,
-			ServiceTime:  ts,
-			ServiceValue: hit.Value,
-			Mileage:      0,
-			UseTime:      0,
-			Flag:         2, // absolute value; platform must not accumulate
-		})
+		log.Printf("[INFO] 6.7 replacement: train=%s part=%s %s %d → %d",
+			trainNo, hit.Code, hit.Field, hit.Previous, hit.Current)
+		registry.Replace(trainNo, hit.Code, at)
+
+		value := hit.Current
+		if hit.Kind != "valve" {
+			value /= 3600 // device reports seconds; platform expects hours
+		}
+		records = append(records, newLifeRecord67(registry, cfg, msg.EventMeta.LineID, msg.EventMeta.TrainID, hit.Code, value, ts, 0))
+	}
+
+	if err := outbox.Enqueue("6.7 replacement", cfg.LifeRecordURL, records); err != nil {
+		return fmt.Errorf("6.7 replacement enqueue failed: %w", err)
+	}
+	return nil
+}
+
+// eventTime parses the device time of an event (Beijing time), falling back to now.
+func eventTime(meta EventMeta) time.Time {
+	if t, err := time.ParseInLocation(time.DateTime, meta.EventTimeText, beijing); err == nil {
+		return t
 	}
+	return time.Now()
+}
+
+// beijing is the time zone of event_time_text.
+var beijing = time.FixedZone("CST", 8*3600)
+
+// newLifeRecord67 builds one 6.7 record; useTime and mileage come from the part registry,
+// limitTime from the event builder's forecast.
+func newLifeRecord67(registry *PartRegistry, cfg Config, lineName, trainID, partCode string, value, ts, limitTime int64) LifeRecord67 {
+	trainNo := padTrainNo(trainID)
+	useTime, mileage := registry.Lookup(trainNo, partCode)
+	return LifeRecord67{
+		LineName:     lineName,
+		TrainType:    cfg.TrainType,
+		TrainNo:      trainNo,
+		PartCode:     partCode,
+		ServiceTime:  ts,
+		ServiceValue: value,
+		Mileage:      mileage,
+		UseTime:      useTime,
+		Flag:         2, // absolute value; platform must not accumulate
+		LimitTime:    limitTime,
+	}
+}
+
+// batchRetryInterval is how often a scheduled batch that could not be queued
+// (empty cache, outbox full) is retried until it succeeds or the next one is due.
+const batchRetryInterval = 5 * time.Minute
+
+// batchState is the persisted record of the last scheduled batch that was queued.
+type batchState struct {
+	LastBatchDate string `json:"last_batch_date"` // "2006-01-02" of the DailyBatchHour occurrence
+}
+
+// DailyBatch sends the 6.7 full snapshot of the life cache once per day at
+// DailyBatchHour. The date of the last successful scheduled batch is persisted,
+// so a batch missed while the process was down runs right after startup.
+type DailyBatch struct {
+	outbox   *Outbox
+	cache    *LifeCache
+	registry *PartRegistry
+	cfg      Config
+	path     string
 
-	if err := client.PostJSON(ctx, cfg.LifeRecordURL, records); err != nil {
-		log.Printf("[ERROR] 6.7 life action POST failed: %v", err)
+	mu       sync.Mutex // serialises scheduled and on-demand sends
+	lastDate string
+}
+
+func newDailyBatch(outbox *Outbox, cache *LifeCache, registry *PartRegistry, cfg Config, path string) *DailyBatch {
+	b := &DailyBatch{outbox: outbox, cache: cache, registry: registry, cfg: cfg, path: path}
+
+	var st batchState
+	found, err := loadJSONFile(path, &st)
+	switch {
+	case err != nil:
+		log.Printf("[WARN] 6.7 daily batch: load %s failed: %v", path, err)
+	case found:
+		b.lastDate = st.LastBatchDate
+		log.Printf("[INFO] 6.7 daily batch: last scheduled batch %s", b.lastDate)
 	}
+	if b.lastDate == "" {
+		// First start: nothing is known to be missed, begin with the next occurrence.
+		b.lastDate = batchDate(prevOccurrence(cfg.DailyBatchHour))
+		b.save()
+	}
+	return b
 }
 
 // Run67DailyBatch fires once per day at DailyBatchHour (default: midnight),
-// snapshots the full life cache, and POSTs all known part values to the platform.
-func Run67DailyBatch(ctx context.Context, client *PlatformClient, cache *LifeCache, cfg Config) {
+// snapshots the full life cache, and queues all known part values for the platform.
+// A due batch that was not queued (missed while down, or failed) runs immediately
+// and is retried every batchRetryInterval. Runs until ctx is cancelled.
+func Run67DailyBatch(ctx context.Context, b *DailyBatch) {
 	for {
-		next := nextOccurrence(cfg.DailyBatchHour)
+		wait := time.Until(nextOccurrence(b.cfg.DailyBatchHour))
+		if due := batchDate(prevOccurrence(b.cfg.DailyBatchHour)); b.behind(due) {
+			log.Printf("[INFO] 6.7 daily batch for %s not sent yet, running now", due)
+			if _, err := b.send(ctx); err != nil {
+				log.Printf("[WARN] 6.7 daily batch for %s: %v – retrying in %v", due, err, batchRetryInterval)
+				wait = min(wait, batchRetryInterval)
+			} else {
+				b.markDone(due)
+			}
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Until(next)):
+		case <-time.After(wait):
+		}
+		// Sleep a bit to avoid firing twice if the system clock jitters at the boundary.
+		if !sleepCtx(ctx, time.Second) {
+			return
 		}
+	}
+}
 
-		sendDailyBatch(ctx, client, cache, cfg)
+func (b *DailyBatch) behind(due string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastDate < due
+}
 
-		// Sleep a bit to avoid firing twice if the system clock jitters at the boundary.
-		time.Sleep(30 * time.Second)
+func (b *DailyBatch) markDone(date string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastDate = date
+	b.save()
+}
+
+// save must be called with mu held (or before the batch is shared).
+func (b *DailyBatch) save() {
+	if err := saveJSONFile(b.path, batchState{LastBatchDate: b.lastDate}); err != nil {
+		log.Printf("[ERROR] 6.7 daily batch: save %s failed: %v", b.path, err)
 	}
 }
 
-func sendDailyBatch(ctx context.Context, client *PlatformClient, cache *LifeCache, cfg Config) {
-	entries := cache.Snapshot()
-	if len(entries) == 0 {
-		log.Printf("[INFO] 6.7 daily batch: cache empty, skipping")
+// ServeHTTP triggers an on-demand batch: POST /batch/6.7 with
+// "Authorization: Bearer <BATCH_TRIGGER_TOKEN>". It does not change the
+// scheduled-batch record, so the next DailyBatchHour batch is sent as usual.
+// main only mounts it when BATCH_TRIGGER_TOKEN is set.
+func (b *DailyBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || b.cfg.BatchTriggerToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(b.cfg.BatchTriggerToken)) != 1 {
+		log.Printf("[WARN] 6.7 on-demand batch: unauthorized request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	n, err := b.send(r.Context())
+	if err != nil {
+		log.Printf("[WARN] 6.7 on-demand batch: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("[INFO] 6.7 on-demand batch queued: %d records", n)
+	fmt.Fprintf(w, "queued %d records\n", n)
+}
+
+// send queues the current life cache snapshot and returns the number of records.
+func (b *DailyBatch) send(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	entries := b.cache.Snapshot()
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("life cache empty")
+	}
 
 	ts := nowMs()
 	records := make([]LifeRecord67, 0, len(entries))
 	for _, e := range entries {
-		records = append(records, LifeRecord67{
-			LineName:     e.LineName,
-			TrainType:    cfg.TrainType,
-			TrainNo:      padTrainNo(e.TrainID),
-			PartCode:     e.PartCode,
-			ServiceTime:  ts,
-			ServiceValue: e.ServiceValue,
-			Mileage:      0,
-			UseTime:      0,
-			Flag:         2,
-		})
-	}
-
-	if err := client.PostJSON(ctx, cfg.LifeRecordURL, records); err != nil {
-		log.Printf("[ERROR] 6.7 daily batch POST failed: %v", err)
+		records = append(records, newLifeRecord67(b.registry, b.cfg, e.LineName, e.TrainID, e.PartCode, e.ServiceValue, ts, e.LimitTime))
+		logForecast(e)
+	}
+
+	if err := b.outbox.Enqueue("6.7 daily batch", b.cfg.LifeRecordURL, records); err != nil {
+		return 0, fmt.Errorf("enqueue failed: %w", err)
+	}
+	log.Printf("[INFO] 6.7 daily batch queued: %d records", len(records))
+	return len(records), nil
+}
+
+// forecastLogHorizon is how far ahead logForecast notes parts reaching their rated life.
+const forecastLogHorizon = 180 * 24 * time.Hour
+
+// logForecast notes parts due to reach their rated life within forecastLogHorizon,
+// for maintenance planning.
+func logForecast(e PartEntry) {
+	if e.LimitTime == 0 || time.Until(time.UnixMilli(e.LimitTime)) > forecastLogHorizon {
 		return
 	}
-	log.Printf("[INFO] 6.7 daily batch sent: %d records", len(records))
+	spec, _ := partSpecByCode(e.PartCode)
+	log.Printf("[INFO] 6.7 forecast: train=%s part=%s (%s) %d/%d, reaches rated life around %s",
+		padTrainNo(e.TrainID), e.PartCode, spec.Name, e.ServiceValue, e.RatedLife,
+		time.UnixMilli(e.LimitTime).In(beijing).Format(time.DateOnly))
+}
+
+func batchDate(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// prevOccurrence returns the most recent wall-clock time (now or earlier) at the given hour.
+func prevOccurrence(hour int) time.Time {
+	return nextOccurrence(hour).AddDate(0, 0, -1)
 }
 
 // nextOccurrence returns the next wall-clock time when the given hour (0-23) occurs.
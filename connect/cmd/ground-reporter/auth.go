@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Platform auth modes (PLATFORM_AUTH_MODE).
+const (
+	authModeAPIKey = "apikey"
+	authModeOAuth2 = "oauth2"
+	authModeHMAC   = "hmac"
+	authModeMTLS   = "mtls"
+)
+
+// platformAuth attaches credentials to a platform request. body is the exact
+// request body, for strategies that sign it.
+type platformAuth interface {
+	Apply(ctx context.Context, req *http.Request, body []byte) error
+}
+
+// tlsAuth is implemented by strategies that authenticate at the TLS layer.
+type tlsAuth interface {
+	TLSConfig() *tls.Config
+}
+
+// tokenInvalidator is implemented by strategies holding a cached credential that
+// the platform may reject before it expires (HTTP 401).
+type tokenInvalidator interface {
+	Invalidate()
+}
+
+// newPlatformAuth builds the auth strategy selected by cfg.PlatformAuthMode.
+func newPlatformAuth(cfg Config) (platformAuth, error) {
+	switch cfg.PlatformAuthMode {
+	case authModeAPIKey:
+		return apiKeyAuth{key: cfg.PlatformApiKey}, nil
+	case authModeOAuth2:
+		if cfg.OAuthTokenURL == "" || cfg.OAuthClientID == "" {
+			return nil, fmt.Errorf("oauth2: PLATFORM_OAUTH_TOKEN_URL and PLATFORM_OAUTH_CLIENT_ID are required")
+		}
+		return &oauth2Auth{
+			tokenURL:     cfg.OAuthTokenURL,
+			clientID:     cfg.OAuthClientID,
+			clientSecret: cfg.OAuthClientSecret,
+			scope:        cfg.OAuthScope,
+			httpClient:   &http.Client{Timeout: time.Duration(cfg.PlatformTimeoutSec) * time.Second},
+		}, nil
+	case authModeHMAC:
+		if cfg.HMACKeyID == "" || cfg.HMACSecret == "" {
+			return nil, fmt.Errorf("hmac: PLATFORM_HMAC_KEY_ID and PLATFORM_HMAC_SECRET are required")
+		}
+		return hmacAuth{keyID: cfg.HMACKeyID, secret: []byte(cfg.HMACSecret)}, nil
+	case authModeMTLS:
+		return newMTLSAuth(cfg.TLSCAFile, cfg.TLSCertFile, cfg.TLSKeyFile)
+	default:
+		return nil, fmt.Errorf("unknown PLATFORM_AUTH_MODE %q (apikey|oauth2|hmac|mtls)", cfg.PlatformAuthMode)
+	}
+}
+
+// apiKeyAuth sends a static X-Api-Key header; an empty key sends nothing.
+type apiKeyAuth struct {
+	key string
+}
+
+func (a apiKeyAuth) Apply(_ context.Context, req *http.Request, _ []byte) error {
+	if a.key != "" {
+		req.Header.Set("X-Api-Key", a.key)
+	}
+	return nil
+}
+
+// oauth2Auth fetches a bearer token with the OAuth2 client-credentials grant
+// (client authenticated by HTTP Basic, RFC 6749 §4.4) and caches it until shortly
+// before expires_in runs out.
+type oauth2Auth struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	httpClient   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// oauth2RefreshMargin renews the token this long before it expires.
+const oauth2RefreshMargin = 30 * time.Second
+
+func (a *oauth2Auth) Apply(ctx context.Context, req *http.Request, _ []byte) error {
+	token, err := a.get(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *oauth2Auth) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = ""
+}
+
+func (a *oauth2Auth) get(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expires) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.scope != "" {
+		form.Set("scope", a.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth2 token: HTTP %d: %s", resp.StatusCode, excerpt(body))
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil || tok.AccessToken == "" {
+		return "", fmt.Errorf("oauth2 token: bad response: %s", excerpt(body))
+	}
+	ttl := time.Duration(tok.ExpiresIn) * time.Second
+	if ttl <= oauth2RefreshMargin {
+		ttl = 2 * oauth2RefreshMargin // no or tiny expires_in: refresh soon, but not on every request
+	}
+	a.token = tok.AccessToken
+	a.expires = time.Now().Add(ttl - oauth2RefreshMargin)
+	return a.token, nil
+}
+
+// hmacAuth signs each request with HMAC-SHA256 over
+//
+//	METHOD \n PATH \n X-Timestamp \n X-Nonce \n X-Content-SHA256
+//
+// and sends the base64 signature in X-Signature alongside X-Key-Id. The timestamp
+// (unix ms) and random nonce let the gateway reject replays.
+type hmacAuth struct {
+	keyID  string
+	secret []byte
+}
+
+func (a hmacAuth) Apply(_ context.Context, req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(nowMs(), 10)
+	n := hex.EncodeToString(nonce)
+	sum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Key-Id", a.keyID)
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Nonce", n)
+	req.Header.Set("X-Content-SHA256", bodyHash)
+	req.Header.Set("X-Signature", hmacSignature(a.secret, req.Method, req.URL.EscapedPath(), ts, n, bodyHash))
+	return nil
+}
+
+// hmacSignature computes the X-Signature value; the mock platform mirrors it.
+func hmacSignature(secret []byte, method, path, ts, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, path, ts, nonce, bodyHash}, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mtlsAuth authenticates with a client certificate; requests carry no extra headers.
+type mtlsAuth struct {
+	tlsConfig *tls.Config
+}
+
+func newMTLSAuth(caFile, certFile, keyFile string) (*mtlsAuth, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("mtls: PLATFORM_TLS_CERT_FILE and PLATFORM_TLS_KEY_FILE are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: load client cert: %w", err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	// Without a CA file the platform certificate is verified against the system roots.
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("mtls: read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mtls: no certificates in %s", caFile)
+		}
+		tc.RootCAs = pool
+	}
+	return &mtlsAuth{tlsConfig: tc}, nil
+}
+
+func (a *mtlsAuth) Apply(context.Context, *http.Request, []byte) error { return nil }
+
+func (a *mtlsAuth) TLSConfig() *tls.Config { return a.tlsConfig }
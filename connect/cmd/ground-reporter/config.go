@@ -13,11 +13,27 @@ type Config struct {
 	LifeRecordURL  string // 6.7 寿命状态数据
 
 	// Common HTTP settings
-	PlatformApiKey         string // X-Api-Key header; empty = no auth
+	PlatformAuthMode       string // apikey | oauth2 | hmac | mtls (see auth.go)
+	PlatformApiKey         string // apikey: X-Api-Key header; empty = no auth
 	PlatformTimeoutSec     int
 	PlatformRetryMax       int
 	PlatformRetryBackoffMs int
 
+	// oauth2: client-credentials grant
+	OAuthTokenURL     string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthScope        string
+
+	// hmac: request signing key
+	HMACKeyID  string
+	HMACSecret string
+
+	// mtls: client certificate; CA file empty = system roots
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+
 	// HVAC subsystem identity
 	SubsystemCode string // fixed "5"
 	TrainType     string // e.g. "B"
@@ -26,33 +42,107 @@ type Config struct {
 	HeartbeatIntervalMin int
 	DailyBatchHour       int // 0-23, default 0 (midnight)
 
+	// 6.6 health: a train with no frames for FrameStaleMin minutes is reported (0 = off);
+	// consumer lag of ConsumerLagWarn messages or more is reported (0 = off);
+	// a train silent for FrameExpireHours is taken out of service and no longer reported (0 = never).
+	// Overnight every train passes FrameStaleMin long before FrameExpireHours; all trains
+	// silent is only degraded (status 3) while signal-parsed has a backlog or fails.
+	FrameStaleMin    int
+	FrameExpireHours int
+	ConsumerLagWarn  int
+
+	// 6.1 fault-bit alarms from signal-alarm (message_type "0"); platform codes per
+	// bit from FaultCodeFile (default ${STATE_DIR}/fault_codes.json, see faultcode_map.go);
+	// not consumed unless that file maps at least one bit
+	AlarmReportEnabled bool
+	FaultCodeFile      string
+
+	// 6.1 records of a device that sends no events for this long are closed; 0 = never
+	AlarmStaleMin int
+
+	// Directory for state that must survive restarts (alarm tracker, outbox)
+	StateDir string
+
+	// 6.7 useTime/mileage: operator-maintained part registry (default ${STATE_DIR}/part_registry.json)
+	// and the signal-parsed raw field carrying the train odometer in km (empty = none)
+	PartRegistryFile string
+	OdometerRawField string
+
+	// Outbox backlog cap in records per platform API lane; 0 = unbounded
+	OutboxMaxRecords int
+
+	// Listen address of the Prometheus /metrics endpoint; empty = disabled
+	MetricsAddr string
+	// Bearer token of POST /batch/6.7 on MetricsAddr; empty = endpoint not served
+	BatchTriggerToken string
+
 	// Kafka
-	KafkaBrokers []string
+	KafkaBrokers       []string
+	KafkaOffsetInitial string            // newest | oldest: where a new consumer group starts
+	ConsumerPolicies   map[string]string // topic → retry | dlq | pause (see consumer.go)
 
 	LogLevel string
 }
 
 func loadConfig() Config {
-	return Config{
+	cfg := Config{
 		FaultRecordURL: getEnv("FAULT_RECORD_URL", "https://clznyw7.nbmetro.com/gate/METRO-PHM/api/faultRecordsSubsystem/saveRecord"),
 		SysStatusURL:   getEnv("SYS_STATUS_URL", "https://clznyw7.nbmetro.com/gate/METRO-SELFCHECK-SUBSYSTEM/api/faultRecordsSubsystem/saveStatus"),
 		LifeRecordURL:  getEnv("LIFE_RECORD_URL", "https://clznyw7.nbmetro.com/gate/METRO-PHM/api/devices/status/train/saveOrUpdate"),
 
+		PlatformAuthMode:       strings.ToLower(getEnv("PLATFORM_AUTH_MODE", authModeAPIKey)),
 		PlatformApiKey:         getEnv("PLATFORM_API_KEY", ""),
 		PlatformTimeoutSec:     getEnvInt("PLATFORM_TIMEOUT_SEC", 10),
 		PlatformRetryMax:       getEnvInt("PLATFORM_RETRY_MAX", 3),
 		PlatformRetryBackoffMs: getEnvInt("PLATFORM_RETRY_BACKOFF_MS", 1000),
 
+		OAuthTokenURL:     getEnv("PLATFORM_OAUTH_TOKEN_URL", ""),
+		OAuthClientID:     getEnv("PLATFORM_OAUTH_CLIENT_ID", ""),
+		OAuthClientSecret: getEnv("PLATFORM_OAUTH_CLIENT_SECRET", ""),
+		OAuthScope:        getEnv("PLATFORM_OAUTH_SCOPE", ""),
+
+		HMACKeyID:  getEnv("PLATFORM_HMAC_KEY_ID", ""),
+		HMACSecret: getEnv("PLATFORM_HMAC_SECRET", ""),
+
+		TLSCAFile:   getEnv("PLATFORM_TLS_CA_FILE", ""),
+		TLSCertFile: getEnv("PLATFORM_TLS_CERT_FILE", ""),
+		TLSKeyFile:  getEnv("PLATFORM_TLS_KEY_FILE", ""),
+
 		SubsystemCode: getEnv("SUBSYSTEM_CODE", "5"),
 		TrainType:     getEnv("TRAIN_TYPE", "B"),
 
 		HeartbeatIntervalMin: getEnvInt("HEARTBEAT_INTERVAL_MIN", 10),
 		DailyBatchHour:       getEnvInt("DAILY_BATCH_HOUR", 0),
 
-		KafkaBrokers: splitCSV(getEnv("KAFKA_BROKERS", "redpanda-1:9092,redpanda-2:9092,redpanda-3:9092")),
+		FrameStaleMin:    getEnvInt("FRAME_STALE_MIN", 60),
+		FrameExpireHours: getEnvInt("FRAME_EXPIRE_HOURS", 12),
+		ConsumerLagWarn:  getEnvInt("CONSUMER_LAG_WARN", 10000),
+
+		AlarmReportEnabled: getEnvBool("ALARM_REPORT_ENABLED", true),
+		AlarmStaleMin:      getEnvInt("ALARM_STALE_MIN", 30),
+		FaultCodeFile:      getEnv("FAULT_CODE_FILE", ""),
+
+		StateDir:          getEnv("STATE_DIR", "/var/lib/ground-reporter"),
+		OutboxMaxRecords:  getEnvInt("OUTBOX_MAX_RECORDS", 100000),
+		MetricsAddr:       getEnv("METRICS_ADDR", ":9102"),
+		BatchTriggerToken: getEnv("BATCH_TRIGGER_TOKEN", ""),
+
+		PartRegistryFile: getEnv("PART_REGISTRY_FILE", ""),
+		OdometerRawField: getEnv("ODOMETER_RAW_FIELD", ""),
+
+		KafkaBrokers:       splitCSV(getEnv("KAFKA_BROKERS", "redpanda-1:9092,redpanda-2:9092,redpanda-3:9092")),
+		KafkaOffsetInitial: strings.ToLower(getEnv("KAFKA_OFFSET_INITIAL", "newest")),
+		ConsumerPolicies:   parsePolicies(getEnv("CONSUMER_ERROR_POLICY", "")),
 
 		LogLevel: getEnv("LOG_LEVEL", "INFO"),
 	}
+	if cfg.FaultCodeFile == "" {
+		cfg.FaultCodeFile = statePath(cfg, "fault_codes.json")
+	}
+	if cfg.PartRegistryFile == "" {
+		cfg.PartRegistryFile = statePath(cfg, "part_registry.json")
+	}
+	return cfg
 }
 
 func splitCSV(s string) []string {
@@ -84,3 +174,15 @@ func getEnvInt(key string, fallback int) int {
 	}
 	return n
 }
+
+func getEnvBool(key string, fallback bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
@@ -2,38 +2,125 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 )
 
+// Error policies applied when a handler fails, before the message is marked.
+const (
+	policyRetry = "retry" // retry the message in place with backoff; the partition waits
+	policyDLQ   = "dlq"   // publish the message to <topic>-dlq and move on
+	policyPause = "pause" // pause fetching the partition and retry at a slow interval
+)
+
+// Retry timing of the retry and pause policies.
+const (
+	retryBackoffMin = time.Second
+	retryBackoffMax = time.Minute
+	pauseInterval   = 30 * time.Second
+)
+
+// dlqSuffix names the dead-letter topic of a source topic, e.g. signal-life-dlq.
+const dlqSuffix = "-dlq"
+
+// MessageHandler processes one Kafka message. The message is only marked once
+// the handler returns nil or its error policy has disposed of it.
+type MessageHandler func([]byte) error
+
+// poisonError marks a message that can never be processed (malformed payload).
+// Retrying it is pointless, so it bypasses retry/pause and goes to the dead-letter
+// topic when the topic's policy is dlq, or is logged and skipped otherwise.
+type poisonError struct {
+	err error
+}
+
+func (e *poisonError) Error() string { return e.err.Error() }
+func (e *poisonError) Unwrap() error { return e.err }
+
+func poison(err error) error {
+	return &poisonError{err: err}
+}
+
+func isPoison(err error) bool {
+	var pe *poisonError
+	return errors.As(err, &pe)
+}
+
+// parsePolicies reads "topic:policy,topic:policy" (CONSUMER_ERROR_POLICY).
+// Unknown policies fall back to retry.
+func parsePolicies(s string) map[string]string {
+	out := make(map[string]string)
+	for _, item := range splitCSV(s) {
+		topic, policy, ok := strings.Cut(item, ":")
+		if !ok {
+			continue
+		}
+		policy = strings.ToLower(strings.TrimSpace(policy))
+		switch policy {
+		case policyRetry, policyDLQ, policyPause:
+		default:
+			log.Printf("[WARN] CONSUMER_ERROR_POLICY: unknown policy %q for %s, using retry", policy, topic)
+			policy = policyRetry
+		}
+		out[strings.TrimSpace(topic)] = policy
+	}
+	return out
+}
+
+// policyFor returns the error policy configured for topic (default retry).
+func (cfg Config) policyFor(topic string) string {
+	if p, ok := cfg.ConsumerPolicies[topic]; ok {
+		return p
+	}
+	return policyRetry
+}
+
+// offsetInitial maps KAFKA_OFFSET_INITIAL to sarama's Offsets.Initial.
+func offsetInitial(s string) int64 {
+	if strings.EqualFold(s, "oldest") {
+		return sarama.OffsetOldest
+	}
+	return sarama.OffsetNewest
+}
+
 // consumeTopic runs a single-topic Kafka consumer group in its own goroutine.
-// handler is called once per message; marking is done after the handler returns.
+// handler is called once per message; the message is marked only after the
+// handler succeeds or the topic's error policy has disposed of it (at-least-once).
 // Reconnects automatically on error until ctx is cancelled.
 func consumeTopic(
 	ctx context.Context,
 	wg *sync.WaitGroup,
-	brokers []string,
+	cfg Config,
+	health *Health,
 	topic string,
 	groupID string,
-	handler func([]byte),
+	handler MessageHandler,
 ) {
 	defer wg.Done()
 
 	kcfg := sarama.NewConfig()
 	kcfg.Version = sarama.V2_6_0_0
 	kcfg.Consumer.Return.Errors = true
-	kcfg.Consumer.Offsets.Initial = sarama.OffsetNewest
+	kcfg.Consumer.Offsets.Initial = offsetInitial(cfg.KafkaOffsetInitial)
 	kcfg.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
 
-	h := &singleTopicHandler{handler: handler}
+	h := &singleTopicHandler{handler: handler, policy: cfg.policyFor(topic), groupID: groupID, health: health}
+	if h.policy == policyDLQ {
+		h.dlqTopic = topic + dlqSuffix
+	}
+	log.Printf("[INFO] consumer %s: topic=%s error-policy=%s offsets.initial=%s", groupID, topic, h.policy, cfg.KafkaOffsetInitial)
 
 	for {
-		group, err := sarama.NewConsumerGroup(brokers, groupID, kcfg)
+		group, err := sarama.NewConsumerGroup(cfg.KafkaBrokers, groupID, kcfg)
 		if err != nil {
 			log.Printf("[ERROR] consumer group %s: create failed: %v – retrying in 5s", groupID, err)
+			health.ConsumerError(groupID, topic, err)
 			select {
 			case <-ctx.Done():
 				return
@@ -41,37 +128,72 @@ func consumeTopic(
 				continue
 			}
 		}
+		h.group = group
+
+		if h.dlqTopic != "" && h.producer == nil {
+			if h.producer, err = sarama.NewSyncProducer(cfg.KafkaBrokers, newProducerConfig()); err != nil {
+				log.Printf("[ERROR] consumer group %s: dead-letter producer: %v – retrying in 5s", groupID, err)
+				_ = group.Close()
+				if !sleepCtx(ctx, 5*time.Second) {
+					return
+				}
+				continue
+			}
+		}
 
 		go func() {
 			for e := range group.Errors() {
 				log.Printf("[WARN] consumer group %s error: %v", groupID, e)
+				health.ConsumerError(groupID, topic, e)
 			}
 		}()
 
 		for {
 			if err := group.Consume(ctx, []string{topic}, h); err != nil {
 				if ctx.Err() != nil {
-					_ = group.Close()
+					h.close(group)
 					return
 				}
 				log.Printf("[ERROR] consumer group %s consume error: %v – retrying in 2s", groupID, err)
+				health.ConsumerError(groupID, topic, err)
 				time.Sleep(2 * time.Second)
 			}
 			if ctx.Err() != nil {
-				_ = group.Close()
+				h.close(group)
 				return
 			}
 		}
 	}
 }
 
+func newProducerConfig() *sarama.Config {
+	pcfg := sarama.NewConfig()
+	pcfg.Version = sarama.V2_6_0_0
+	pcfg.Producer.RequiredAcks = sarama.WaitForAll
+	pcfg.Producer.Return.Successes = true
+	return pcfg
+}
+
 type singleTopicHandler struct {
-	handler func([]byte)
+	handler  MessageHandler
+	groupID  string
+	health   *Health
+	policy   string
+	dlqTopic string // set for the dlq policy
+	group    sarama.ConsumerGroup
+	producer sarama.SyncProducer
 }
 
 func (h *singleTopicHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
 func (h *singleTopicHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
 
+func (h *singleTopicHandler) close(group sarama.ConsumerGroup) {
+	_ = group.Close()
+	if h.producer != nil {
+		_ = h.producer.Close()
+	}
+}
+
 func (h *singleTopicHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for {
 		select {
@@ -81,8 +203,90 @@ func (h *singleTopicHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, clai
 			if !ok {
 				return nil
 			}
-			h.handler(msg.Value)
+			if !h.process(sess.Context(), msg) {
+				return nil // session ended while the message was still unprocessed: leave it unmarked
+			}
 			sess.MarkMessage(msg, "")
+			h.health.ConsumerMessage(h.groupID, msg.Topic, msg.Partition, claim.HighWaterMarkOffset()-msg.Offset-1)
+		}
+	}
+}
+
+// process runs the handler and applies the error policy. It returns true when
+// the message may be marked, false when the session ended first.
+func (h *singleTopicHandler) process(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+	err := h.handler(msg.Value)
+	if err == nil {
+		return true
+	}
+
+	if isPoison(err) || h.policy == policyDLQ {
+		if h.dlqTopic == "" {
+			log.Printf("[WARN] %s[%d]@%d: skipping unprocessable message: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			return true
+		}
+		return h.deadLetter(ctx, msg, err)
+	}
+
+	paused := false
+	backoff := retryBackoffMin
+	for attempt := 1; ; attempt++ {
+		h.health.ConsumerError(h.groupID, msg.Topic, err)
+		wait := backoff
+		if h.policy == policyPause {
+			wait = pauseInterval
+			if !paused {
+				h.group.Pause(map[string][]int32{msg.Topic: {msg.Partition}})
+				paused = true
+				log.Printf("[WARN] %s[%d]@%d: handler failed, partition paused: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			}
+		}
+		log.Printf("[WARN] %s[%d]@%d: attempt %d failed, retrying in %v: %v", msg.Topic, msg.Partition, msg.Offset, attempt, wait, err)
+		if !sleepCtx(ctx, wait) {
+			if paused {
+				h.group.Resume(map[string][]int32{msg.Topic: {msg.Partition}})
+			}
+			return false
+		}
+		if err = h.handler(msg.Value); err == nil {
+			break
+		}
+		if isPoison(err) {
+			log.Printf("[WARN] %s[%d]@%d: skipping unprocessable message: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			break
+		}
+		backoff = min(backoff*2, retryBackoffMax)
+	}
+	if paused {
+		h.group.Resume(map[string][]int32{msg.Topic: {msg.Partition}})
+		log.Printf("[INFO] %s[%d]: partition resumed", msg.Topic, msg.Partition)
+	}
+	return true
+}
+
+// deadLetter publishes msg to the dead-letter topic with the failure reason in
+// headers, retrying until it is stored so the source offset is never marked first.
+func (h *singleTopicHandler) deadLetter(ctx context.Context, msg *sarama.ConsumerMessage, cause error) bool {
+	out := &sarama.ProducerMessage{
+		Topic: h.dlqTopic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("error"), Value: []byte(cause.Error())},
+			{Key: []byte("source_topic"), Value: []byte(msg.Topic)},
+			{Key: []byte("source_partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte("source_offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		},
+	}
+	for {
+		_, _, err := h.producer.SendMessage(out)
+		if err == nil {
+			log.Printf("[WARN] %s[%d]@%d: moved to %s: %v", msg.Topic, msg.Partition, msg.Offset, h.dlqTopic, cause)
+			return true
+		}
+		log.Printf("[ERROR] %s[%d]@%d: publish to %s failed, retrying in 5s: %v", msg.Topic, msg.Partition, msg.Offset, h.dlqTopic, err)
+		if !sleepCtx(ctx, 5*time.Second) {
+			return false
 		}
 	}
 }
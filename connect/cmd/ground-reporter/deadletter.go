@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+var outboxDeadLettered = newCounter("ground_reporter_outbox_dead_lettered_total", "Platform records permanently rejected and written to the dead-letter file.")
+
+// deadLetter is one line of the dead-letter file: a record the platform rejected
+// together with the platform's own explanation.
+type deadLetter struct {
+	Kind       string          `json:"kind"`
+	URL        string          `json:"url"`
+	Body       json.RawMessage `json:"body"`
+	EnqueuedAt int64           `json:"enqueued_at"`
+	RejectedAt int64           `json:"rejected_at"`
+	HTTPStatus int             `json:"http_status"`
+	Code       int             `json:"code"`
+	Message    string          `json:"message"`
+}
+
+// appendDeadLetter appends one rejected record to the JSON-lines file at path.
+func appendDeadLetter(path string, dl deadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
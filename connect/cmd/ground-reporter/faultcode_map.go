@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Platform fault codes for the raw fault bits of signal-alarm (connect-nb67
+// buildAlarmHits). Unlike the predict codes (HVAC{carriage}{seq}, from the
+// warning code table), the project ships no fault code table, so the codes are
+// taken from the platform interface spec and loaded from FAULT_CODE_FILE
+// (default ${STATE_DIR}/fault_codes.json; template: fault_codes.example.json):
+//
+//	{
+//	  "spec": "<spec document, section/table and version the codes come from>",
+//	  "codes": [
+//	    {"bit": "blpflt_comp_u11", "code": "<platform code, {carriage} = carriage id>", "location": "空调机组1"}
+//	  ]
+//	}
+//
+// Bits without a code are not reported (logged once per bit, counted in
+// ground_reporter_alarm_unmapped_bits_total). Without a usable file no bit is
+// mapped, and main does not start the signal-alarm consumer at all.
+
+type faultCodeFile struct {
+	Spec  string         `json:"spec"`
+	Codes []faultCodeDef `json:"codes"`
+}
+
+// faultCodeDef maps one fault bit to its platform code. Location is the 6.1
+// location field, using the same wording as the predict table.
+type faultCodeDef struct {
+	Bit      string `json:"bit"`
+	Code     string `json:"code"`
+	Location string `json:"location"`
+}
+
+// faultCodeByBit indexes the loaded codes by bit name. It is filled by
+// loadFaultCodes at startup, before the consumers run, and only read afterwards.
+var faultCodeByBit = map[string]faultCodeDef{}
+
+// loadFaultCodes reads the fault code file and reports whether any bit got a
+// code. A missing file, or one that does not name its spec, leaves every bit
+// unmapped.
+func loadFaultCodes(path string) bool {
+	var f faultCodeFile
+	found, err := loadJSONFile(path, &f)
+	switch {
+	case err != nil:
+		log.Printf("[ERROR] fault codes: read %s failed: %v", path, err)
+		return false
+	case !found:
+		log.Printf("[WARN] fault codes: %s not found", path)
+		return false
+	case strings.TrimSpace(f.Spec) == "":
+		log.Printf("[ERROR] fault codes: %s has no \"spec\" reference, not loaded", path)
+		return false
+	}
+
+	for _, d := range f.Codes {
+		if d.Bit == "" || d.Code == "" {
+			continue
+		}
+		faultCodeByBit[d.Bit] = d
+		// Register the location of every carriage's code so buildRecord61
+		// resolves fault and predict records through the same locationByCode lookup.
+		for carriageID := range carriageNames {
+			alertcodeLocationMap[d.code(carriageID)] = d.Location
+		}
+	}
+	log.Printf("[INFO] fault codes: %d bits mapped from %s (spec: %s)", len(faultCodeByBit), path, f.Spec)
+	return len(faultCodeByBit) > 0
+}
+
+// code returns the platform fault code of the bit on a carriage.
+func (d faultCodeDef) code(carriageID int) string {
+	return strings.ReplaceAll(d.Code, "{carriage}", strconv.Itoa(carriageID))
+}
+
+var alarmUnmappedBits = newCounter("ground_reporter_alarm_unmapped_bits_total", "signal-alarm fault bit hits not reported because the bit has no platform fault code.")
+
+// unknownFaultBits remembers bits already warned about, so an unmapped bit logs once.
+var unknownFaultBits sync.Map
+
+// faultCodeFor maps a raw fault bit name to the platform fault code of the
+// carriage. ok is false for a bit without a code, which must not be reported.
+func faultCodeFor(bit string, carriageID int) (code string, ok bool) {
+	d, ok := faultCodeByBit[bit]
+	if !ok {
+		alarmUnmappedBits.Add(1)
+		if _, seen := unknownFaultBits.LoadOrStore(bit, struct{}{}); !seen {
+			log.Printf("[WARN] 6.1 alarm: no platform fault code for bit %q, not reported", bit)
+		}
+		return "", false
+	}
+	return d.code(carriageID), true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 6.6 status values.
+const (
+	status66OK       = "1"
+	status66Partial  = "2"
+	status66Degraded = "3"
+)
+
+// frameTopic carries the parsed train frames that feed StationCache.
+const frameTopic = "signal-parsed"
+
+// consumerHealth is what one consumer group reported since the last heartbeat.
+type consumerHealth struct {
+	topic   string
+	lag     map[int32]int64 // partition → messages behind the high-water mark
+	lastMsg time.Time
+	lastErr time.Time
+	errMsg  string
+	errors  int // errors since the last heartbeat
+}
+
+// Health collects live pipeline signals and turns them into the 6.6 heartbeat
+// status: consumer errors and lag (from consumeTopic), last frame per train
+// (from StationCache) and platform delivery results (from the outbox metrics).
+type Health struct {
+	mu        sync.Mutex
+	started   time.Time
+	consumers map[string]*consumerHealth // groupID → state
+
+	// outbox counters at the previous heartbeat, to compute per-interval rates
+	prevAttempts, prevDelivered, prevFailures, prevDeadLettered int64
+}
+
+func newHealth() *Health {
+	return &Health{started: time.Now(), consumers: make(map[string]*consumerHealth)}
+}
+
+func (h *Health) consumer(groupID, topic string) *consumerHealth {
+	c, ok := h.consumers[groupID]
+	if !ok {
+		c = &consumerHealth{topic: topic, lag: make(map[int32]int64)}
+		h.consumers[groupID] = c
+	}
+	return c
+}
+
+// ConsumerMessage records a processed message and the partition lag behind it.
+func (h *Health) ConsumerMessage(groupID, topic string, partition int32, lag int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.consumer(groupID, topic)
+	c.lastMsg = time.Now()
+	c.lag[partition] = lag
+}
+
+// ConsumerError records a broker, session or handler failure of a consumer group.
+func (h *Health) ConsumerError(groupID, topic string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.consumer(groupID, topic)
+	c.lastErr = time.Now()
+	c.errMsg = err.Error()
+	c.errors++
+}
+
+// healthFinding is one problem found by Evaluate.
+type healthFinding struct {
+	degraded bool // true: status 3, false: status 2
+	remark   string
+	solution string
+}
+
+// Evaluate computes the heartbeat status and the human-readable remark/solution
+// for the interval since the previous call. frames holds the trains in service
+// (see StationCache.LastFrames) and framesSeen whether any frame arrived since
+// startup; frameStale is how long a train may send no frames; lagWarn is the
+// consumer lag (messages) considered backlogged.
+func (h *Health) Evaluate(frames map[string]time.Time, framesSeen bool, frameStale time.Duration, lagWarn int64) (status, remark, solution string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	var findings []healthFinding
+
+	// Kafka: every consumer failing without progress means the broker is unreachable.
+	var failing, lagging []string
+	frameBacklog := false // frames are queued or the frame consumer fails
+	for _, c := range h.consumers {
+		stuck := c.errors > 0 && !c.lastMsg.After(c.lastErr)
+		if stuck {
+			failing = append(failing, fmt.Sprintf("%s(%s)", c.topic, c.errMsg))
+		}
+		var total int64
+		for _, l := range c.lag {
+			total += l
+		}
+		if c.topic == frameTopic && (stuck || total > 0) {
+			frameBacklog = true
+		}
+		if lagWarn > 0 && total >= lagWarn {
+			lagging = append(lagging, fmt.Sprintf("%s 积压 %d 条", c.topic, total))
+		}
+		c.errors = 0
+	}
+	sort.Strings(failing)
+	sort.Strings(lagging)
+	if len(failing) > 0 {
+		findings = append(findings, healthFinding{
+			degraded: len(failing) == len(h.consumers),
+			remark:   "Kafka 消费异常: " + strings.Join(failing, ", "),
+			solution: "检查 Redpanda 集群状态及 ground-reporter 到 KAFKA_BROKERS 的网络",
+		})
+	}
+	if len(lagging) > 0 {
+		findings = append(findings, healthFinding{
+			remark:   "消费延迟: " + strings.Join(lagging, ", "),
+			solution: "检查平台接口响应速度与 ground-reporter 处理日志",
+		})
+	}
+
+	// Frames: trains that stopped sending, or nothing received at all.
+	if frameStale > 0 {
+		var stale []string
+		for train, t := range frames {
+			if now.Sub(t) > frameStale {
+				stale = append(stale, train)
+			}
+		}
+		sort.Strings(stale)
+		switch {
+		case !framesSeen && now.Sub(h.started) > frameStale:
+			findings = append(findings, healthFinding{
+				degraded: true,
+				remark:   fmt.Sprintf("启动 %v 以来未收到任何列车数据帧", frameStale),
+				solution: "检查车地数据链路、接入服务及 nb67 解析流水线",
+			})
+		case len(stale) > 0 && len(stale) == len(frames) && frameBacklog:
+			findings = append(findings, healthFinding{
+				degraded: true,
+				remark:   fmt.Sprintf("所有列车超过 %v 无数据帧，%s 消费未跟上", frameStale, frameTopic),
+				solution: "检查 Redpanda 集群状态及 ground-reporter 消费日志",
+			})
+		case len(stale) > 0 && len(stale) == len(frames):
+			// Every night all trains go quiet well before FrameExpireHours takes
+			// them out of service; with the frame topic drained this is stabling
+			// or an upstream outage, not a fault of this service.
+			findings = append(findings, healthFinding{
+				remark:   fmt.Sprintf("所有列车超过 %v 无数据帧（%s 无积压，收车停运期间属正常）", frameStale, frameTopic),
+				solution: "运营时段内出现时检查车地数据链路、接入服务及 nb67 解析流水线",
+			})
+		case len(stale) > 0:
+			findings = append(findings, healthFinding{
+				remark:   fmt.Sprintf("列车 %s 超过 %v 无数据帧", strings.Join(stale, ","), frameStale),
+				solution: "确认相关列车是否在线运营，检查其车载数据发送",
+			})
+		}
+	}
+
+	// Platform delivery in this interval. The rate is per delivery attempt: a
+	// record retried five times before it gets through is five attempts, one
+	// of them successful.
+	attempts, delivered, failures, dead := outboxAttempts.Get(), outboxDelivered.Get(), outboxFailures.Get(), outboxDeadLettered.Get()
+	dAttempts, dDelivered, dFailures, dDead := attempts-h.prevAttempts, delivered-h.prevDelivered, failures-h.prevFailures, dead-h.prevDeadLettered
+	h.prevAttempts, h.prevDelivered, h.prevFailures, h.prevDeadLettered = attempts, delivered, failures, dead
+	if dFailures > 0 && dAttempts > 0 {
+		rate := float64(dFailures) / float64(dAttempts)
+		findings = append(findings, healthFinding{
+			degraded: dDelivered == 0,
+			remark: fmt.Sprintf("平台报送失败率 %.0f%%（报送 %d 次，失败 %d 次），积压 %d 条，最早积压 %ds",
+				rate*100, dAttempts, dFailures, outboxDepth.Get(), outboxOldestAge.Get()),
+			solution: "检查地面平台接口可用性与鉴权配置，恢复后积压记录将自动补发",
+		})
+	}
+	if dDead > 0 {
+		findings = append(findings, healthFinding{
+			remark:   fmt.Sprintf("平台拒收 %d 条记录", dDead),
+			solution: "查看 STATE_DIR/deadletter.jsonl 中平台返回的原因并修正上报内容",
+		})
+	}
+
+	if len(findings) == 0 {
+		return status66OK, "", ""
+	}
+	status = status66Partial
+	var remarks, solutions []string
+	for _, f := range findings {
+		if f.degraded {
+			status = status66Degraded
+		}
+		remarks = append(remarks, f.remark)
+		solutions = append(solutions, f.solution)
+	}
+	return status, strings.Join(remarks, "；"), strings.Join(solutions, "；")
+}
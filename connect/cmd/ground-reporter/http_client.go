@@ -4,31 +4,96 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"time"
 )
 
+// platformCodeOK is the envelope code of an accepted request.
+const platformCodeOK = 200
+
+// platformEnvelope is the response body of every platform API:
+// {"code":200,"message":"操作成功","entity":null}.
+type platformEnvelope struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Entity  json.RawMessage `json:"entity"`
+}
+
+// PlatformError is a request the platform answered but did not accept, either by
+// HTTP status or by a business code in a 2xx envelope. Permanent errors mean the
+// payload itself was rejected and resending it cannot succeed.
+type PlatformError struct {
+	HTTPStatus int
+	Code       int    // envelope code; 0 when the body was not an envelope
+	Message    string // envelope message or raw body excerpt
+	Permanent  bool
+}
+
+func (e *PlatformError) Error() string {
+	kind := "retryable"
+	if e.Permanent {
+		kind = "permanent"
+	}
+	if e.Code != 0 {
+		return fmt.Sprintf("HTTP %d, platform code %d (%s): %s", e.HTTPStatus, e.Code, kind, e.Message)
+	}
+	return fmt.Sprintf("HTTP %d (%s): %s", e.HTTPStatus, kind, e.Message)
+}
+
+// isPermanent reports whether err is a platform rejection that must not be retried.
+func isPermanent(err error) bool {
+	var pe *PlatformError
+	return errors.As(err, &pe) && pe.Permanent
+}
+
+// retryableStatus reports whether an HTTP status or envelope code means the
+// platform is unavailable rather than rejecting the payload: 5xx, 408 and 429,
+// plus 401/403 — refused credentials are fixed by configuration, and the records
+// must stay queued until then.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return code >= 500
+}
+
 type PlatformClient struct {
-	apiKey     string // X-Api-Key header value; empty = omit header
+	auth       platformAuth // credentials per PLATFORM_AUTH_MODE
 	httpClient *http.Client
 	retryMax   int
 	backoffMs  int
 }
 
-func newPlatformClient(cfg Config) *PlatformClient {
-	return &PlatformClient{
-		apiKey: cfg.PlatformApiKey,
-		httpClient: &http.Client{
-			Timeout: time.Duration(cfg.PlatformTimeoutSec) * time.Second,
-		},
-		retryMax:  cfg.PlatformRetryMax,
-		backoffMs: cfg.PlatformRetryBackoffMs,
+func newPlatformClient(cfg Config) (*PlatformClient, error) {
+	auth, err := newPlatformAuth(cfg)
+	if err != nil {
+		return nil, err
 	}
+
+	httpClient := &http.Client{
+		Timeout: time.Duration(cfg.PlatformTimeoutSec) * time.Second,
+	}
+	if ta, ok := auth.(tlsAuth); ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = ta.TLSConfig()
+		httpClient.Transport = transport
+	}
+
+	return &PlatformClient{
+		auth:       auth,
+		httpClient: httpClient,
+		retryMax:   cfg.PlatformRetryMax,
+		backoffMs:  cfg.PlatformRetryBackoffMs,
+	}, nil
 }
 
 // PostJSON marshals body as JSON and POSTs to the given full URL, retrying on transient failures.
+// A permanent *PlatformError is returned at once without retrying.
 func (c *PlatformClient) PostJSON(ctx context.Context, url string, body any) error {
 	data, err := json.Marshal(body)
 	if err != nil {
@@ -50,6 +115,9 @@ func (c *PlatformClient) PostJSON(ctx context.Context, url string, body any) err
 		if err = c.doPost(ctx, url, data); err == nil {
 			return nil
 		}
+		if isPermanent(err) {
+			return fmt.Errorf("POST %s: %w", url, err)
+		}
 		log.Printf("[WARN] POST %s attempt %d/%d failed: %v", url, attempt+1, c.retryMax+1, err)
 	}
 	return fmt.Errorf("POST %s: all %d attempts failed, last error: %w", url, c.retryMax+1, err)
@@ -61,8 +129,8 @@ func (c *PlatformClient) doPost(ctx context.Context, url string, data []byte) er
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	if c.apiKey != "" {
-		req.Header.Set("X-Api-Key", c.apiKey)
+	if err := c.auth.Apply(ctx, req, data); err != nil {
+		return fmt.Errorf("auth: %w", err)
 	}
 
 	resp, err := c.httpClient.Do(req)
@@ -71,8 +139,41 @@ func (c *PlatformClient) doPost(ctx context.Context, url string, data []byte) er
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		if ti, ok := c.auth.(tokenInvalidator); ok {
+			ti.Invalidate()
+		}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var env platformEnvelope
+	isEnvelope := json.Unmarshal(body, &env) == nil && env.Code != 0
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+		pe := &PlatformError{HTTPStatus: resp.StatusCode, Message: excerpt(body), Permanent: !retryableStatus(resp.StatusCode)}
+		if isEnvelope {
+			pe.Code, pe.Message = env.Code, env.Message
+		}
+		return pe
+	}
+
+	// A 2xx without an envelope (empty or non-JSON body) is taken as accepted.
+	if !isEnvelope || env.Code == platformCodeOK {
+		return nil
+	}
+	return &PlatformError{
+		HTTPStatus: resp.StatusCode,
+		Code:       env.Code,
+		Message:    env.Message,
+		Permanent:  !retryableStatus(env.Code),
+	}
+}
+
+// excerpt shortens a response body for error messages.
+func excerpt(body []byte) string {
+	const maxLen = 200
+	if len(body) > maxLen {
+		return string(body[:maxLen]) + "..."
 	}
-	return nil
+	return string(body)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"strconv"
 	"sync"
 	"time"
@@ -17,7 +18,7 @@ type partSpec struct {
 	Unit     string // "hours" | "count"
 }
 
-// partSpecs mirrors buildLifeHits in nb67_event_processor.go exactly.
+// partSpecs mirrors lifeCounters in nb67_event_processor.go exactly.
 var partSpecs = []partSpec{
 	{1, "机组1通风机累计运行时间", "DwefOpTmU11", "hours"},
 	{2, "机组1冷凝风机累计运行时间", "DwcfOpTmU11", "hours"},
@@ -35,31 +36,81 @@ var partSpecs = []partSpec{
 	{22, "废排风阀开关总次数", "DwdmpexuOpCnt", "count"},
 }
 
+// partSpecByCode finds the spec of a part code (carriageID*1000 + 50000 + offset).
+func partSpecByCode(code string) (partSpec, bool) {
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return partSpec{}, false
+	}
+	for _, spec := range partSpecs {
+		if spec.Offset == n%1000 {
+			return spec, true
+		}
+	}
+	return partSpec{}, false
+}
+
+// serviceUnits converts a raw counter value (seconds for fans/compressors,
+// counts for valves) into the unit reported to the platform.
+func (s partSpec) serviceUnits(raw int64) int64 {
+	if s.Unit == "hours" {
+		return raw / 3600 // device reports seconds; platform expects hours
+	}
+	return raw
+}
+
 type partCacheKey struct {
 	DeviceID string
 	PartCode string
 }
 
 type PartEntry struct {
-	LineName   string
-	TrainType  string
-	TrainID    string
-	CarriageID int
-	PartCode   string
+	DeviceID   string `json:"device_id"`
+	LineName   string `json:"line_name"`
+	TrainType  string `json:"train_type"`
+	TrainID    string `json:"train_id"`
+	CarriageID int    `json:"carriage_id"`
+	PartCode   string `json:"part_code"`
 	// serviceValue to report: already converted (hours for time-based, count for valve)
-	ServiceValue int64
-	UpdatedAt    time.Time
+	ServiceValue int64     `json:"service_value"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// RatedLife and LimitTime come from the event builder's signal-life forecasts:
+	// the configured limit (same unit as ServiceValue) and the unix ms at which
+	// the part is expected to reach it; 0 = unknown
+	RatedLife int64 `json:"rated_life,omitempty"`
+	LimitTime int64 `json:"limit_time,omitempty"`
 }
 
 // LifeCache stores the latest cumulative part values seen in signal-parsed.
 // Updated on every parsed message; snapshot is taken for the nightly batch.
+// The cache is persisted to path so a restart shortly before the batch hour
+// (the consumer starts at the newest offset) does not send an empty batch.
 type LifeCache struct {
 	mu    sync.RWMutex
 	cache map[partCacheKey]*PartEntry
+	path  string
+	dirty bool // a part value changed since the last save
 }
 
-func newLifeCache() *LifeCache {
-	return &LifeCache{cache: make(map[partCacheKey]*PartEntry)}
+// newLifeCache creates the cache and restores the entries saved at path, if any.
+func newLifeCache(path string) *LifeCache {
+	c := &LifeCache{cache: make(map[partCacheKey]*PartEntry), path: path}
+
+	var entries []PartEntry
+	found, err := loadJSONFile(path, &entries)
+	if err != nil {
+		log.Printf("[WARN] life cache: load %s failed, starting empty: %v", path, err)
+		return c
+	}
+	if !found {
+		return c
+	}
+	for i := range entries {
+		e := entries[i]
+		c.cache[partCacheKey{DeviceID: e.DeviceID, PartCode: e.PartCode}] = &e
+	}
+	log.Printf("[INFO] life cache: restored %d part value(s) from %s", len(c.cache), path)
+	return c
 }
 
 // Update extracts all 14 part values from a signal-parsed message and refreshes the cache.
@@ -79,17 +130,12 @@ func (c *LifeCache) Update(msg ParsedMsg, trainType string) {
 			continue // field absent or device not yet reporting
 		}
 
-		var serviceValue int64
-		if spec.Unit == "hours" {
-			serviceValue = raw / 3600 // device reports seconds; platform expects hours
-		} else {
-			serviceValue = raw
-		}
-
+		serviceValue := spec.serviceUnits(raw)
 		code := fmt.Sprintf("%d", base+int64(spec.Offset))
 		key := partCacheKey{DeviceID: msg.DeviceID, PartCode: code}
 
-		c.cache[key] = &PartEntry{
+		e := &PartEntry{
+			DeviceID:     msg.DeviceID,
 			LineName:     strconv.Itoa(msg.LineID),
 			TrainType:    trainType,
 			TrainID:      strconv.Itoa(msg.TrainID),
@@ -98,6 +144,17 @@ func (c *LifeCache) Update(msg ParsedMsg, trainType string) {
 			ServiceValue: serviceValue,
 			UpdatedAt:    now,
 		}
+		prev, ok := c.cache[key]
+		if !ok || prev.ServiceValue != serviceValue {
+			c.dirty = true
+		}
+		if ok {
+			e.RatedLife, e.LimitTime = prev.RatedLife, prev.LimitTime
+			if serviceValue < prev.ServiceValue {
+				e.LimitTime = 0 // part replaced: wait for the builder's next forecast
+			}
+		}
+		c.cache[key] = e
 	}
 }
 
@@ -112,3 +169,59 @@ func (c *LifeCache) Snapshot() []PartEntry {
 	}
 	return out
 }
+
+// Flush saves the cache if a part value changed since the last save.
+func (c *LifeCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return
+	}
+	entries := make([]PartEntry, 0, len(c.cache))
+	for _, e := range c.cache {
+		entries = append(entries, *e)
+	}
+	if err := saveJSONFile(c.path, entries); err != nil {
+		log.Printf("[ERROR] life cache: save %s failed: %v", c.path, err)
+		return
+	}
+	c.dirty = false
+}
+
+// SetForecast records the event builder's rated life and forecast of a part
+// (limit in raw units: seconds or counts). A forecast without limit_time keeps
+// the previous estimate, since the builder needs a day of history after a
+// restart; a zero limit (life warnings disabled) clears it.
+func (c *LifeCache) SetForecast(deviceID string, f LifeForecast) {
+	spec, ok := partSpecByCode(f.Code)
+	if !ok {
+		return
+	}
+	rated := spec.serviceUnits(f.Limit)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[partCacheKey{DeviceID: deviceID, PartCode: f.Code}]
+	if !ok {
+		return
+	}
+	limitTime := f.LimitTime
+	if limitTime == 0 && rated > 0 {
+		limitTime = e.LimitTime
+	}
+	if e.RatedLife != rated || e.LimitTime != limitTime {
+		e.RatedLife, e.LimitTime = rated, limitTime
+		c.dirty = true
+	}
+}
+
+// LimitTime returns the last forecast time (unix ms) at which a part reaches
+// its rated life, or 0 if unknown.
+func (c *LifeCache) LimitTime(deviceID, partCode string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if e, ok := c.cache[partCacheKey{DeviceID: deviceID, PartCode: partCode}]; ok {
+		return e.LimitTime
+	}
+	return 0
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -13,49 +15,118 @@ import (
 func main() {
 	cfg := loadConfig()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	log.Printf("[INFO] ground-reporter starting: faultRecordURL=%s sysStatusURL=%s lifeRecordURL=%s subsystem=%s trainType=%s",
-		cfg.FaultRecordURL, cfg.SysStatusURL, cfg.LifeRecordURL, cfg.SubsystemCode, cfg.TrainType)
+	log.Printf("[INFO] ground-reporter starting: faultRecordURL=%s sysStatusURL=%s lifeRecordURL=%s subsystem=%s trainType=%s auth=%s",
+		cfg.FaultRecordURL, cfg.SysStatusURL, cfg.LifeRecordURL, cfg.SubsystemCode, cfg.TrainType, cfg.PlatformAuthMode)
 
-	client := newPlatformClient(cfg)
-	tracker := newAlarmTracker()
-	lifeCache := newLifeCache()
+	faultCodesLoaded := loadFaultCodes(cfg.FaultCodeFile)
+
+	client, err := newPlatformClient(cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] platform client: %v", err)
+	}
+	outbox, err := openOutbox(statePath(cfg, "outbox"), statePath(cfg, "deadletter.jsonl"), client, cfg.OutboxMaxRecords)
+	if err != nil {
+		log.Fatalf("[ERROR] outbox: open %s failed: %v", statePath(cfg, "outbox"), err)
+	}
+	tracker := newAlarmTracker(statePath(cfg, "alarm_tracker.json"))
+	lifeCache := newLifeCache(statePath(cfg, "life_cache.json"))
+	partRegistry := newPartRegistry(cfg.PartRegistryFile, statePath(cfg, "part_state.json"))
+	dailyBatch := newDailyBatch(outbox, lifeCache, partRegistry, cfg, statePath(cfg, "life_batch.json"))
 	stationCache := newStationCache()
+	health := newHealth()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
 
+	// --- platform delivery: drain each API lane of the outbox in order ---
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outbox.Run(ctx)
+	}()
+
+	// --- Prometheus metrics (outbox depth etc.) + on-demand 6.7 batch (token only) ---
+	routes := map[string]http.Handler{}
+	if cfg.BatchTriggerToken != "" {
+		routes["/batch/6.7"] = dailyBatch
+	} else {
+		log.Printf("[INFO] BATCH_TRIGGER_TOKEN not set, POST /batch/6.7 disabled")
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		RunMetricsServer(ctx, cfg.MetricsAddr, routes)
+	}()
+
 	// --- 6.1: signal-predict ---
 	wg.Add(1)
-	go consumeTopic(ctx, &wg, cfg.KafkaBrokers,
+	go consumeTopic(ctx, &wg, cfg, health,
 		"signal-predict", "ground-reporter-predict",
-		func(data []byte) {
-			Handle61Predict(ctx, client, tracker, stationCache, cfg, data)
+		func(data []byte) error {
+			return Handle61Predict(outbox, tracker, stationCache, cfg, data)
 		},
 	)
 
+	// --- 6.1: signal-alarm (only with platform fault codes to report them under) ---
+	if cfg.AlarmReportEnabled && !faultCodesLoaded {
+		log.Printf("[ERROR] 6.1 alarm reporting disabled: no platform fault codes loaded from %s (FAULT_CODE_FILE)", cfg.FaultCodeFile)
+	} else if cfg.AlarmReportEnabled {
+		wg.Add(1)
+		go consumeTopic(ctx, &wg, cfg, health,
+			"signal-alarm", "ground-reporter-alarm",
+			func(data []byte) error {
+				return Handle61Alarm(outbox, tracker, stationCache, cfg, data)
+			},
+		)
+	} else {
+		log.Printf("[INFO] 6.1 alarm reporting disabled (ALARM_REPORT_ENABLED=false)")
+	}
+
+	// --- 6.1: close records of devices that went silent ---
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		Run61Expiry(ctx, outbox, tracker, stationCache, cfg)
+	}()
+
+	// --- persist 6.1 tracker, 6.7 life cache and part registry state across restarts ---
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		RunStateFlush(ctx, tracker, lifeCache, partRegistry)
+	}()
+
 	// --- 6.7 per-action: signal-life ---
 	wg.Add(1)
-	go consumeTopic(ctx, &wg, cfg.KafkaBrokers,
+	go consumeTopic(ctx, &wg, cfg, health,
 		"signal-life", "ground-reporter-life",
-		func(data []byte) {
-			Handle67LifeAction(ctx, client, cfg, data)
+		func(data []byte) error {
+			return Handle67LifeAction(outbox, lifeCache, partRegistry, cfg, data)
+		},
+	)
+
+	// --- 6.7 part replacement: signal-replacement ---
+	wg.Add(1)
+	go consumeTopic(ctx, &wg, cfg, health,
+		"signal-replacement", "ground-reporter-replacement",
+		func(data []byte) error {
+			return Handle67Replacement(outbox, partRegistry, cfg, data)
 		},
 	)
 
-	// --- 6.7 daily cache + station cache: signal-parsed ---
+	// --- 6.7 daily cache + station cache + odometer: signal-parsed ---
 	wg.Add(1)
-	go consumeTopic(ctx, &wg, cfg.KafkaBrokers,
-		"signal-parsed", "ground-reporter-life-cache",
-		func(data []byte) {
+	go consumeTopic(ctx, &wg, cfg, health,
+		frameTopic, "ground-reporter-life-cache",
+		func(data []byte) error {
 			var msg ParsedMsg
 			if err := json.Unmarshal(data, &msg); err != nil {
-				if cfg.LogLevel == "DEBUG" {
-					log.Printf("[DEBUG] life-cache: bad json: %v", err)
-				}
-				return
+				return poison(fmt.Errorf("life-cache: bad json: %w", err))
 			}
 			lifeCache.Update(msg, cfg.TrainType)
 			stationCache.Update(msg)
+			partRegistry.UpdateOdometer(msg, cfg.OdometerRawField)
+			return nil
 		},
 	)
 
@@ -63,14 +134,14 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		Run66Heartbeat(ctx, client, cfg)
+		Run66Heartbeat(ctx, client, health, stationCache, cfg)
 	}()
 
 	// --- 6.7: daily batch timer ---
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		Run67DailyBatch(ctx, client, lifeCache, cfg)
+		Run67DailyBatch(ctx, dailyBatch)
 	}()
 
 	// Graceful shutdown on SIGTERM / SIGINT
@@ -81,5 +152,6 @@ func main() {
 	log.Printf("[INFO] ground-reporter shutting down...")
 	cancel()
 	wg.Wait()
+	_ = outbox.Close()
 	log.Printf("[INFO] ground-reporter stopped")
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metric is a single int64 gauge or counter exposed on /metrics.
+type metric struct {
+	name  string
+	help  string
+	kind  string // "gauge" | "counter"
+	value atomic.Int64
+}
+
+func (m *metric) Set(v int64) { m.value.Store(v) }
+func (m *metric) Add(d int64) { m.value.Add(d) }
+func (m *metric) Get() int64  { return m.value.Load() }
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]*metric)
+)
+
+func newMetric(name, kind, help string) *metric {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m := &metric{name: name, help: help, kind: kind}
+	metrics[name] = m
+	return m
+}
+
+func newGauge(name, help string) *metric   { return newMetric(name, "gauge", help) }
+func newCounter(name, help string) *metric { return newMetric(name, "counter", help) }
+
+// writeMetrics renders all metrics in the Prometheus text exposition format.
+func writeMetrics(w http.ResponseWriter, _ *http.Request) {
+	metricsMu.Lock()
+	all := make([]*metric, 0, len(metrics))
+	for _, m := range metrics {
+		all = append(all, m)
+	}
+	metricsMu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range all {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.Get())
+	}
+}
+
+// RunMetricsServer serves /metrics and the given admin routes on addr until ctx
+// is cancelled. Empty addr disables it.
+func RunMetricsServer(ctx context.Context, addr string, routes map[string]http.Handler) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	for pattern, h := range routes {
+		mux.Handle(pattern, h)
+	}
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("[INFO] metrics listening on %s/metrics", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("[ERROR] metrics server: %v", err)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outboxSegmentMaxBytes is the size after which the outbox starts a new segment file.
+const outboxSegmentMaxBytes = 4 << 20
+
+// Delivery retry backoff of the drainer once PostJSON has exhausted its own retries.
+const (
+	outboxBackoffMin = time.Second
+	outboxBackoffMax = 5 * time.Minute
+)
+
+var (
+	outboxDepth     = newGauge("ground_reporter_outbox_depth", "Platform records queued and not yet acknowledged.")
+	outboxOldestAge = newGauge("ground_reporter_outbox_oldest_age_seconds", "Age of the oldest queued platform record.")
+	outboxEnqueued  = newCounter("ground_reporter_outbox_enqueued_total", "Platform records written to the outbox.")
+	outboxAttempts  = newCounter("ground_reporter_outbox_delivery_attempts_total", "Delivery attempts of queued platform records (delivered, failed or rejected).")
+	outboxDelivered = newCounter("ground_reporter_outbox_delivered_total", "Platform records acknowledged by the platform.")
+	outboxFailures  = newCounter("ground_reporter_outbox_delivery_failures_total", "Delivery attempts that failed after all HTTP retries.")
+	outboxDropped   = newCounter("ground_reporter_outbox_dropped_total", "Platform records refused because the outbox was full.")
+)
+
+// outboxEntry is one line of a segment file.
+type outboxEntry struct {
+	Kind       string          `json:"kind"` // log label, e.g. "6.1 alarm"
+	URL        string          `json:"url"`
+	Body       json.RawMessage `json:"body"`
+	EnqueuedAt int64           `json:"enqueued_at"` // unix ms
+}
+
+// outboxCursor points at the next record to deliver.
+type outboxCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Outbox queues platform POSTs on disk, one FIFO lane per platform API (6.1,
+// 6.7, ...), each with its own segments, cursor and drainer under dir/<api>.
+// Records of one API are delivered strictly in order, but an API whose endpoint
+// keeps failing only holds back its own lane: the other APIs keep delivering.
+//
+// Records are appended as JSON lines to numbered segment files and fsynced
+// before Enqueue returns, so a record is durable by the time the Kafka offset of
+// its source message is marked. A lane only advances its persisted cursor once
+// the platform has acknowledged a record; a platform outage therefore just grows
+// the backlog, which is replayed when it recovers. Fully delivered segments are
+// deleted.
+//
+// A record the platform permanently rejects (see PlatformError) would block its
+// lane forever, so it is moved to the dead-letter file instead of being retried.
+// While the dead-letter file cannot be written the lane stays blocked and retries
+// with backoff; a rejected record is never dropped.
+type Outbox struct {
+	dir        string
+	deadLetter string // dead-letter file path
+	client     *PlatformClient
+	maxRecords int
+
+	mu    sync.Mutex
+	lanes map[string]*outboxQueue
+	ctx   context.Context // set by Run; lanes created later start their drainer at once
+	wg    sync.WaitGroup
+}
+
+// outboxQueue is one disk-backed FIFO lane of the outbox.
+type outboxQueue struct {
+	owner      *Outbox
+	lane       string // platform API, "" for a queue left by a pre-lane version
+	dir        string
+	maxRecords int64
+
+	mu       sync.Mutex
+	segments []uint64 // segment numbers on disk, ascending; the last one is written to
+	w        *os.File
+	wSize    int64
+	cursor   outboxCursor
+	depth    int64
+	wake     chan struct{}
+
+	headEnqueuedAt atomic.Int64 // unix ms of the record being delivered, 0 when idle
+}
+
+// openOutbox opens (or creates) the outbox in dir and every lane still on disk
+// from a previous run. maxRecords caps the backlog of each lane; 0 means
+// unbounded. Permanently rejected records are appended to deadLetterPath.
+func openOutbox(dir, deadLetterPath string, client *PlatformClient, maxRecords int) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		dir:        dir,
+		deadLetter: deadLetterPath,
+		client:     client,
+		maxRecords: maxRecords,
+		lanes:      map[string]*outboxQueue{},
+	}
+
+	// Segments directly under dir are the single queue of a version without
+	// lanes; drain them once, in their own lane, then remove them.
+	legacy, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	if len(legacy) > 0 {
+		q, err := o.openQueue("", dir)
+		if err != nil {
+			return nil, fmt.Errorf("open outbox %s: %w", dir, err)
+		}
+		o.lanes[""] = q
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		q, err := o.openQueue(e.Name(), filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("open outbox lane %s: %w", e.Name(), err)
+		}
+		o.lanes[e.Name()] = q
+	}
+	return o, nil
+}
+
+// openQueue opens (or creates) one lane and counts the records still queued in it.
+func (o *Outbox) openQueue(lane, dir string) (*outboxQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := &outboxQueue{
+		owner:      o,
+		lane:       lane,
+		dir:        dir,
+		maxRecords: int64(o.maxRecords),
+		wake:       make(chan struct{}, 1),
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		n, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, n)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	if _, err := loadJSONFile(q.cursorPath(), &q.cursor); err != nil {
+		return nil, fmt.Errorf("load cursor: %w", err)
+	}
+
+	// Drop segments the cursor has already moved past (crash between cursor save and delete).
+	for len(q.segments) > 0 && q.segments[0] < q.cursor.Segment {
+		_ = os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 {
+		q.segments = []uint64{q.cursor.Segment + 1}
+	}
+	if q.cursor.Segment < q.segments[0] {
+		q.cursor = outboxCursor{Segment: q.segments[0]}
+	}
+
+	for _, seg := range q.segments {
+		from := int64(0)
+		if seg == q.cursor.Segment {
+			from = q.cursor.Offset
+		}
+		n, err := countOutboxLines(q.segmentPath(seg), from)
+		if err != nil {
+			return nil, fmt.Errorf("scan segment %d: %w", seg, err)
+		}
+		q.depth += n
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if q.w, err = os.OpenFile(q.segmentPath(last), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	if fi, err := q.w.Stat(); err == nil {
+		q.wSize = fi.Size()
+	}
+
+	outboxDepth.Add(q.depth)
+	if q.depth > 0 {
+		log.Printf("[INFO] outbox: %d record(s) queued from previous run in %s", q.depth, dir)
+	}
+	return q, nil
+}
+
+// countOutboxLines counts complete records in a segment from offset on, and cuts
+// off a torn last line left by a crash mid-append.
+func countOutboxLines(path string, offset int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	if end := int64(bytes.LastIndexByte(data, '\n') + 1); end < int64(len(data)) {
+		log.Printf("[WARN] outbox: truncating torn record at end of %s", path)
+		if err := f.Truncate(end); err != nil {
+			return 0, err
+		}
+		data = data[:end]
+	}
+	if offset >= int64(len(data)) {
+		return 0, nil
+	}
+	return int64(bytes.Count(data[offset:], []byte{'\n'})), nil
+}
+
+func (q *outboxQueue) segmentPath(seg uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d.seg", seg))
+}
+
+func (q *outboxQueue) cursorPath() string {
+	return filepath.Join(q.dir, "cursor.json")
+}
+
+// outboxLane returns the lane of a record: the platform API its kind starts
+// with ("6.1 alarm" -> "6.1").
+func outboxLane(kind string) string {
+	lane, _, _ := strings.Cut(kind, " ")
+	return lane
+}
+
+// Enqueue durably appends one POST to the lane of its API. kind is used in log
+// lines and names the lane. It fails when the lane is at its cap: new records
+// are refused rather than evicting old ones, so what is delivered is always an
+// in-order prefix.
+func (o *Outbox) Enqueue(kind, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	line, err := json.Marshal(outboxEntry{Kind: kind, URL: url, Body: data, EnqueuedAt: nowMs()})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	line = append(line, '\n')
+
+	q, err := o.queue(outboxLane(kind))
+	if err != nil {
+		return err
+	}
+	return q.append(line)
+}
+
+// queue returns the lane, opening it (and starting its drainer once Run has
+// been called) on first use.
+func (o *Outbox) queue(lane string) (*outboxQueue, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if q, ok := o.lanes[lane]; ok {
+		return q, nil
+	}
+	q, err := o.openQueue(lane, filepath.Join(o.dir, lane))
+	if err != nil {
+		return nil, fmt.Errorf("open outbox lane %s: %w", lane, err)
+	}
+	o.lanes[lane] = q
+	if o.ctx != nil {
+		o.startLocked(q)
+	}
+	return q, nil
+}
+
+func (q *outboxQueue) append(line []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxRecords > 0 && q.depth >= q.maxRecords {
+		outboxDropped.Add(1)
+		return fmt.Errorf("outbox lane %s full (%d records queued)", q.lane, q.depth)
+	}
+	if q.wSize >= outboxSegmentMaxBytes {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if _, err := q.w.Write(line); err != nil {
+		return err
+	}
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	q.wSize += int64(len(line))
+	q.depth++
+	outboxDepth.Add(1)
+	outboxEnqueued.Add(1)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotateLocked closes the write segment and starts the next one. Caller must hold q.mu.
+func (q *outboxQueue) rotateLocked() error {
+	next := q.segments[len(q.segments)-1] + 1
+	f, err := os.OpenFile(q.segmentPath(next), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = q.w.Close()
+	q.w = f
+	q.wSize = 0
+	q.segments = append(q.segments, next)
+	return nil
+}
+
+// peek returns the record at the cursor and the cursor just past it.
+// ok is false when nothing is queued. Exhausted segments are deleted on the way.
+func (q *outboxQueue) peek() (entry outboxEntry, next outboxCursor, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.depth > 0 {
+		line, err := readOutboxLine(q.segmentPath(q.cursor.Segment), q.cursor.Offset)
+		if err == io.EOF {
+			if q.cursor.Segment == q.segments[len(q.segments)-1] {
+				return entry, next, false, nil
+			}
+			if err := q.advanceSegmentLocked(); err != nil {
+				return entry, next, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return entry, next, false, err
+		}
+
+		next = outboxCursor{Segment: q.cursor.Segment, Offset: q.cursor.Offset + int64(len(line))}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("[ERROR] outbox: skipping unreadable record at %d:%d: %v", q.cursor.Segment, q.cursor.Offset, err)
+			q.ackLocked(next)
+			continue
+		}
+		return entry, next, true, nil
+	}
+	return entry, next, false, nil
+}
+
+// advanceSegmentLocked moves the cursor to the start of the next segment and
+// deletes the exhausted one. Caller must hold q.mu.
+func (q *outboxQueue) advanceSegmentLocked() error {
+	done := q.segments[0]
+	q.segments = q.segments[1:]
+	q.cursor = outboxCursor{Segment: q.segments[0]}
+	if err := saveJSONFile(q.cursorPath(), q.cursor); err != nil {
+		return err
+	}
+	return os.Remove(q.segmentPath(done))
+}
+
+func readOutboxLine(path string, offset int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		// A partial line is a record still being appended; treat it as not there yet.
+		return nil, io.EOF
+	}
+	return line, nil
+}
+
+// ack marks the record before next as delivered.
+func (q *outboxQueue) ack(next outboxCursor) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ackLocked(next)
+}
+
+func (q *outboxQueue) ackLocked(next outboxCursor) {
+	q.cursor = next
+	q.depth--
+	outboxDepth.Add(-1)
+	if err := saveJSONFile(q.cursorPath(), q.cursor); err != nil {
+		// Only costs a duplicate delivery of this record after a restart.
+		log.Printf("[ERROR] outbox: save cursor failed: %v", err)
+	}
+}
+
+// Run delivers the queued records of every lane until ctx is cancelled, one
+// drainer per lane, and returns once they have stopped.
+func (o *Outbox) Run(ctx context.Context) {
+	o.mu.Lock()
+	o.ctx = ctx
+	for _, q := range o.lanes {
+		o.startLocked(q)
+	}
+	o.mu.Unlock()
+
+	<-ctx.Done()
+	o.wg.Wait()
+}
+
+// startLocked starts the drainer of a lane. Caller must hold o.mu.
+func (o *Outbox) startLocked(q *outboxQueue) {
+	if o.ctx.Err() != nil {
+		return
+	}
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		q.run(o.ctx)
+	}()
+}
+
+// refreshOldestAge publishes the age of the oldest record being delivered over all lanes.
+func (o *Outbox) refreshOldestAge() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	oldest := int64(0)
+	for _, q := range o.lanes {
+		if t := q.headEnqueuedAt.Load(); t > 0 && (oldest == 0 || t < oldest) {
+			oldest = t
+		}
+	}
+	if oldest == 0 {
+		outboxOldestAge.Set(0)
+		return
+	}
+	outboxOldestAge.Set((nowMs() - oldest) / 1000)
+}
+
+// run delivers the lane's records in order until ctx is cancelled. A record that
+// cannot be delivered blocks this lane only and is retried with exponential backoff.
+func (q *outboxQueue) run(ctx context.Context) {
+	backoff := outboxBackoffMin
+	failing := false
+
+	for {
+		entry, next, ok, err := q.peek()
+		if err != nil {
+			log.Printf("[ERROR] outbox %s: read failed: %v – retrying in %v", q.dir, err, outboxBackoffMax)
+			if !sleepCtx(ctx, outboxBackoffMax) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			q.headEnqueuedAt.Store(0)
+			q.owner.refreshOldestAge()
+			if q.lane == "" {
+				// Queue of a version without lanes: nothing is added to it any more.
+				q.remove()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		q.headEnqueuedAt.Store(entry.EnqueuedAt)
+		q.owner.refreshOldestAge()
+
+		err = q.owner.client.PostJSON(ctx, entry.URL, entry.Body)
+		if ctx.Err() == nil {
+			outboxAttempts.Add(1)
+		}
+		switch {
+		case err == nil:
+		case isPermanent(err):
+			if werr := q.reject(entry, next, err); werr != nil {
+				// Keep the record at the head of the lane until it is safely in the
+				// dead-letter file; it is posted again after the backoff.
+				log.Printf("[ERROR] %s rejected by platform, write to %s failed, retrying in %v: %v (%v)",
+					entry.Kind, q.owner.deadLetter, backoff, werr, err)
+				if !sleepCtx(ctx, backoff) {
+					return
+				}
+				backoff = min(backoff*2, outboxBackoffMax)
+			}
+			continue
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			outboxFailures.Add(1)
+			log.Printf("[ERROR] %s POST failed, %d record(s) queued, retrying in %v: %v",
+				entry.Kind, q.queued(), backoff, err)
+			failing = true
+			if !sleepCtx(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, outboxBackoffMax)
+			continue
+		}
+
+		q.ack(next)
+		outboxDelivered.Add(1)
+		if failing {
+			log.Printf("[INFO] %s: platform reachable again, replaying %d queued record(s)", entry.Kind, q.queued())
+			failing = false
+		}
+		backoff = outboxBackoffMin
+	}
+}
+
+func (q *outboxQueue) queued() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// remove deletes a drained queue of a version without lanes.
+func (q *outboxQueue) remove() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth > 0 {
+		return
+	}
+	_ = q.w.Close()
+	q.w = nil
+	for _, seg := range q.segments {
+		_ = os.Remove(q.segmentPath(seg))
+	}
+	_ = os.Remove(q.cursorPath())
+	log.Printf("[INFO] outbox: records queued before the per-API lanes delivered, removed them from %s", q.dir)
+}
+
+// reject moves a permanently rejected record to the dead-letter file and acks it,
+// so the records queued behind it can be delivered. If the dead-letter write fails
+// the record is not acked and the write error is returned.
+func (q *outboxQueue) reject(entry outboxEntry, next outboxCursor, err error) error {
+	dl := deadLetter{
+		Kind:       entry.Kind,
+		URL:        entry.URL,
+		Body:       entry.Body,
+		EnqueuedAt: entry.EnqueuedAt,
+		RejectedAt: nowMs(),
+		Message:    err.Error(),
+	}
+	var pe *PlatformError
+	if errors.As(err, &pe) {
+		dl.HTTPStatus, dl.Code, dl.Message = pe.HTTPStatus, pe.Code, pe.Message
+	}
+	if werr := appendDeadLetter(q.owner.deadLetter, dl); werr != nil {
+		return werr
+	}
+	log.Printf("[ERROR] %s rejected by platform, moved to %s: %v", entry.Kind, q.owner.deadLetter, err)
+	q.ack(next)
+	outboxDeadLettered.Add(1)
+	return nil
+}
+
+// Close closes the write segments of all lanes.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	for _, q := range o.lanes {
+		q.mu.Lock()
+		if q.w != nil {
+			errs = append(errs, q.w.Close())
+		}
+		q.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// sleepCtx waits for d and reports false if ctx was cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
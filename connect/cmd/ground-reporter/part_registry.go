@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PartRegistry supplies the 6.7 useTime (start of service) and mileage of each
+// life-tracked part. It combines two sources:
+//
+//   - the registry file (PART_REGISTRY_FILE), maintained by operators and reloaded
+//     when it changes: commissioning date and odometer per train, installation
+//     date per part code;
+//   - reporter state (part_state.json): replacements detected at runtime and the
+//     latest odometer readings from signal-parsed (ODOMETER_RAW_FIELD).
+//
+// A replacement recorded at runtime wins over the file entry when it is newer.
+//
+// Registry file example (trains keyed by train number, parts by part code):
+//
+//	{
+//	  "trains": {
+//	    "00001": {
+//	      "in_service_at": "2023-06-30",
+//	      "mileage_km": 182340,
+//	      "parts": {"51003": {"installed_at": "2025-04-12", "install_mileage_km": 150210}}
+//	    }
+//	  }
+//	}
+type PartRegistry struct {
+	filePath  string
+	statePath string
+
+	mu        sync.Mutex
+	file      registryFile
+	fileMod   time.Time
+	checkedAt time.Time
+	state     partState
+	dirty     bool // odometer readings changed since the last save
+}
+
+// registryReloadInterval throttles the stat of the registry file.
+const registryReloadInterval = time.Minute
+
+type registryFile struct {
+	Trains map[string]registryTrain `json:"trains"`
+}
+
+type registryTrain struct {
+	InServiceAt string                  `json:"in_service_at"` // default installation date of its parts
+	MileageKm   *int64                  `json:"mileage_km"`    // odometer, when no live reading exists
+	Parts       map[string]registryPart `json:"parts"`
+}
+
+type registryPart struct {
+	InstalledAt      string `json:"installed_at"` // "2006-01-02" or RFC 3339
+	InstallMileageKm int64  `json:"install_mileage_km"`
+}
+
+// partState is the reporter-owned part of the registry.
+type partState struct {
+	Replacements map[string]partInstall `json:"replacements"` // "trainNo/partCode" → install
+	Odometer     map[string]int64       `json:"odometer"`     // trainNo → km
+}
+
+type partInstall struct {
+	InstalledAt      int64 `json:"installed_at"` // unix ms
+	InstallMileageKm int64 `json:"install_mileage_km"`
+}
+
+func newPartRegistry(filePath, statePath string) *PartRegistry {
+	r := &PartRegistry{
+		filePath:  filePath,
+		statePath: statePath,
+		state:     partState{Replacements: make(map[string]partInstall), Odometer: make(map[string]int64)},
+	}
+	if _, err := loadJSONFile(statePath, &r.state); err != nil {
+		log.Printf("[WARN] part registry: load %s failed: %v", statePath, err)
+	}
+	if r.state.Replacements == nil {
+		r.state.Replacements = make(map[string]partInstall)
+	}
+	if r.state.Odometer == nil {
+		r.state.Odometer = make(map[string]int64)
+	}
+	r.reloadLocked(time.Now())
+	return r
+}
+
+// reloadLocked re-reads the registry file if its modification time changed.
+func (r *PartRegistry) reloadLocked(now time.Time) {
+	r.checkedAt = now
+	fi, err := os.Stat(r.filePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] part registry: stat %s: %v", r.filePath, err)
+		}
+		return
+	}
+	if fi.ModTime().Equal(r.fileMod) {
+		return
+	}
+
+	var f registryFile
+	if _, err := loadJSONFile(r.filePath, &f); err != nil {
+		log.Printf("[WARN] part registry: load %s failed, keeping previous: %v", r.filePath, err)
+		return
+	}
+	// Normalise train keys to the platform train number ("1" → "00001").
+	trains := make(map[string]registryTrain, len(f.Trains))
+	parts := 0
+	for k, t := range f.Trains {
+		trains[padTrainNo(k)] = t
+		parts += len(t.Parts)
+	}
+	r.file = registryFile{Trains: trains}
+	r.fileMod = fi.ModTime()
+	log.Printf("[INFO] part registry: loaded %d train(s), %d part entr(ies) from %s", len(trains), parts, r.filePath)
+}
+
+// Lookup returns the 6.7 useTime (unix ms, 0 if unknown) and mileage (km run
+// since installation, 0 if no odometer) of a part.
+func (r *PartRegistry) Lookup(trainNo, partCode string) (useTime, mileage int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checkedAt) >= registryReloadInterval {
+		r.reloadLocked(now)
+	}
+
+	train := r.file.Trains[trainNo]
+	var inst partInstall
+	if p, ok := train.Parts[partCode]; ok {
+		inst = partInstall{InstalledAt: parseRegistryTime(p.InstalledAt), InstallMileageKm: p.InstallMileageKm}
+	} else {
+		inst.InstalledAt = parseRegistryTime(train.InServiceAt)
+	}
+	if rep, ok := r.state.Replacements[trainNo+"/"+partCode]; ok && rep.InstalledAt > inst.InstalledAt {
+		inst = rep
+	}
+
+	if odo, ok := r.odometerLocked(trainNo); ok && odo >= inst.InstallMileageKm {
+		mileage = odo - inst.InstallMileageKm
+	}
+	return inst.InstalledAt, mileage
+}
+
+// odometerLocked prefers the live reading over the registry file value.
+func (r *PartRegistry) odometerLocked(trainNo string) (int64, bool) {
+	if km, ok := r.state.Odometer[trainNo]; ok {
+		return km, true
+	}
+	if km := r.file.Trains[trainNo].MileageKm; km != nil {
+		return *km, true
+	}
+	return 0, false
+}
+
+// Replace records that a part was replaced at the given time: its useTime and
+// mileage restart from there. Saved immediately.
+func (r *PartRegistry) Replace(trainNo, partCode string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	odo, _ := r.odometerLocked(trainNo)
+	r.state.Replacements[trainNo+"/"+partCode] = partInstall{InstalledAt: at.UnixMilli(), InstallMileageKm: odo}
+	r.saveLocked()
+}
+
+// UpdateOdometer takes the train odometer from a signal-parsed frame when field
+// (ODOMETER_RAW_FIELD) is configured and present.
+func (r *PartRegistry) UpdateOdometer(msg ParsedMsg, field string) {
+	if field == "" {
+		return
+	}
+	km := rawInt(msg.Raw, field)
+	if km <= 0 {
+		return
+	}
+	trainNo := padTrainNo(strconv.Itoa(msg.TrainID))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.Odometer[trainNo] != km {
+		r.state.Odometer[trainNo] = km
+		r.dirty = true
+	}
+}
+
+// Flush saves the odometer readings if they changed since the last save.
+func (r *PartRegistry) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dirty {
+		r.saveLocked()
+	}
+}
+
+func (r *PartRegistry) saveLocked() {
+	if err := saveJSONFile(r.statePath, r.state); err != nil {
+		log.Printf("[ERROR] part registry: save %s failed: %v", r.statePath, err)
+		return
+	}
+	r.dirty = false
+}
+
+// parseRegistryTime accepts a date ("2006-01-02", local time) or RFC 3339 and
+// returns unix ms, or 0 when empty or malformed.
+func parseRegistryTime(s string) int64 {
+	if s == "" {
+		return 0
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t.UnixMilli()
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UnixMilli()
+	}
+	log.Printf("[WARN] part registry: bad time %q (want 2006-01-02 or RFC 3339)", s)
+	return 0
+}
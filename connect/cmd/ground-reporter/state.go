@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statePath returns the file path of a piece of persisted reporter state under cfg.StateDir.
+func statePath(cfg Config, name string) string {
+	return filepath.Join(cfg.StateDir, name)
+}
+
+// saveJSONFile writes v as JSON to path atomically (temp file + fsync + rename),
+// so a crash mid-write never leaves a truncated state file behind.
+func saveJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadJSONFile reads a file written by saveJSONFile into v.
+// A missing file is not an error: found is false and v is left untouched.
+func loadJSONFile(path string, v any) (found bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// stateFlusher is in-memory state saved periodically rather than on every change.
+type stateFlusher interface {
+	Flush()
+}
+
+// RunStateFlush saves each piece of state every 10s if it changed, and once more
+// on shutdown. Changes that must survive a crash (e.g. alarm open/close) are
+// saved immediately by their owners; this covers frequent, cheap-to-lose updates.
+func RunStateFlush(ctx context.Context, states ...stateFlusher) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	flush := func() {
+		for _, s := range states {
+			s.Flush()
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
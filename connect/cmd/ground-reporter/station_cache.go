@@ -1,6 +1,11 @@
 package main
 
-import "sync"
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
 
 // StationInfo holds the latest station data for a device, extracted from NB67 protocol fields.
 type StationInfo struct {
@@ -12,17 +17,28 @@ type StationInfo struct {
 // Lookup at alarm/life event time is always "best-effort": returns zero values when the cache
 // hasn't seen a parsed frame for this device yet (edge case at cold start).
 type StationCache struct {
-	mu    sync.RWMutex
-	cache map[string]StationInfo // deviceID → latest station info
+	mu         sync.RWMutex
+	cache      map[string]StationInfo // deviceID → latest station info
+	lastFrame  map[string]time.Time   // trainID → arrival time of its latest parsed frame
+	framesSeen bool                   // any parsed frame since startup
 }
 
 func newStationCache() *StationCache {
-	return &StationCache{cache: make(map[string]StationInfo)}
+	return &StationCache{
+		cache:     make(map[string]StationInfo),
+		lastFrame: make(map[string]time.Time),
+	}
 }
 
 // Update refreshes the station info for a device from a signal-parsed message's raw fields.
 // Keys "CurStation" and "NextStation" match the PascalCase field names of the Kaitai-generated Nb67 struct.
+// Every frame also refreshes the train's last-frame time used by the 6.6 heartbeat.
 func (c *StationCache) Update(msg ParsedMsg) {
+	c.mu.Lock()
+	c.lastFrame[strconv.Itoa(msg.TrainID)] = time.Now()
+	c.framesSeen = true
+	c.mu.Unlock()
+
 	cur := uint16(rawInt(msg.Raw, "CurStation"))
 	next := uint16(rawInt(msg.Raw, "NextStation"))
 	if cur == 0 && next == 0 {
@@ -39,3 +55,23 @@ func (c *StationCache) Get(deviceID string) StationInfo {
 	defer c.mu.RUnlock()
 	return c.cache[deviceID]
 }
+
+// LastFrames returns a copy of the last parsed-frame time per train. Trains
+// silent for longer than expire (0 = never) are taken as out of service
+// (stabled, in the depot, withdrawn) and forgotten until they send again.
+// anySeen reports whether any frame has arrived since startup.
+func (c *StationCache) LastFrames(expire time.Duration) (frames map[string]time.Time, anySeen bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	frames = make(map[string]time.Time, len(c.lastFrame))
+	for train, t := range c.lastFrame {
+		if expire > 0 && now.Sub(t) > expire {
+			delete(c.lastFrame, train)
+			log.Printf("[INFO] 6.6 health: train %s silent for %v, no longer monitored until it sends again", train, expire)
+			continue
+		}
+		frames[train] = t
+	}
+	return frames, c.framesSeen
+}
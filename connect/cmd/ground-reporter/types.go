@@ -14,10 +14,14 @@ type EventMeta struct {
 }
 
 // SubEventMsg is the top-level message on signal-alarm, signal-predict, signal-life.
+// Transition is "clear" when the device's hits dropped to zero (Hits is then empty).
+// Forecasts is only set on signal-life, hourly per device (Hits may then be empty).
 type SubEventMsg struct {
-	EventMeta EventMeta       `json:"event_meta"`
-	Hits      json.RawMessage `json:"hits"`
-	Source    string          `json:"source"`
+	EventMeta  EventMeta       `json:"event_meta"`
+	Hits       json.RawMessage `json:"hits"`
+	Source     string          `json:"source"`
+	Transition string          `json:"transition"`
+	Forecasts  []LifeForecast  `json:"forecasts"`
 }
 
 type AlarmHit struct {
@@ -38,6 +42,29 @@ type LifeHit struct {
 	Severity int    `json:"severity"`
 	Value    int64  `json:"value"` // seconds (fans/compressors) or counts (valves)
 	Limit    int64  `json:"limit"`
+	// Event builder's estimate (unix ms) of when Limit is reached, from its
+	// recent counter rate; 0 while it has too little history
+	LimitTime int64 `json:"limit_time"`
+}
+
+// LifeForecast is the event builder's rated life and forecast of one part,
+// sent for every part of a device, not only those past the warning level.
+type LifeForecast struct {
+	Code      string `json:"code"`
+	Value     int64  `json:"value"`      // seconds (fans/compressors) or counts (valves)
+	Limit     int64  `json:"limit"`      // configured rated life, same unit; 0 = life warnings disabled
+	LimitTime int64  `json:"limit_time"` // as LifeHit.LimitTime
+}
+
+// ReplacementHit is one entry on signal-replacement: a part counter dropped,
+// i.e. the part (or its controller) was replaced.
+type ReplacementHit struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Field    string `json:"field"`
+	Kind     string `json:"kind"`     // "fan" | "comp" (seconds) or "valve" (counts)
+	Previous int64  `json:"previous"` // counter before the drop
+	Current  int64  `json:"current"`  // counter after the drop
 }
 
 // ParsedMsg is a minimal view of signal-parsed used only for life cache population.
@@ -86,11 +113,12 @@ type LifeRecord67 struct {
 	TrainType    string `json:"trainType"`
 	TrainNo      string `json:"trainNo"`
 	PartCode     string `json:"partCode"`
-	ServiceTime  int64  `json:"serviceTime"`  // now ms
-	ServiceValue int64  `json:"serviceValue"` // cumulative count or hours
-	Mileage      int64  `json:"mileage"`      // always 0
-	UseTime      int64  `json:"useTime"`      // start-of-service ms; 0 if unknown
-	Flag         int    `json:"flag"`         // 2 = do not accumulate (send absolute value)
+	ServiceTime  int64  `json:"serviceTime"`         // now ms
+	ServiceValue int64  `json:"serviceValue"`        // cumulative count or hours
+	Mileage      int64  `json:"mileage"`             // km since installation (PartRegistry); 0 if no odometer
+	UseTime      int64  `json:"useTime"`             // start-of-service ms (PartRegistry); 0 if unknown
+	Flag         int    `json:"flag"`                // 2 = do not accumulate (send absolute value)
+	LimitTime    int64  `json:"limitTime,omitempty"` // forecast ms at which the rated life is reached; 0 if unknown
 }
 
 // rawInt safely extracts an integer from a map[string]any (JSON numbers are float64).
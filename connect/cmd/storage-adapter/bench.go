@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// benchDevicePrefix marks the synthetic rows written by runBench.
+const benchDevicePrefix = "bench-"
+
+// runBench writes n synthetic fact_raw records through each write mode, in
+// batches of BATCH_SIZE, against the configured database and logs the
+// throughput. Run with `storage-adapter -bench N`. A warm-up pass of each mode
+// fills caches and connections first; the measured runs then alternate
+// batch, copy, copy, batch so neither mode always runs on a warmer table, and
+// each mode's rate is the mean of its two runs. Messages are built before the
+// clock starts. The synthetic rows (device_id "bench-*") are deleted
+// afterwards, also when a run fails.
+func runBench(ctx context.Context, a *adapter, n int) error {
+	cfg := a.cfg
+	defer func() { a.cfg = cfg }()
+	defer func() {
+		tag, err := a.pool.Exec(context.Background(), `DELETE FROM hvac.fact_raw WHERE device_id LIKE $1 AND event_time >= NOW() - INTERVAL '2 hours'`,
+			benchDevicePrefix+"%")
+		if err != nil {
+			log.Printf("[ERROR] bench cleanup: %v", err)
+			return
+		}
+		log.Printf("[INFO] bench cleanup: deleted %d synthetic rows", tag.RowsAffected())
+	}()
+
+	warmup := max(n/10, min(n, cfg.BatchSize))
+	for _, mode := range []string{writeModeBatch, writeModeCopy} {
+		if _, err := benchRun(ctx, a, mode, "warmup", warmup); err != nil {
+			return err
+		}
+	}
+
+	took := map[string]time.Duration{}
+	for i, mode := range []string{writeModeBatch, writeModeCopy, writeModeCopy, writeModeBatch} {
+		d, err := benchRun(ctx, a, mode, fmt.Sprintf("r%d", i), n)
+		if err != nil {
+			return err
+		}
+		took[mode] += d
+	}
+	for _, mode := range []string{writeModeBatch, writeModeCopy} {
+		mean := took[mode] / 2
+		log.Printf("[INFO] bench mode=%s rows=%d batch=%d took=%v rate=%.0f rows/s (mean of 2 runs)",
+			mode, n, cfg.BatchSize, mean, float64(n)/mean.Seconds())
+	}
+	return nil
+}
+
+// benchRun builds n messages for one run, then times writing them in mode.
+// run keeps the device ids of each run apart, so no run hits another's rows.
+func benchRun(ctx context.Context, a *adapter, mode, run string, n int) (time.Duration, error) {
+	a.cfg.WriteMode = mode
+	base := time.Now().UTC().Add(-time.Hour)
+	msgs := make([]pendingMessage, n)
+	for i := range msgs {
+		msg, err := benchMessage(mode+"-"+run, i, base)
+		if err != nil {
+			return 0, fmt.Errorf("bench %s %s: %w", mode, run, err)
+		}
+		msgs[i] = msg
+	}
+
+	start := time.Now()
+	for len(msgs) > 0 {
+		size := min(a.cfg.BatchSize, len(msgs))
+		if err := a.flushBatch(ctx, msgs[:size]); err != nil {
+			return 0, fmt.Errorf("bench %s %s: %w", mode, run, err)
+		}
+		msgs = msgs[size:]
+	}
+	took := time.Since(start)
+	log.Printf("[INFO] bench run=%s mode=%s rows=%d took=%v", run, mode, n, took)
+	return took, nil
+}
+
+// benchMessage builds one synthetic signal-storage record: 6 carriages per
+// train at 1 Hz, with every mapped field filled. tag goes into the device id.
+func benchMessage(tag string, i int, base time.Time) (pendingMessage, error) {
+	raw := make(map[string]any, len(rawFields))
+	for _, f := range rawFields {
+		switch f.Kind {
+		case kindSmallint:
+			raw[f.Source] = 2
+		case kindNumeric:
+			raw[f.Source] = 250 + i%50
+		default:
+			raw[f.Source] = false
+		}
+	}
+	value, err := json.Marshal(map[string]any{
+		"event_time_text":  base.Add(time.Duration(i/6) * time.Second).Format(time.RFC3339Nano),
+		"event_time_valid": true,
+		"ingest_time":      time.Now().UTC().Format(time.RFC3339Nano),
+		"line_id":          7,
+		"train_id":         7001 + i/6%40,
+		"carriage_id":      i%6 + 1,
+		"device_id":        fmt.Sprintf("%s%s-%02d", benchDevicePrefix, tag, i%6+1),
+		"frame_no":         i,
+		"parser_version":   "bench",
+		"payload_json":     map[string]any{"raw": raw},
+	})
+	if err != nil {
+		return pendingMessage{}, err
+	}
+	rec, err := decodeStorage(value)
+	if err != nil {
+		return pendingMessage{}, fmt.Errorf("decode synthetic record %d: %w", i, err)
+	}
+	return pendingMessage{record: rec, msg: saramaMessage{inner: &sarama.ConsumerMessage{Value: value}}}, nil
+}
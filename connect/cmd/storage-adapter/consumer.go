@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -15,6 +14,7 @@ import (
 type adapter struct {
 	cfg  Config
 	pool *pgxpool.Pool
+	dlq  sarama.SyncProducer // DLQ_TOPIC: poison records (see deadletter.go)
 }
 
 type saramaMessage struct {
@@ -26,45 +26,79 @@ func (m saramaMessage) GetPartition() int32 { return m.inner.Partition }
 func (m saramaMessage) GetOffset() int64    { return m.inner.Offset }
 func (m saramaMessage) GetValue() []byte    { return m.inner.Value }
 
-const insertSQL = `
-INSERT INTO hvac.fact_raw (
-  event_time, ingest_time, process_time,
-  line_id, train_id, carriage_id, device_id, frame_no,
-  parser_version, quality_code, event_time_valid,
-  wmode_u1, wmode_u2,
-  f_cp_u11, f_cp_u12, f_cp_u21, f_cp_u22,
-  i_cp_u11, i_cp_u12, i_cp_u21, i_cp_u22,
-  suckp_u11, suckp_u12, suckp_u21, suckp_u22,
-  highpress_u11, highpress_u12, highpress_u21, highpress_u22,
-  fas_u1, fas_u2, ras_u1, ras_u2,
-  presdiff_u1, presdiff_u2,
-  aq_co2_u1, aq_co2_u2, aq_tvoc_u1, aq_tvoc_u2,
-  aq_pm2_5_u1, aq_pm2_5_u2, aq_pm10_u1, aq_pm10_u2,
-  bocflt_ef_u11, bocflt_ef_u12, bocflt_ef_u21, bocflt_ef_u22,
-  bocflt_cf_u11, bocflt_cf_u12, bocflt_cf_u21, bocflt_cf_u22,
-  blpflt_comp_u11, blpflt_comp_u12, blpflt_comp_u21, blpflt_comp_u22,
-  bscflt_comp_u11, bscflt_comp_u12, bscflt_comp_u21, bscflt_comp_u22,
-  bflt_tempover, bflt_diffpres_u1, bflt_diffpres_u2,
-  payload_json
-) VALUES (
-  $1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,
-  $12,$13,$14,$15,$16,$17,$18,$19,$20,$21,
-  $22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,
-  $36,$37,$38,$39,$40,$41,$42,$43,$44,$45,$46,$47,$48,$49,$50,
-  $51,$52,$53,$54,$55,$56,$57,$58,$59,$60,$61,$62,$63
+// fact_event keeps one row per episode: event_time is when the code first
+// appeared, last_seen_time/hit_count track the repeats, recovery_time is set
+// by resolveEventSQL when a frame no longer carries the code. The hypertable
+// cannot hold a unique index without event_time, so the open episode is found
+// with UPDATE (partial index ix_fact_event_open) and a new one inserted
+// otherwise; lockEventDevicesSQL serialises writers of the same device so two
+// transactions cannot both open one. Only a frame newer than last_seen_time
+// counts as a repeat, so a redelivered frame leaves the episode unchanged; a
+// frame redelivered after its episode was resolved falls inside that episode
+// (event_time..recovery_time) and does not open a new one.
+// Rows written before episodes (last_seen_time NULL) are left as they are.
+const upsertEventSQL = `
+WITH open_episode AS (
+    UPDATE hvac.fact_event
+    SET hit_count      = hit_count + CASE WHEN last_seen_time < $1::timestamptz THEN 1 ELSE 0 END,
+        severity       = CASE WHEN last_seen_time < $1::timestamptz THEN $10 ELSE severity END,
+        payload_json   = CASE WHEN last_seen_time < $1::timestamptz THEN $11 ELSE payload_json END,
+        ingest_time    = CASE WHEN last_seen_time < $1::timestamptz THEN $2 ELSE ingest_time END,
+        last_seen_time = GREATEST(last_seen_time, $1::timestamptz)
+    WHERE device_id = $6 AND event_type = $7 AND fault_code = $8
+      AND recovery_time IS NULL
+      AND last_seen_time IS NOT NULL
+    RETURNING 1
 )
-ON CONFLICT (device_id, event_time, ingest_time) DO NOTHING;
-`
-
-const insertEventSQL = `
 INSERT INTO hvac.fact_event (
     event_time, ingest_time, line_id, train_id, carriage_id, device_id,
-    event_type, fault_code, fault_name, severity, payload_json
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-ON CONFLICT (event_time, device_id, fault_code) DO UPDATE 
-SET ingest_time = EXCLUDED.ingest_time;
+    event_type, fault_code, fault_name, severity, payload_json,
+    status, last_seen_time, hit_count
+)
+SELECT $1::timestamptz, $2::timestamptz, $3::integer, $4::integer, $5::integer, $6::varchar,
+       $7::varchar, $8::varchar, $9::text, $10::smallint, $11::jsonb,
+       'open', $1::timestamptz, 1
+WHERE NOT EXISTS (SELECT 1 FROM open_episode)
+  AND NOT EXISTS (
+    SELECT 1 FROM hvac.fact_event
+    WHERE device_id = $6 AND event_type = $7 AND fault_code = $8
+      AND recovery_time IS NOT NULL
+      AND last_seen_time IS NOT NULL
+      AND event_time <= $1::timestamptz AND recovery_time >= $1::timestamptz
+  )
+ON CONFLICT (event_time, device_id, fault_code) DO NOTHING;
+`
+
+// resolveEventSQL ends the device's open episodes of an event type whose code
+// is not in the frame. Frames older than an episode's last repeat are ignored.
+const resolveEventSQL = `
+UPDATE hvac.fact_event
+SET recovery_time = $3, status = 'resolved'
+WHERE device_id = $1 AND event_type = $2
+  AND recovery_time IS NULL
+  AND last_seen_time <= $3
+  AND NOT (fault_code = ANY($4::text[]));
+`
+
+// lockEventDevicesSQL takes a transaction-scoped advisory lock per device of
+// the batch's event frames, in sorted order so concurrent batches cannot
+// deadlock. pgx runs a batch as one implicit transaction.
+const lockEventDevicesSQL = `
+SELECT pg_advisory_xact_lock(hashtext('hvac.fact_event:' || d))
+FROM (SELECT DISTINCT unnest($1::text[]) AS d ORDER BY 1) AS devices;
+`
+
+const insertPartHistorySQL = `
+INSERT INTO hvac.part_history (
+    replaced_at, line_id, train_id, carriage_id, device_id,
+    part_code, part_name, counter_field, counter_kind, previous_value, current_value, payload_json
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (device_id, part_code, replaced_at) DO NOTHING;
 `
 
+// replacementTopic carries part replacement events (counter drops) from the event builder.
+const replacementTopic = "signal-replacement"
+
 func (a *adapter) run(ctx context.Context) error {
 	kcfg := sarama.NewConfig()
 	kcfg.Version = sarama.V2_6_0_0
@@ -78,6 +112,15 @@ func (a *adapter) run(ctx context.Context) error {
 	}
 	defer group.Close()
 
+	pcfg := sarama.NewConfig()
+	pcfg.Version = sarama.V2_6_0_0
+	pcfg.Producer.RequiredAcks = sarama.WaitForAll
+	pcfg.Producer.Return.Successes = true
+	if a.dlq, err = sarama.NewSyncProducer(a.cfg.KafkaBrokers, pcfg); err != nil {
+		return fmt.Errorf("create dead-letter producer: %w", err)
+	}
+	defer a.dlq.Close()
+
 	handler := &consumerGroupHandler{adapter: a}
 	go func() {
 		for err := range group.Errors() {
@@ -111,18 +154,35 @@ func (h *consumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, cl
 	ticker := time.NewTicker(h.adapter.cfg.FlushInterval)
 	defer ticker.Stop()
 
+	// flush writes the batch, dead-lettering poison records, and keeps the
+	// unwritten rest on database errors, retrying it with backoff so the
+	// partition neither skips nor reorders records.
 	flush := func() {
-		if len(batch) == 0 {
-			return
-		}
-		if err := h.adapter.flushBatch(sess.Context(), batch); err != nil {
-			log.Printf("[ERROR] flush failed: %v", err)
-			return
+		backoff := retryBackoffMin
+		for len(batch) > 0 {
+			done, err := h.adapter.flushIsolating(sess.Context(), batch)
+			for _, item := range batch[:done] {
+				sess.MarkMessage(item.msg.inner, "")
+			}
+			batch = append(batch[:0], batch[done:]...)
+			if err == nil || sess.Context().Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] flush failed, retrying %d records in %v: %v", len(batch), backoff, err)
+			if !sleepCtx(sess.Context(), backoff) {
+				return
+			}
+			backoff = min(backoff*2, retryBackoffMax)
 		}
-		for _, item := range batch {
-			sess.MarkMessage(item.msg.inner, "")
+	}
+
+	// reject dead-letters a message that cannot be decoded. The batch is
+	// flushed first so marking msg does not commit past unwritten records.
+	reject := func(msg *sarama.ConsumerMessage, err error) {
+		flush()
+		if len(batch) == 0 && h.adapter.deadLetter(sess.Context(), msg, err) {
+			sess.MarkMessage(msg, "")
 		}
-		batch = batch[:0]
 	}
 
 	for {
@@ -143,53 +203,26 @@ func (h *consumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, cl
 				log.Printf("[DEBUG] received msg from topic=%s partition=%d offset=%d", msg.Topic, msg.Partition, msg.Offset)
 			}
 
-			isEventTopic := msg.Topic == "signal-alarm" || msg.Topic == "signal-predict" || msg.Topic == "signal-life"
+			eventType, isEventTopic := eventTypes[msg.Topic]
 
-			if isEventTopic {
-				var ev EventRecord
-				if err := json.Unmarshal(msg.Value, &ev); err != nil {
-					log.Printf("[WARN] invalid event json topic=%s err=%v", msg.Topic, err)
-					sess.MarkMessage(msg, "")
+			if msg.Topic == replacementTopic {
+				rows, err := decodeReplacement(msg.Value)
+				if err != nil {
+					reject(msg, err)
 					continue
 				}
-
-				eventType := "alarm"
-				if msg.Topic == "signal-predict" {
-					eventType = "predict"
-				} else if msg.Topic == "signal-life" {
-					eventType = "life"
-				}
-
-				flats := make([]EventFlatRecord, 0, len(ev.Hits))
-				for _, hit := range ev.Hits {
-					sev := hit.Severity
-					if hit.Level != nil {
-						sev = *hit.Level
-					}
-
-					// 为了方便以后分析，payload_json 包含原始 hit 信息
-					payload, _ := json.Marshal(hit)
-
-					flats = append(flats, EventFlatRecord{
-						EventTime:  hit.EventMeta.EventTimeText,
-						IngestTime: time.Now().Format(time.RFC3339),
-						LineID:     hit.EventMeta.LineID,
-						TrainID:    hit.EventMeta.TrainID,
-						CarriageID: hit.EventMeta.CarriageID,
-						DeviceID:   hit.EventMeta.DeviceID,
-						EventType:  eventType,
-						FaultCode:  hit.Code,
-						FaultName:  hit.Name,
-						Severity:   sev,
-						Payload:    payload,
-					})
+				batch = append(batch, pendingMessage{record: rows, msg: saramaMessage{inner: msg}})
+			} else if isEventTopic {
+				frame, err := decodeEvent(msg.Value, eventType)
+				if err != nil {
+					reject(msg, err)
+					continue
 				}
-				batch = append(batch, pendingMessage{isEvent: true, record: flats, msg: saramaMessage{inner: msg}})
+				batch = append(batch, pendingMessage{isEvent: true, record: frame, msg: saramaMessage{inner: msg}})
 			} else {
-				var record StorageRecord
-				if err := json.Unmarshal(msg.Value, &record); err != nil {
-					log.Printf("[WARN] invalid storage json topic=%s err=%v", msg.Topic, err)
-					sess.MarkMessage(msg, "")
+				record, err := decodeStorage(msg.Value)
+				if err != nil {
+					reject(msg, err)
 					continue
 				}
 				batch = append(batch, pendingMessage{isEvent: false, record: record, msg: saramaMessage{inner: msg}})
@@ -207,43 +240,73 @@ func (a *adapter) flushBatch(ctx context.Context, batch []pendingMessage) error
 	defer cancel()
 
 	pgBatch := &pgx.Batch{}
+	copyMode := a.cfg.WriteMode == writeModeCopy
+	var rawRows [][]any // copy mode: fact_raw rows for COPY instead of the batch
 	totalRaw := 0
 	totalEvents := 0
+	totalParts := 0
+
+	// Event devices first, so their episode statements run under the device lock.
+	var devices []string
+	for _, item := range batch {
+		if frame, ok := item.record.(EventFrame); ok && item.isEvent {
+			devices = append(devices, frame.DeviceID)
+		}
+	}
+	if len(devices) > 0 {
+		pgBatch.Queue(lockEventDevicesSQL, devices)
+	}
 
 	for _, item := range batch {
-		if item.isEvent {
-			flats := item.record.([]EventFlatRecord)
-			for _, f := range flats {
-				args, _ := f.toEventInsertArgs()
-				pgBatch.Queue(insertEventSQL, args...)
-				totalEvents++
+		if rows, ok := item.record.([]PartHistoryRecord); ok {
+			for _, r := range rows {
+				pgBatch.Queue(insertPartHistorySQL, r.toPartHistoryInsertArgs()...)
+				totalParts++
 			}
+		} else if item.isEvent {
+			frame := item.record.(EventFrame)
+			for _, st := range frame.episodeStatements() {
+				pgBatch.Queue(st.sql, st.args...)
+			}
+			totalEvents += len(frame.Hits)
 		} else {
 			record := item.record.(StorageRecord)
-			args, err := record.toInsertArgs(item.msg.inner.Value)
-			if err != nil {
-				continue
+			args := record.toInsertArgs()
+			if copyMode {
+				rawRows = append(rawRows, args)
+			} else {
+				pgBatch.Queue(insertSQL, args...)
 			}
-			pgBatch.Queue(insertSQL, args...)
 			totalRaw++
 		}
 	}
 
-	totalCount := totalRaw + totalEvents
-	if totalCount == 0 {
+	queued := pgBatch.Len()
+	if totalRaw+queued == 0 {
 		return nil
 	}
 
 	start := time.Now()
-	batchResult := a.pool.SendBatch(txCtx, pgBatch)
-	defer batchResult.Close()
-
-	for i := 0; i < totalCount; i++ {
-		if _, err := batchResult.Exec(); err != nil {
-			return fmt.Errorf("exec batch insert: %w", err)
+	if copyMode {
+		if err := a.flushCopy(txCtx, rawRows, pgBatch); err != nil {
+			return err
 		}
+	} else if err := execBatch(a.pool.SendBatch(txCtx, pgBatch), queued); err != nil {
+		return err
 	}
 
-	log.Printf("[INFO] flushed batch: raw=%d events=%d took=%v", totalRaw, totalEvents, time.Since(start))
+	log.Printf("[INFO] flushed batch: mode=%s raw=%d events=%d parts=%d took=%v",
+		a.cfg.WriteMode, totalRaw, totalEvents, totalParts, time.Since(start))
 	return nil
 }
+
+// execBatch reads the results of n queued statements and closes the batch.
+func execBatch(results pgx.BatchResults, n int) error {
+	defer results.Close()
+	for i := 0; i < n; i++ {
+		if _, err := results.Exec(); err != nil {
+			return fmt.Errorf("exec batch insert: %w", err)
+		}
+	}
+	return results.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Write modes for fact_raw (WRITE_MODE).
+const (
+	writeModeBatch = "batch" // one INSERT ... ON CONFLICT per record in a pgx.Batch
+	writeModeCopy  = "copy"  // COPY into a staging table, then one INSERT ... SELECT
+)
+
+// The staging table is a per-session temp table emptied at commit, so pooled
+// connections create it once and COPY never sees another flush's rows.
+const createStageSQL = `
+CREATE TEMP TABLE IF NOT EXISTS fact_raw_stage
+    (LIKE hvac.fact_raw INCLUDING DEFAULTS) ON COMMIT DELETE ROWS;
+`
+
+// mergeStageSQL keeps the dedup of the batch path: rows whose
+// (device_id, event_time, ingest_time) already exist are skipped.
+var mergeStageSQL = fmt.Sprintf(`
+INSERT INTO hvac.fact_raw (%[1]s)
+SELECT %[1]s FROM fact_raw_stage
+ON CONFLICT (device_id, event_time, ingest_time) DO NOTHING;
+`, strings.Join(rawColumns, ", "))
+
+// flushCopy writes fact_raw rows by COPY + merge and runs the remaining
+// statements (events, part history) in the same transaction, so a failed
+// flush leaves nothing behind and the redelivered batch is applied once.
+func (a *adapter) flushCopy(ctx context.Context, rawRows [][]any, rest *pgx.Batch) error {
+	tx, err := a.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin copy transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if len(rawRows) > 0 {
+		if _, err := tx.Exec(ctx, createStageSQL); err != nil {
+			return fmt.Errorf("create staging table: %w", err)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"fact_raw_stage"}, rawColumns, pgx.CopyFromRows(rawRows)); err != nil {
+			return fmt.Errorf("copy into staging table: %w", err)
+		}
+		if _, err := tx.Exec(ctx, mergeStageSQL); err != nil {
+			return fmt.Errorf("merge staging table: %w", err)
+		}
+	}
+	if n := rest.Len(); n > 0 {
+		if err := execBatch(tx.SendBatch(ctx, rest), n); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit copy transaction: %w", err)
+	}
+	return nil
+}
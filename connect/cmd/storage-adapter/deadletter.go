@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Poison-message isolation.
+//
+// flushBatch writes a batch atomically (one implicit transaction in batch
+// mode, an explicit one in copy mode), so a single bad record fails the whole
+// batch. A batch that fails with a record error is split in halves until the
+// failing records are alone; those are published to DLQ_TOPIC with the error
+// text and the rest is written. Any other error (connection, timeout, server
+// shutdown, lock or serialization failure) keeps the batch and is retried
+// with backoff, without touching the dead-letter topic.
+
+const (
+	retryBackoffMin = time.Second
+	retryBackoffMax = 30 * time.Second
+)
+
+// isRecordError reports whether err is caused by the data of the records
+// rather than by the database: a data exception (SQLSTATE class 22, e.g.
+// numeric field overflow), an integrity constraint violation (class 23), or a
+// value pgx could not encode.
+func isRecordError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return strings.Contains(err.Error(), "failed to encode")
+}
+
+// flushIsolating writes batch, dead-lettering the records that fail on their
+// own. It returns how many leading records are done (written or
+// dead-lettered) and the error that stopped it, if any.
+func (a *adapter) flushIsolating(ctx context.Context, batch []pendingMessage) (int, error) {
+	err := a.flushBatch(ctx, batch)
+	switch {
+	case err == nil:
+		return len(batch), nil
+	case !isRecordError(err):
+		return 0, err
+	case len(batch) == 1:
+		if !a.deadLetter(ctx, batch[0].msg.inner, err) {
+			return 0, ctx.Err()
+		}
+		return 1, nil
+	}
+
+	mid := len(batch) / 2
+	done, err := a.flushIsolating(ctx, batch[:mid])
+	if err != nil {
+		return done, err
+	}
+	rest, err := a.flushIsolating(ctx, batch[mid:])
+	return mid + rest, err
+}
+
+// deadLetter publishes msg to the dead-letter topic with the failure reason in
+// the headers, retrying every 5s until it is stored. It returns false only
+// when ctx is cancelled first; the message is then left uncommitted.
+func (a *adapter) deadLetter(ctx context.Context, msg *sarama.ConsumerMessage, cause error) bool {
+	out := &sarama.ProducerMessage{
+		Topic: a.cfg.DLQTopic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("error"), Value: []byte(cause.Error())},
+			{Key: []byte("source_topic"), Value: []byte(msg.Topic)},
+			{Key: []byte("source_partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte("source_offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		},
+	}
+	for {
+		_, _, err := a.dlq.SendMessage(out)
+		if err == nil {
+			log.Printf("[WARN] %s[%d]@%d: moved to %s: %v", msg.Topic, msg.Partition, msg.Offset, a.cfg.DLQTopic, cause)
+			return true
+		}
+		log.Printf("[ERROR] %s[%d]@%d: publish to %s failed, retrying in 5s: %v", msg.Topic, msg.Partition, msg.Offset, a.cfg.DLQTopic, err)
+		if !sleepCtx(ctx, 5*time.Second) {
+			return false
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
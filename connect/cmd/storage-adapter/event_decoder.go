@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The event builder (connect-nb67) publishes one SubEvent per device frame and
+// topic: event_meta at the top level, the hit list, and the rule source.
+// event_meta.schema_version selects the decoder, so a schema change on the
+// producer side shows up as an unsupported version instead of rows with empty
+// device ids and zero line/train/carriage ids.
+
+// SubEventMeta is the top-level event_meta of a SubEvent. line_id and train_id
+// are strings in this schema.
+type SubEventMeta struct {
+	SchemaVersion string `json:"schema_version"`
+	LineID        string `json:"line_id"`
+	TrainID       string `json:"train_id"`
+	CarriageID    int32  `json:"carriage_id"`
+	DeviceID      string `json:"device_id"`
+	EventTimeText string `json:"event_time_text"`
+	IngestTime    string `json:"ingest_time"`
+	ProcessTime   string `json:"process_time"`
+	ConfigVersion string `json:"config_version"`
+}
+
+// SubEvent is a message on signal-alarm, signal-predict or signal-life.
+// Transition is "clear" when the device's hits dropped to zero (Hits is then empty).
+// A life event may also carry the builder's hourly part forecasts (ignored here);
+// its Hits are still the frame's complete life hits, possibly none.
+type SubEvent struct {
+	EventMeta  SubEventMeta    `json:"event_meta"`
+	Hits       json.RawMessage `json:"hits"`
+	Source     string          `json:"source"`
+	Transition string          `json:"transition"`
+}
+
+// EventHit is the union of PredictHit (severity), AlarmHit (level) and
+// LifeHit (severity, value, limit).
+type EventHit struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Severity *int16 `json:"severity,omitempty"`
+	Level    *int16 `json:"level,omitempty"` // alarm: 1=严重 2=一般
+	Value    *int64 `json:"value,omitempty"` // life: cumulative seconds or counts
+	Limit    *int64 `json:"limit,omitempty"` // life: rated life, same unit
+}
+
+// eventPayload is stored in fact_event.payload_json: the hit plus its origin.
+type eventPayload struct {
+	EventHit
+	Source        string `json:"source,omitempty"`
+	SchemaVersion string `json:"schema_version"`
+	ConfigVersion string `json:"config_version,omitempty"`
+}
+
+// EventFrame is one decoded event message: the hits of one device frame for one
+// event type. Codes of the device's open episodes that are not among Hits end
+// at EventTime (see episodeStatements); a "clear" message has no hits.
+type EventFrame struct {
+	DeviceID  string
+	EventType string
+	EventTime string
+	Hits      []EventFlatRecord
+}
+
+// eventDecoder turns one event message into an event frame.
+type eventDecoder func(data []byte, eventType string) (EventFrame, error)
+
+// eventDecoders maps event_meta.schema_version to its decoder. Add an entry
+// (and keep the old one while producers roll over) when the schema changes.
+var eventDecoders = map[string]eventDecoder{
+	"nb67.event": decodeSubEventV1,
+}
+
+// eventTypes maps event topics to fact_event.event_type.
+var eventTypes = map[string]string{
+	"signal-alarm":   "alarm",
+	"signal-predict": "predict",
+	"signal-life":    "life",
+}
+
+// decodeEvent picks the decoder by schema_version.
+func decodeEvent(data []byte, eventType string) (EventFrame, error) {
+	version, err := eventSchemaVersion(data)
+	if err != nil {
+		return EventFrame{}, err
+	}
+	return eventDecoders[version](data, eventType)
+}
+
+// eventSchemaVersion reads event_meta.schema_version and checks that a decoder exists.
+func eventSchemaVersion(data []byte) (string, error) {
+	var head struct {
+		EventMeta struct {
+			SchemaVersion string `json:"schema_version"`
+		} `json:"event_meta"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return "", fmt.Errorf("invalid json: %w", err)
+	}
+	version := head.EventMeta.SchemaVersion
+	if _, ok := eventDecoders[version]; !ok {
+		return "", fmt.Errorf("unsupported event schema_version %q", version)
+	}
+	return version, nil
+}
+
+// decodeSubEventV1 decodes schema "nb67.event".
+func decodeSubEventV1(data []byte, eventType string) (EventFrame, error) {
+	var ev SubEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return EventFrame{}, fmt.Errorf("invalid json: %w", err)
+	}
+	meta := ev.EventMeta
+	lineID, trainID, err := meta.ids()
+	if err != nil {
+		return EventFrame{}, err
+	}
+	if meta.EventTimeText == "" {
+		return EventFrame{}, fmt.Errorf("event_meta.event_time_text is empty")
+	}
+
+	var hits []EventHit
+	if len(ev.Hits) > 0 && string(ev.Hits) != "null" {
+		if err := json.Unmarshal(ev.Hits, &hits); err != nil {
+			return EventFrame{}, fmt.Errorf("invalid hits: %w", err)
+		}
+	}
+
+	ingestTime := meta.IngestTime
+	if ingestTime == "" {
+		ingestTime = time.Now().Format(time.RFC3339)
+	}
+
+	flats := make([]EventFlatRecord, 0, len(hits))
+	for _, hit := range hits {
+		if hit.Code == "" {
+			return EventFrame{}, fmt.Errorf("hit without code")
+		}
+		var sev int16
+		if hit.Severity != nil {
+			sev = *hit.Severity
+		}
+		if hit.Level != nil {
+			sev = *hit.Level
+		}
+
+		// 为了方便以后分析，payload_json 包含原始 hit 信息及其来源
+		payload, _ := json.Marshal(eventPayload{
+			EventHit:      hit,
+			Source:        ev.Source,
+			SchemaVersion: meta.SchemaVersion,
+			ConfigVersion: meta.ConfigVersion,
+		})
+
+		flats = append(flats, EventFlatRecord{
+			EventTime:  meta.EventTimeText,
+			IngestTime: ingestTime,
+			LineID:     lineID,
+			TrainID:    trainID,
+			CarriageID: meta.CarriageID,
+			DeviceID:   meta.DeviceID,
+			EventType:  eventType,
+			FaultCode:  hit.Code,
+			FaultName:  hit.Name,
+			Severity:   sev,
+			Payload:    payload,
+		})
+	}
+	return EventFrame{DeviceID: meta.DeviceID, EventType: eventType, EventTime: meta.EventTimeText, Hits: flats}, nil
+}
+
+// ids validates the device id and converts the string line/train ids.
+func (m SubEventMeta) ids() (lineID, trainID int32, err error) {
+	if m.DeviceID == "" {
+		return 0, 0, fmt.Errorf("event_meta.device_id is empty")
+	}
+	line, err := strconv.ParseInt(m.LineID, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("event_meta.line_id %q: %w", m.LineID, err)
+	}
+	train, err := strconv.ParseInt(m.TrainID, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("event_meta.train_id %q: %w", m.TrainID, err)
+	}
+	return int32(line), int32(train), nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fact_raw column mapping.
+//
+// rawFields is the one list of the typed sensor columns of hvac.fact_raw: for
+// each column, the decoded frame field it is read from (the codec field name
+// under payload_json.raw, i.e. the Kaitai id of NB67.ksy in Go case), its SQL
+// type and the scale applied to numeric values. Decoding, the INSERT and COPY
+// column lists and the Redpanda Connect writer mappings are
+// derived from it (the writer configs by `go generate`, see mappingSections),
+// so a new typed column needs a migration and one entry here.
+// The envelope columns (times, ids, parser metadata) and payload_json are fixed.
+
+// fieldKind is the SQL type of a mapped column.
+type fieldKind int
+
+const (
+	kindSmallint fieldKind = iota // SMALLINT
+	kindNumeric                   // NUMERIC, raw value × Scale
+	kindBoolean                   // BOOLEAN
+)
+
+type rawField struct {
+	Column string // hvac.fact_raw column, also the flat key on signal-storage
+	Source string // field under payload_json.raw
+	Kind   fieldKind
+	Scale  float64 // numeric: column = raw × Scale
+}
+
+func smallint(column, source string) rawField {
+	return rawField{Column: column, Source: source, Kind: kindSmallint, Scale: 1}
+}
+
+func numeric(column, source string, scale float64) rawField {
+	return rawField{Column: column, Source: source, Kind: kindNumeric, Scale: scale}
+}
+
+func boolean(column, source string) rawField {
+	return rawField{Column: column, Source: source, Kind: kindBoolean, Scale: 1}
+}
+
+// rawFields are stored unscaled so far (temperatures in 0.1 ℃, as the rules
+// and warning_config thresholds expect); keep Scale 1 for existing columns.
+var rawFields = []rawField{
+	smallint("wmode_u1", "WmodeU1"), smallint("wmode_u2", "WmodeU2"),
+
+	numeric("f_cp_u11", "FCpU11", 1), numeric("f_cp_u12", "FCpU12", 1),
+	numeric("f_cp_u21", "FCpU21", 1), numeric("f_cp_u22", "FCpU22", 1),
+	numeric("i_cp_u11", "ICpU11", 1), numeric("i_cp_u12", "ICpU12", 1),
+	numeric("i_cp_u21", "ICpU21", 1), numeric("i_cp_u22", "ICpU22", 1),
+	numeric("suckp_u11", "SuckpU11", 1), numeric("suckp_u12", "SuckpU12", 1),
+	numeric("suckp_u21", "SuckpU21", 1), numeric("suckp_u22", "SuckpU22", 1),
+	numeric("highpress_u11", "HighpressU11", 1), numeric("highpress_u12", "HighpressU12", 1),
+	numeric("highpress_u21", "HighpressU21", 1), numeric("highpress_u22", "HighpressU22", 1),
+
+	numeric("fas_u1", "FasU1", 1), numeric("fas_u2", "FasU2", 1),
+	numeric("ras_u1", "RasU1", 1), numeric("ras_u2", "RasU2", 1),
+	numeric("presdiff_u1", "PresdiffU1", 1), numeric("presdiff_u2", "PresdiffU2", 1),
+	numeric("aq_co2_u1", "AqCo2U1", 1), numeric("aq_co2_u2", "AqCo2U2", 1),
+	numeric("aq_tvoc_u1", "AqTvocU1", 1), numeric("aq_tvoc_u2", "AqTvocU2", 1),
+	numeric("aq_pm2_5_u1", "AqPm25U1", 1), numeric("aq_pm2_5_u2", "AqPm25U2", 1),
+	numeric("aq_pm10_u1", "AqPm10U1", 1), numeric("aq_pm10_u2", "AqPm10U2", 1),
+
+	boolean("bocflt_ef_u11", "BocfltEfU11"), boolean("bocflt_ef_u12", "BocfltEfU12"),
+	boolean("bocflt_ef_u21", "BocfltEfU21"), boolean("bocflt_ef_u22", "BocfltEfU22"),
+	boolean("bocflt_cf_u11", "BocfltCfU11"), boolean("bocflt_cf_u12", "BocfltCfU12"),
+	boolean("bocflt_cf_u21", "BocfltCfU21"), boolean("bocflt_cf_u22", "BocfltCfU22"),
+	boolean("blpflt_comp_u11", "BlpfltCompU11"), boolean("blpflt_comp_u12", "BlpfltCompU12"),
+	boolean("blpflt_comp_u21", "BlpfltCompU21"), boolean("blpflt_comp_u22", "BlpfltCompU22"),
+	boolean("bscflt_comp_u11", "BscfltCompU11"), boolean("bscflt_comp_u12", "BscfltCompU12"),
+	boolean("bscflt_comp_u21", "BscfltCompU21"), boolean("bscflt_comp_u22", "BscfltCompU22"),
+	boolean("bflt_tempover", "BfltTempover"),
+	boolean("bflt_diffpres_u1", "BfltDiffpresU1"), boolean("bflt_diffpres_u2", "BfltDiffpresU2"),
+}
+
+// envelopeColumns are the fact_raw columns taken from the signal-storage
+// envelope, in toInsertArgs order.
+var envelopeColumns = []string{
+	"event_time", "ingest_time", "process_time",
+	"line_id", "train_id", "carriage_id", "device_id", "frame_no",
+	"parser_version", "quality_code", "event_time_valid",
+}
+
+// rawColumns lists the fact_raw columns in toInsertArgs order: the envelope,
+// the mapped fields, payload_json.
+var rawColumns = func() []string {
+	cols := append([]string{}, envelopeColumns...)
+	for _, f := range rawFields {
+		cols = append(cols, f.Column)
+	}
+	return append(cols, "payload_json")
+}()
+
+var insertSQL = func() string {
+	params := make([]string, len(rawColumns))
+	for i := range params {
+		params[i] = "$" + strconv.Itoa(i+1)
+	}
+	return fmt.Sprintf(`
+INSERT INTO hvac.fact_raw (%s)
+VALUES (%s)
+ON CONFLICT (device_id, event_time, ingest_time) DO NOTHING;
+`, strings.Join(rawColumns, ", "), strings.Join(params, ","))
+}()
+
+// value converts a JSON value into the column value; null or absent is nil.
+// scale is the field's Scale for raw values and 1 for flat keys, which the
+// writers already scaled.
+func (f rawField) value(v json.RawMessage, scale float64) (any, error) {
+	s := string(bytes.TrimSpace(v))
+	if s == "" || s == "null" {
+		return nil, nil
+	}
+	switch f.Kind {
+	case kindSmallint:
+		n, err := strconv.ParseInt(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Column, err)
+		}
+		return int16(n), nil
+	case kindNumeric:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Column, err)
+		}
+		return x * scale, nil
+	default:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Column, err)
+		}
+		return b, nil
+	}
+}
+
+// Generated sections of the Redpanda Connect writers. Each sits between a
+// "rawFields:begin" and a "rawFields:end" marker line (a Bloblang "#" or an SQL
+// "--" comment, whichever the surrounding text is) and is rewritten from
+// rawFields by `go generate` (storage-adapter -write-mapping); -check-mapping
+// fails when a config no longer matches.
+//
+//go:generate go run . -write-mapping ../../config ../../../dist/config
+
+// pgWriterEnvelope are the columns nb67-pg-writer.yaml inserts ahead of the
+// mapped fields, in its args_mapping order.
+var pgWriterEnvelope = []string{
+	"event_time", "ingest_time", "process_time", "event_time_valid",
+	"line_id", "train_id", "carriage_id", "device_id", "frame_no",
+	"parser_version", "quality_code",
+}
+
+// mappingSection is one generated section: the nth (0-based) marked block of file.
+type mappingSection struct {
+	file   string
+	nth    int
+	render func() []string // lines without the block's indentation
+}
+
+var mappingSections = []mappingSection{
+	// nb67-storage-writer.yaml: pipeline.processors[0].mapping
+	{"nb67-storage-writer.yaml", 0, func() []string {
+		lines := make([]string, 0, len(rawFields))
+		for _, f := range rawFields {
+			src := "this.raw." + f.Source
+			if f.Kind == kindNumeric && f.Scale != 1 {
+				src = fmt.Sprintf("(%s * %s).catch(null)", src, strconv.FormatFloat(f.Scale, 'g', -1, 64))
+			}
+			lines = append(lines, fmt.Sprintf("%q: %s,", f.Column, src))
+		}
+		return lines
+	}},
+	// nb67-pg-writer.yaml: output.sql_raw.query columns and VALUES placeholders
+	{"nb67-pg-writer.yaml", 0, func() []string {
+		cols := append([]string{}, pgWriterEnvelope...)
+		for _, f := range rawFields {
+			cols = append(cols, f.Column)
+		}
+		cols = append(cols, "payload_json")
+		params := make([]string, len(cols))
+		for i := range params {
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+		lines := []string{"INSERT INTO hvac.fact_raw ("}
+		lines = append(lines, wrapList(cols, 4, "  ")...)
+		lines = append(lines, ") VALUES (")
+		lines = append(lines, wrapList(params, 10, "  ")...)
+		return append(lines, ") ON CONFLICT (device_id, event_time, ingest_time) DO NOTHING;")
+	}},
+	// nb67-pg-writer.yaml: output.sql_raw.args_mapping
+	{"nb67-pg-writer.yaml", 1, func() []string {
+		lines := make([]string, 0, len(rawFields))
+		for _, f := range rawFields {
+			lines = append(lines, "this."+f.Column+",")
+		}
+		return lines
+	}},
+}
+
+// wrapList joins items with ", ", n per line.
+func wrapList(items []string, n int, indent string) []string {
+	var lines []string
+	for i := 0; i < len(items); i += n {
+		line := indent + strings.Join(items[i:min(i+n, len(items))], ", ")
+		if i+n < len(items) {
+			line += ","
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// renderMapping returns the config text with its generated sections rewritten.
+func renderMapping(name string, text string) (string, error) {
+	lines := strings.Split(text, "\n")
+	var out []string
+	block := 0
+	for i := 0; i < len(lines); i++ {
+		out = append(out, lines[i])
+		if !strings.HasSuffix(strings.TrimSpace(lines[i]), "rawFields:begin") {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && !strings.HasSuffix(strings.TrimSpace(lines[end]), "rawFields:end") {
+			end++
+		}
+		if end == len(lines) {
+			return "", fmt.Errorf("%s: rawFields:begin on line %d has no rawFields:end", name, i+1)
+		}
+		var sec *mappingSection
+		for j := range mappingSections {
+			if mappingSections[j].file == name && mappingSections[j].nth == block {
+				sec = &mappingSections[j]
+			}
+		}
+		if sec == nil {
+			return "", fmt.Errorf("%s: unexpected generated section %d on line %d", name, block, i+1)
+		}
+		indent := lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " "))]
+		for _, l := range sec.render() {
+			out = append(out, indent+l)
+		}
+		i = end - 1
+		block++
+	}
+	for _, sec := range mappingSections {
+		if sec.file == name && sec.nth >= block {
+			return "", fmt.Errorf("%s: generated section %d not found", name, sec.nth)
+		}
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// mappingFiles lists the writer configs that carry generated sections.
+func mappingFiles() []string {
+	var names []string
+	for _, sec := range mappingSections {
+		if !slices.Contains(names, sec.file) {
+			names = append(names, sec.file)
+		}
+	}
+	return names
+}
+
+// syncMapping rewrites (write) or compares the generated sections of the
+// writer configs in each directory, and returns the files that differ.
+func syncMapping(dirs []string, write bool) (stale []string, err error) {
+	for _, dir := range dirs {
+		for _, name := range mappingFiles() {
+			path := filepath.Join(dir, name)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			text, err := renderMapping(name, string(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if text == string(data) {
+				continue
+			}
+			stale = append(stale, path)
+			if write {
+				if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return stale, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -12,6 +13,28 @@ import (
 )
 
 func main() {
+	bench := flag.Int("bench", 0, "write N synthetic fact_raw rows with each WRITE_MODE, report throughput and exit")
+	writeMap := flag.Bool("write-mapping", false, "rewrite the rawFields sections of the Redpanda Connect writer configs in the given directories and exit")
+	checkMap := flag.Bool("check-mapping", false, "exit 1 if the rawFields sections of the writer configs in the given directories are out of date")
+	flag.Parse()
+	if *writeMap || *checkMap {
+		stale, err := syncMapping(flag.Args(), *writeMap)
+		if err != nil {
+			log.Fatalf("field mapping: %v", err)
+		}
+		for _, path := range stale {
+			if *writeMap {
+				log.Printf("[INFO] field mapping: rewrote %s", path)
+			} else {
+				log.Printf("[ERROR] field mapping: %s is out of date with rawFields, run go generate", path)
+			}
+		}
+		if *checkMap && len(stale) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	cfg := loadConfig()
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
@@ -26,6 +49,12 @@ func main() {
 		cfg:  cfg,
 		pool: pool,
 	}
+	if *bench > 0 {
+		if err := runBench(ctx, service, *bench); err != nil {
+			log.Fatalf("benchmark failed: %v", err)
+		}
+		return
+	}
 	if err := service.run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatalf("storage-adapter stopped with error: %v", err)
 	}
@@ -6,20 +6,55 @@ import (
 	"time"
 )
 
-func (r *StorageRecord) toInsertArgs(rawValue []byte) ([]any, error) {
+// decodeStorage decodes a signal-storage message. Mapped columns are read from
+// payload_json.raw (the message itself when payload_json is absent); a field
+// missing there falls back to the column's flat key on the message.
+func decodeStorage(data []byte) (StorageRecord, error) {
+	var r StorageRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("invalid storage json: %w", err)
+	}
+	if len(r.PayloadJSON) == 0 {
+		r.PayloadJSON = append(r.PayloadJSON, data...)
+	}
+
+	// payload_json without a raw object leaves Raw empty: flat keys only
+	var payload struct {
+		Raw map[string]json.RawMessage `json:"raw"`
+	}
+	_ = json.Unmarshal(r.PayloadJSON, &payload)
+
+	var flat map[string]json.RawMessage // parsed on the first miss
+	r.Values = make([]any, len(rawFields))
+	for i, f := range rawFields {
+		v, ok := payload.Raw[f.Source]
+		scale := f.Scale
+		if !ok {
+			if flat == nil {
+				if err := json.Unmarshal(data, &flat); err != nil {
+					return r, fmt.Errorf("invalid storage json: %w", err)
+				}
+			}
+			v, scale = flat[f.Column], 1
+		}
+		value, err := f.value(v, scale)
+		if err != nil {
+			return r, err
+		}
+		r.Values[i] = value
+	}
+	return r, nil
+}
+
+// toInsertArgs returns the fact_raw row in rawColumns order.
+func (r *StorageRecord) toInsertArgs() []any {
 	now := time.Now().UTC()
 	eventTime, eventTimeValid := parseEventTime(r.EventTimeText, r.EventTimeValid, now)
 	ingestTime := parseOptionalTimeOrDefault(r.IngestTime, now)
 	processTime := parseOptionalTime(r.ProcessTime)
 
-	if len(r.PayloadJSON) == 0 {
-		r.PayloadJSON = append(r.PayloadJSON, rawValue...)
-	}
-	if !json.Valid(r.PayloadJSON) {
-		return nil, fmt.Errorf("payload_json is invalid json")
-	}
-
-	return []any{
+	args := make([]any, 0, len(rawColumns))
+	args = append(args,
 		eventTime,
 		ingestTime,
 		processTime,
@@ -31,59 +66,9 @@ func (r *StorageRecord) toInsertArgs(rawValue []byte) ([]any, error) {
 		r.ParserVersion,
 		r.QualityCode,
 		eventTimeValid,
-		r.WmodeU1,
-		r.WmodeU2,
-		r.FCpU11,
-		r.FCpU12,
-		r.FCpU21,
-		r.FCpU22,
-		r.ICpU11,
-		r.ICpU12,
-		r.ICpU21,
-		r.ICpU22,
-		r.SuckpU11,
-		r.SuckpU12,
-		r.SuckpU21,
-		r.SuckpU22,
-		r.HighpressU11,
-		r.HighpressU12,
-		r.HighpressU21,
-		r.HighpressU22,
-		r.FasU1,
-		r.FasU2,
-		r.RasU1,
-		r.RasU2,
-		r.PresdiffU1,
-		r.PresdiffU2,
-		r.AqCo2U1,
-		r.AqCo2U2,
-		r.AqTvocU1,
-		r.AqTvocU2,
-		r.AqPm25U1,
-		r.AqPm25U2,
-		r.AqPm10U1,
-		r.AqPm10U2,
-		r.BocfltEfU11,
-		r.BocfltEfU12,
-		r.BocfltEfU21,
-		r.BocfltEfU22,
-		r.BocfltCfU11,
-		r.BocfltCfU12,
-		r.BocfltCfU21,
-		r.BocfltCfU22,
-		r.BlpfltCompU11,
-		r.BlpfltCompU12,
-		r.BlpfltCompU21,
-		r.BlpfltCompU22,
-		r.BscfltCompU11,
-		r.BscfltCompU12,
-		r.BscfltCompU21,
-		r.BscfltCompU22,
-		r.BfltTempover,
-		r.BfltDiffpresU1,
-		r.BfltDiffpresU2,
-		r.PayloadJSON,
-	}, nil
+	)
+	args = append(args, r.Values...)
+	return append(args, r.PayloadJSON)
 }
 
 func (r *EventFlatRecord) toEventInsertArgs() ([]any, error) {
@@ -106,6 +91,86 @@ func (r *EventFlatRecord) toEventInsertArgs() ([]any, error) {
 	}, nil
 }
 
+// batchStatement is one statement queued on the pgx batch.
+type batchStatement struct {
+	sql  string
+	args []any
+}
+
+// episodeStatements resolves the device's open episodes missing from the frame,
+// then extends or opens one episode per hit.
+func (f EventFrame) episodeStatements() []batchStatement {
+	now := time.Now().UTC()
+	frameTime, _ := parseEventTime(f.EventTime, true, now)
+	codes := make([]string, 0, len(f.Hits))
+	for _, h := range f.Hits {
+		codes = append(codes, h.FaultCode)
+	}
+
+	out := make([]batchStatement, 0, len(f.Hits)+1)
+	out = append(out, batchStatement{resolveEventSQL, []any{f.DeviceID, f.EventType, frameTime, codes}})
+	for i := range f.Hits {
+		args, _ := f.Hits[i].toEventInsertArgs()
+		out = append(out, batchStatement{upsertEventSQL, args})
+	}
+	return out
+}
+
+func (r *PartHistoryRecord) toPartHistoryInsertArgs() []any {
+	now := time.Now().UTC()
+	replacedAt, _ := parseEventTime(r.ReplacedAt, true, now)
+	return []any{
+		replacedAt,
+		r.LineID,
+		r.TrainID,
+		r.CarriageID,
+		r.DeviceID,
+		r.PartCode,
+		r.PartName,
+		r.CounterField,
+		r.CounterKind,
+		r.Previous,
+		r.Current,
+		r.Payload,
+	}
+}
+
+// decodeReplacement turns a signal-replacement message into part history rows.
+func decodeReplacement(data []byte) ([]PartHistoryRecord, error) {
+	if _, err := eventSchemaVersion(data); err != nil {
+		return nil, err
+	}
+	var ev ReplacementEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	meta := ev.EventMeta
+	lineID, trainID, err := meta.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]PartHistoryRecord, 0, len(ev.Hits))
+	for _, hit := range ev.Hits {
+		payload, _ := json.Marshal(hit)
+		rows = append(rows, PartHistoryRecord{
+			ReplacedAt:   meta.EventTimeText,
+			LineID:       lineID,
+			TrainID:      trainID,
+			CarriageID:   meta.CarriageID,
+			DeviceID:     meta.DeviceID,
+			PartCode:     hit.Code,
+			PartName:     hit.Name,
+			CounterField: hit.Field,
+			CounterKind:  hit.Kind,
+			Previous:     hit.Previous,
+			Current:      hit.Current,
+			Payload:      payload,
+		})
+	}
+	return rows, nil
+}
+
 func parseEventTime(text string, valid bool, fallback time.Time) (time.Time, bool) {
 	if text == "" {
 		return fallback, false
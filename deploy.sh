@@ -88,6 +88,14 @@ fi
 log_step "Step 3: 预置宿主机文件"
 
 # 3a. Connect 配置文件（避免 Docker 创建假目录）
+# 写入链路的传感器列由 storage-adapter 的 rawFields 生成，先校验未漂移（无 go 环境时跳过）
+if command -v go &>/dev/null; then
+    if ! (cd "${SCRIPT_DIR}/connect/cmd/storage-adapter" && go run . -check-mapping "${CONNECT_CONFIG_DIR}"); then
+        log_error "nb67-storage-writer.yaml / nb67-pg-writer.yaml 与 rawFields 不一致，请在 connect/cmd/storage-adapter 下执行 go generate"
+    fi
+else
+    log_warn "未找到 go，跳过 Connect 写入配置与 rawFields 一致性校验"
+fi
 sudo mkdir -p "${HOST_DATA}/connect/config"
 for yaml in nb67-parser.yaml nb67-storage-writer.yaml nb67-event-builder.yaml \
             nb67-event-writer.yaml nb67-pg-writer.yaml; do
@@ -117,7 +125,7 @@ fi
 
 # 3c. init-db SQL 文件
 sudo mkdir -p "${HOST_DATA}/timescaledb/init-db"
-for sql in 01-init.sql 02-migration-20260504.sql 03-migration-20260512.sql 04-migration-20260513.sql 05-migration-20260513.sql; do
+for sql in 01-init.sql 02-migration-20260504.sql 03-migration-20260512.sql 04-migration-20260513.sql 05-migration-20260513.sql 06-migration-20261018.sql 07-migration-20261018.sql 08-migration-20261018.sql 09-migration-20261018.sql 10-migration-20261018.sql 11-migration-20261018.sql 12-migration-20261018.sql 13-migration-20261018.sql; do
     src="${BASENV_DIR}/init-db/${sql}"
     if [[ -f "$src" ]]; then
         sudo cp "$src" "${HOST_DATA}/timescaledb/init-db/"
@@ -125,13 +133,17 @@ for sql in 01-init.sql 02-migration-20260504.sql 03-migration-20260512.sql 04-mi
         log_error "找不到 SQL 文件: ${src}"
     fi
 done
-log_info "数据库初始化 SQL 就位 (5个文件)"
+log_info "数据库初始化 SQL 就位 (13个文件)"
 
 # 3d. mock-platform 源码（report 环境 ground-reporter 用）
 sudo mkdir -p "${HOST_DATA}/connect/tests/mock-platform"
 sudo cp "${MOCK_PLATFORM_DIR}/main.go" "${HOST_DATA}/connect/tests/mock-platform/"
 log_info "mock-platform 源码就位"
 
+# 3e. ground-reporter 持久化状态目录（报警跟踪状态 + 平台报送 outbox）
+sudo mkdir -p "${HOST_DATA}/ground-reporter/state"
+log_info "ground-reporter 状态目录就位"
+
 # ── Step 4: 按序启动三个栈 ───────────────────────────────────────────────
 log_step "Step 4: 启动容器栈"
 
@@ -195,6 +207,22 @@ run_sql "04-migration-20260513.sql（WARN_CABIN_OVERHEAT 阈值修正）" \
     "${HOST_DATA}/timescaledb/init-db/04-migration-20260513.sql"
 run_sql "05-migration-20260513.sql（PHM策略+出厂默认+测试模式）" \
     "${HOST_DATA}/timescaledb/init-db/05-migration-20260513.sql"
+run_sql "06-migration-20261018.sql（rule_state 规则计时器持久化）" \
+    "${HOST_DATA}/timescaledb/init-db/06-migration-20261018.sql"
+run_sql "07-migration-20261018.sql（warning_rule 声明式预警规则）" \
+    "${HOST_DATA}/timescaledb/init-db/07-migration-20261018.sql"
+run_sql "08-migration-20261018.sql（warning_config NOTIFY 热加载）" \
+    "${HOST_DATA}/timescaledb/init-db/08-migration-20261018.sql"
+run_sql "09-migration-20261018.sql（部件计数器基线 + part_history 更换履历）" \
+    "${HOST_DATA}/timescaledb/init-db/09-migration-20261018.sql"
+run_sql "10-migration-20261018.sql（部件寿命配置 WARN_LIFE_* + default_params）" \
+    "${HOST_DATA}/timescaledb/init-db/10-migration-20261018.sql"
+run_sql "11-migration-20261018.sql（fact_event 发作周期 last_seen_time / hit_count）" \
+    "${HOST_DATA}/timescaledb/init-db/11-migration-20261018.sql"
+run_sql "12-migration-20261018.sql（rule_state 规则已触发标记 fired）" \
+    "${HOST_DATA}/timescaledb/init-db/12-migration-20261018.sql"
+run_sql "13-migration-20261018.sql（fact_event 已恢复发作索引 ix_fact_event_resolved）" \
+    "${HOST_DATA}/timescaledb/init-db/13-migration-20261018.sql"
 
 # 验证表存在
 TABLE_COUNT=$(${DOCKER} exec timescaledb psql -U postgres postgres -tAc \
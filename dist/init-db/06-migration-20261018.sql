@@ -0,0 +1,20 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H1. 新建 hvac.rule_state 表，持久化 nb67_event_builder 的规则计时器
+--       （state_backend: postgres），使持续时间门控跨重启延续
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- ----------------------------------------------------------------------------
+-- H1. hvac.rule_state：一行对应一个正在计时的规则条件
+--     state_key = device_id || ':' || rule_code（与 Go 内存 key 相同）
+--     first_seen 为条件首次满足时的消息时间（非系统时间）
+-- ----------------------------------------------------------------------------
+CREATE TABLE IF NOT EXISTS hvac.rule_state (
+    state_key   VARCHAR(192) PRIMARY KEY,
+    first_seen  TIMESTAMPTZ  NOT NULL,
+    updated_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE hvac.rule_state IS 'event-builder 规则持续时间计时器快照，启动时恢复，定期 checkpoint';
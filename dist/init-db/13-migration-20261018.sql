@@ -0,0 +1,13 @@
+-- =============================================================================
+-- Migration: 2026-10-18
+-- 变更内容：
+--   H10. storage-adapter 新开发作周期前检查同一设备、事件类型、故障码是否已有覆盖该帧时间的
+--        已恢复发作（event_time <= 帧时间 <= recovery_time），避免发作关闭后重投的中间帧
+--        再开一条发作记录（见 connect/cmd/storage-adapter/consumer.go upsertEventSQL）
+-- 说明：所有语句幂等，可重复执行
+-- =============================================================================
+
+-- 查找已恢复的发作周期（与 ix_fact_event_open 互补）
+CREATE INDEX IF NOT EXISTS ix_fact_event_resolved
+    ON hvac.fact_event (device_id, event_type, fault_code, event_time DESC)
+    WHERE recovery_time IS NOT NULL;
@@ -1,20 +1,47 @@
 // mock-platform: 模拟地面健康管理平台的接收端
 // 监听 8188 端口，接受 ground-reporter 的三类 POST 请求，
-// 将收到的 JSON 格式化打印到控制台，并返回成功响应。
+// 将收到的 JSON 格式化打印到控制台，并返回平台响应信封（默认成功）。
 //
 // 用法:
 //   go run main.go
 //   go run main.go -port 8188
+//   go run main.go -reply-code 400 -reply-message "参数校验失败"   # 模拟 HTTP 200 + 业务错误码
+//
+// 鉴权校验（对应 ground-reporter 的 PLATFORM_AUTH_MODE，校验失败返回 HTTP 401 + 信封）:
+//   go run main.go -auth apikey -api-key secret123
+//   go run main.go -auth oauth2 -client-id gr -client-secret s3cret -token-ttl 60s   # 令牌端点 POST /oauth/token
+//   go run main.go -auth hmac -hmac-key-id gr -hmac-secret s3cret
+//   go run main.go -auth mtls -tls-cert server.crt -tls-key server.key -tls-client-ca ca.crt
+//
+// mtls 模式监听 HTTPS 并要求客户端证书；/ping 另在 127.0.0.1:<health-port>（默认 8189）以明文 HTTP
+// 提供，不校验鉴权，docker-compose 健康检查走该端口，任何鉴权模式下均可用。
+// 测试证书可用 openssl 生成：
+//   openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj /CN=mock-ca -keyout ca.key -out ca.crt
+//   openssl req -newkey rsa:2048 -nodes -subj /CN=mock-platform -addext subjectAltName=DNS:mock-platform,DNS:localhost -keyout server.key -out server.csr
+//   openssl x509 -req -in server.csr -CA ca.crt -CAkey ca.key -CAcreateserial -days 365 -copy_extensions copy -out server.crt
+//   openssl req -newkey rsa:2048 -nodes -subj /CN=ground-reporter -keyout client.key -out client.csr
+//   openssl x509 -req -in client.csr -CA ca.crt -CAkey ca.key -CAcreateserial -days 365 -out client.crt
 package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,28 +51,197 @@ var knownPaths = map[string]string{
 	"/gate/METRO-PHM/api/devices/status/train/saveOrUpdate":          "6.7 寿命状态写入",
 }
 
+var (
+	replyCode    = flag.Int("reply-code", 200, "响应信封中的业务码（200=成功，其他值模拟平台业务错误）")
+	replyMessage = flag.String("reply-message", "操作成功", "响应信封中的 message")
+
+	authMode     = flag.String("auth", "none", "鉴权校验模式: none | apikey | oauth2 | hmac | mtls")
+	apiKey       = flag.String("api-key", "", "apikey 模式期望的 X-Api-Key")
+	clientID     = flag.String("client-id", "", "oauth2 模式的 client_id")
+	clientSecret = flag.String("client-secret", "", "oauth2 模式的 client_secret")
+	tokenTTL     = flag.Duration("token-ttl", time.Hour, "oauth2 模式签发令牌的有效期")
+	hmacKeyID    = flag.String("hmac-key-id", "", "hmac 模式期望的 X-Key-Id")
+	hmacSecret   = flag.String("hmac-secret", "", "hmac 模式的签名密钥")
+	hmacSkew     = flag.Duration("hmac-skew", 5*time.Minute, "hmac 模式允许的 X-Timestamp 偏差")
+	tlsCert      = flag.String("tls-cert", "", "服务端证书（设置后监听 HTTPS）")
+	tlsKey       = flag.String("tls-key", "", "服务端私钥")
+	tlsClientCA  = flag.String("tls-client-ca", "", "mtls 模式校验客户端证书的 CA")
+)
+
 func main() {
 	port := flag.Int("port", 8188, "监听端口")
+	healthPort := flag.Int("health-port", 8189, "健康检查端口（仅 127.0.0.1，明文 HTTP，只提供 /ping；0=关闭）")
 	flag.Parse()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ping", func(w http.ResponseWriter, _ *http.Request) {
+	ping := func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
-	})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", ping)
+	mux.HandleFunc("/oauth/token", handleToken)
 	mux.HandleFunc("/", handleRequest)
 
 	addr := fmt.Sprintf("0.0.0.0:%d", *port)
-	log.Printf("mock-platform 启动，监听 %s", addr)
+	log.Printf("mock-platform 启动，监听 %s，鉴权模式 %s", addr, *authMode)
 	log.Printf("已注册接口：")
 	for path, name := range knownPaths {
 		log.Printf("  POST %s  →  %s", path, name)
 	}
 
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if *healthPort > 0 {
+		healthMux := http.NewServeMux()
+		healthMux.HandleFunc("/ping", ping)
+		healthAddr := fmt.Sprintf("127.0.0.1:%d", *healthPort)
+		go func() {
+			if err := http.ListenAndServe(healthAddr, healthMux); err != nil {
+				log.Fatalf("健康检查端口启动失败: %v", err)
+			}
+		}()
+		log.Printf("健康检查：GET http://%s/ping", healthAddr)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	if *authMode == "mtls" {
+		if *tlsCert == "" || *tlsKey == "" || *tlsClientCA == "" {
+			log.Fatalf("mtls 模式需要 -tls-cert -tls-key -tls-client-ca")
+		}
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			log.Fatalf("读取客户端 CA 失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("客户端 CA 中没有证书: %s", *tlsClientCA)
+		}
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+
+	var err error
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("启动失败: %v", err)
 	}
 }
 
+// ── 鉴权校验 ─────────────────────────────────────────────────
+
+var (
+	tokensMu sync.Mutex
+	tokens   = map[string]time.Time{} // 已签发 oauth2 令牌 → 过期时间
+	noncesMu sync.Mutex
+	nonces   = map[string]time.Time{} // hmac 已用 nonce → 首次出现时间（防重放）
+)
+
+// handleToken 模拟 OAuth2 client-credentials 令牌端点（client 以 HTTP Basic 认证）。
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if r.PostFormValue("grant_type") != "client_credentials" || id != *clientID || secret != *clientSecret {
+		log.Printf("oauth2 令牌申请被拒绝: client_id=%q grant_type=%q", id, r.PostFormValue("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	tokensMu.Lock()
+	tokens[token] = time.Now().Add(*tokenTTL)
+	tokensMu.Unlock()
+	log.Printf("oauth2 签发令牌 %s…（有效期 %v）", token[:8], *tokenTTL)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int64(tokenTTL.Seconds()),
+	})
+}
+
+// checkAuth 按 -auth 模式校验请求，返回空串表示通过，否则返回失败原因。
+func checkAuth(r *http.Request, body []byte) string {
+	switch *authMode {
+	case "none":
+		return ""
+	case "apikey":
+		if r.Header.Get("X-Api-Key") != *apiKey {
+			return "X-Api-Key 不匹配"
+		}
+	case "oauth2":
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return "缺少 Bearer 令牌"
+		}
+		tokensMu.Lock()
+		exp, known := tokens[token]
+		tokensMu.Unlock()
+		if !known {
+			return "未知令牌"
+		}
+		if time.Now().After(exp) {
+			return "令牌已过期"
+		}
+	case "hmac":
+		return checkHMAC(r, body)
+	case "mtls":
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "未提供客户端证书"
+		}
+	default:
+		return "未知鉴权模式 " + *authMode
+	}
+	return ""
+}
+
+// checkHMAC 校验签名：HMAC-SHA256(secret, METHOD\nPATH\nX-Timestamp\nX-Nonce\nX-Content-SHA256)，
+// 与 ground-reporter auth.go 的 hmacSignature 一致。
+func checkHMAC(r *http.Request, body []byte) string {
+	if r.Header.Get("X-Key-Id") != *hmacKeyID {
+		return "X-Key-Id 不匹配"
+	}
+	ts, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "X-Timestamp 无效"
+	}
+	if d := time.Since(time.UnixMilli(ms)); d > *hmacSkew || d < -*hmacSkew {
+		return "X-Timestamp 超出允许偏差"
+	}
+	sum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Content-SHA256") != bodyHash {
+		return "X-Content-SHA256 与 body 不符"
+	}
+
+	mac := hmac.New(sha256.New, []byte(*hmacSecret))
+	mac.Write([]byte(strings.Join([]string{r.Method, r.URL.EscapedPath(), ts, nonce, bodyHash}, "\n")))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("X-Signature")), []byte(want)) {
+		return "X-Signature 校验失败"
+	}
+
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	for n, seen := range nonces {
+		if time.Since(seen) > 2**hmacSkew {
+			delete(nonces, n)
+		}
+	}
+	if _, dup := nonces[nonce]; dup || nonce == "" {
+		return "X-Nonce 重放"
+	}
+	nonces[nonce] = time.Now()
+	return ""
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	ts := time.Now().Format("15:04:05.000")
 
@@ -68,21 +264,35 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		pretty.Write(body) // 格式化失败就原样输出
 	}
 
-	apiKey := r.Header.Get("X-Api-Key")
-	if apiKey == "" {
-		apiKey = "(未设置)"
+	gotKey := r.Header.Get("X-Api-Key")
+	if gotKey == "" {
+		gotKey = "(未设置)"
 	}
+	authErr := checkAuth(r, body)
 
 	sep := "─────────────────────────────────────────────────"
 	fmt.Printf("\n%s\n", sep)
 	fmt.Printf("[%s]  %s\n", ts, name)
 	fmt.Printf("路径: %s %s\n", r.Method, r.URL.Path)
-	fmt.Printf("X-Api-Key: %s\n", apiKey)
+	fmt.Printf("X-Api-Key: %s\n", gotKey)
 	fmt.Printf("Body:\n%s\n", pretty.String())
 	fmt.Printf("%s\n", sep)
 
-	// 返回平台标准成功响应
+	if authErr != "" {
+		fmt.Printf("鉴权失败 (%s): %s\n", *authMode, authErr)
+		resp, _ := json.Marshal(map[string]any{"code": http.StatusUnauthorized, "message": "鉴权失败: " + authErr, "entity": nil})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write(resp)
+		return
+	}
+
+	// 返回平台标准响应信封（业务错误同样是 HTTP 200，由 code 区分）
+	if *replyCode != 200 {
+		fmt.Printf("返回业务错误: code=%d message=%s\n", *replyCode, *replyMessage)
+	}
+	resp, _ := json.Marshal(map[string]any{"code": *replyCode, "message": *replyMessage, "entity": nil})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"code":200,"message":"操作成功","entity":null}`))
+	_, _ = w.Write(resp)
 }
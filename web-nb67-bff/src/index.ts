@@ -10,7 +10,7 @@ import { sql } from 'kysely';
 import { KafkaManager } from './config/kafka.js';
 import { HistoryRepository, TREND_PARAM_DEFS } from './repository/history.repository.js';
 import { StatusRepository } from './repository/status.repository.js';
-import { formatTime } from './utils/time.js';
+import { formatTime, formatEpisodeDuration } from './utils/time.js';
 
 const fastify = Fastify({
     logger: {
@@ -296,6 +296,8 @@ async function bootstrap() {
                         fault_level: level,
                         occurrence_time: formatTime(row[config.runtime === 'DEV' ? 'ingest_time' : 'event_time']),
                         recovery_time: row.recovery_time ? formatTime(row.recovery_time) : null,
+                        duration: formatEpisodeDuration(row),
+                        hit_count: row.hit_count ?? 1,
                         status: row.recovery_time ? '已恢复' : '活动'
                     };
                 });
@@ -306,7 +308,7 @@ async function bootstrap() {
                     fault_code: row.fault_code,
                     name: row.fault_name,
                     start_time: formatTime(row[config.runtime === 'DEV' ? 'ingest_time' : 'event_time']),
-                    end_time: null,
+                    end_time: row.recovery_time ? formatTime(row.recovery_time) : null,
                     state: `${row.train_id}${String(row.carriage_id).padStart(2, '0')}1`
                 }));
 
@@ -541,7 +543,7 @@ async function bootstrap() {
             const formatUnit = (code: string) => code?.toLowerCase().includes('u2') ? '机组二' : code?.toLowerCase().includes('u1') ? '机组一' : '-';
             const CARRIAGE_MAP: Record<string, string> = { '1':'TC1','2':'MP1','3':'M1','4':'M2','5':'MP2','6':'TC2' };
 
-            const headers = ['列车号','车厢','机组','严重级别','故障详情','开始时间','结束时间','状态'];
+            const headers = ['列车号','车厢','机组','严重级别','故障详情','开始时间','结束时间','持续时长','命中次数','状态'];
             const rows = result.list.map((r: any) => {
                 // 报警导出 severity：1→正常 2→中等 3→严重
                 const level = r.severity === 3 ? '严重' : r.severity === 2 ? '中等' : '正常';
@@ -553,6 +555,8 @@ async function bootstrap() {
                     r.fault_name || '',
                     formatTime(r[config.runtime === 'DEV' ? 'ingest_time' : 'event_time']),
                     r.recovery_time ? formatTime(r.recovery_time) : '',
+                    formatEpisodeDuration(r),
+                    r.hit_count ?? 1,
                     r.recovery_time ? '已恢复' : '活动'
                 ].map((v: any) => `"${String(v).replace(/"/g, '""')}"`).join(',');
             });
@@ -643,6 +647,8 @@ async function bootstrap() {
                     trigger_condition: getTriggerCondition(row),
                     start_time: formatTime(row.occurrence_start ?? row[config.runtime === 'DEV' ? 'ingest_time' : 'event_time']),
                     end_time: row.recovery_time ? formatTime(row.recovery_time) : null,
+                    duration: formatEpisodeDuration(row),
+                    hit_count: row.hit_count ?? 1,
                 }));
 
                 return { code: 200, data: { list, total: result.total } };
@@ -667,7 +673,7 @@ async function bootstrap() {
 
             const CARRIAGE_MAP: Record<string, string> = { '1':'TC1','2':'MP1','3':'M1','4':'M2','5':'MP2','6':'TC2' };
             const formatUnit = (code: string) => code?.toLowerCase().includes('u2') ? '机组二' : code?.toLowerCase().includes('u1') ? '机组一' : '-';
-            const headers = ['列车号','车厢','机组','严重级别','预警名称','触发条件','开始时间','结束时间'];
+            const headers = ['列车号','车厢','机组','严重级别','预警名称','触发条件','开始时间','结束时间','持续时长','命中次数'];
             const rows = result.list.map((r: any) => {
                 return [
                     `0${r.train_id}`,
@@ -677,7 +683,9 @@ async function bootstrap() {
                     r.fault_name || '',
                     r.trigger_condition || '',
                     formatTime(r.occurrence_start ?? r[config.runtime === 'DEV' ? 'ingest_time' : 'event_time']),
-                    r.recovery_time ? formatTime(r.recovery_time) : ''
+                    r.recovery_time ? formatTime(r.recovery_time) : '',
+                    formatEpisodeDuration(r),
+                    r.hit_count ?? 1
                 ].map((v: any) => `"${String(v).replace(/"/g, '""')}"`).join(',');
             });
 
@@ -575,7 +575,7 @@ export class StatusRepository {
             .select([
                 'e.event_time', 'e.ingest_time', 'e.train_id', 'e.carriage_id',
                 'e.fault_code', 'e.fault_name', 'e.severity', 'e.status',
-                'e.recovery_time' as any,
+                'e.recovery_time' as any, 'e.last_seen_time' as any, 'e.hit_count' as any,
                 'wc.strategy as trigger_condition' as any,
             ])
             .orderBy(`e.${this.timeCol}` as any, 'desc')
@@ -601,6 +601,7 @@ export class StatusRepository {
         const filteredTotal = list.length;
 
         // 计算每行的"发作起始时间"：同一故障连续触发共享同一 start_time，60s 无触发视为新的发作序列
+        // （storage-adapter 按发作周期写入的行 event_time 即起始时间，此处仅对逐帧写入的存量行起作用）
         const GAP_MS = 60_000;
         const tCol = this.timeCol;
         const asc = [...list].sort((a: any, b: any) => {
@@ -615,6 +616,11 @@ export class StatusRepository {
         for (const row of asc) {
             const k = `${(row as any).train_id}:${(row as any).carriage_id}:${(row as any).fault_code}`;
             const t = new Date((row as any)[tCol]).getTime();
+            if ((row as any).last_seen_time) {
+                // 按发作周期写入的行：event_time 即起始时间
+                startByRow.set(row, new Date(t));
+                continue;
+            }
             const prev = lastSeen[k];
             if (prev === undefined || t - prev > GAP_MS) {
                 islandStart[k] = new Date(t);
@@ -651,10 +657,14 @@ export class StatusRepository {
         unit?: string;
         strategy?: string;
         enabled?: boolean;
+        params?: Record<string, any>;   // 寿命类（category=life）: raw_scale / warn_pct / crit_pct / overrides
     }) {
+        // JSONB 列显式序列化，避免驱动把对象内的数组转成 PG 数组字面量
+        const { params, ...rest } = data;
+        const values: any = params === undefined ? rest : { ...rest, params: JSON.stringify(params) };
         return await db
             .updateTable('hvac.warning_config' as any)
-            .set(data as any)
+            .set(values)
             .where('id', '=', id)
             .execute();
     }
@@ -668,7 +678,8 @@ export class StatusRepository {
                     threshold_good   = default_threshold_good,
                     threshold_normal = default_threshold_normal,
                     threshold_bad    = default_threshold_bad,
-                    strategy         = default_strategy
+                    strategy         = default_strategy,
+                    params           = COALESCE(default_params, params)
                 WHERE id = ${sql.lit(id)}
                   AND default_trigger_value IS NOT NULL`.compile(db)
         );
@@ -77,6 +77,9 @@ export interface FactEventTable {
     fault_name: string | null;
     severity: number | null;
     status: string | null;
+    recovery_time: Date | null;     // 发作结束时间，NULL = 仍在发作
+    last_seen_time: Date | null;    // 发作期间最后一次命中（11-migration 之后写入）
+    hit_count: number;              // 发作期间命中帧数
     payload_json: any | null;
 }
 
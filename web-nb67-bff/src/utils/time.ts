@@ -20,5 +20,20 @@ export const formatTime = (date: any, format = 'YYYY-MM-DD HH:mm:ss') => {
     return dayjs.tz(date).format(format)
 }
 
+/**
+ * 事件发作时长：event_time 至 recovery_time（仍在发作则至 last_seen_time）
+ * @param row hvac.fact_event 行
+ * @returns 如 "2小时5分钟"；逐帧写入的存量行没有 last_seen_time，返回 '-'
+ */
+export const formatEpisodeDuration = (row: any) => {
+    if (!row?.last_seen_time) return '-'
+    const end = row.recovery_time ?? row.last_seen_time
+    const sec = Math.max(0, dayjs(end).diff(dayjs(row.event_time), 'second'))
+    if (sec < 60) return `${sec}秒`
+    const h = Math.floor(sec / 3600)
+    const m = Math.floor((sec % 3600) / 60)
+    return h > 0 ? `${h}小时${m}分钟` : `${m}分钟`
+}
+
 export { dayjs }
 export default dayjs